@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/fatih/color"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// planAction is what `apply` does to one VM.
+type planAction string
+
+const (
+	actionCreate   planAction = "create"
+	actionUpdate   planAction = "update"
+	actionRecreate planAction = "recreate" // fresh VM record, runtime state dropped
+	actionDelete   planAction = "delete"   // only with --prune
+)
+
+// recreateKeys change what the VM is rather than how it runs, so the VM
+// is recreated instead of updated.
+var recreateKeys = map[string]bool{"image": true, "arch": true}
+
+// restartKeys need a running VM to be restarted to take effect.
+var restartKeys = map[string]bool{
+	"ram": true, "cpu": true, "ssh_port": true, "vnc_port": true, "image": true,
+	"accel": true, "arch": true, "firmware": true, "forwards": true, "pid_file": true, "log_file": true,
+}
+
+// specKeys are the VM keys a spec manages, in display order. A key missing
+// from the spec is unset, so it falls back to the defaults.
+func specKeys() []string {
+	var keys []string
+	for _, s := range vmSettings {
+		keys = append(keys, s.Key)
+	}
+	var extra []string
+	for key := range settableVMKeys {
+		extra = append(extra, key)
+	}
+	sort.Strings(extra)
+	return append(keys, extra...)
+}
+
+func keyValue(vm VMConfig, key string) string {
+	field, _ := fieldByPath(reflect.ValueOf(&vm).Elem(), key)
+	return formatValue(field)
+}
+
+// planChange is one key that differs between the config and the spec.
+type planChange struct {
+	Key  string `json:"key"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// planStep is what happens to one VM.
+type planStep struct {
+	VM      string       `json:"vm"`
+	Action  planAction   `json:"action"`
+	Changes []planChange `json:"changes,omitempty"`
+	Running bool         `json:"running"` // stopped first if Restart or deleted
+	Restart bool         `json:"restart"` // started again afterwards
+}
+
+// applyPlan turns a config into what a spec describes.
+type applyPlan struct {
+	Defaults []planChange `json:"defaults,omitempty"`
+	Steps    []planStep   `json:"steps,omitempty"`
+}
+
+func (p applyPlan) empty() bool {
+	return len(p.Defaults) == 0 && len(p.Steps) == 0
+}
+
+// loadSpec reads a spec file: a config in any format, of which only the
+// vms and defaults blocks are used.
+func loadSpec(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if data, err = configToJSON(configFormat(path), data); err != nil {
+		return Config{}, err
+	}
+
+	var spec Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return Config{}, err
+	}
+	for name, vm := range spec.VMs {
+		if vm.Name != "" && vm.Name != name {
+			return Config{}, fmt.Errorf("vms.%s has name '%s'", name, vm.Name)
+		}
+	}
+	return spec, nil
+}
+
+// planApply compares config with spec. VMs not in the spec are deleted
+// only when prune is set; a spec without a defaults block leaves the
+// config's defaults alone.
+func planApply(config Config, spec Config, prune bool) (applyPlan, error) {
+	var plan applyPlan
+
+	defaults := config.Defaults
+	if spec.Defaults != nil {
+		defaults = spec.Defaults
+		var keys []string
+		for key := range config.Defaults {
+			keys = append(keys, key)
+		}
+		for key := range spec.Defaults {
+			if _, ok := config.Defaults[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if from, to := config.Defaults[key], spec.Defaults[key]; from != to {
+				plan.Defaults = append(plan.Defaults, planChange{Key: key, From: from, To: to})
+			}
+		}
+	}
+
+	names := make([]string, 0, len(spec.VMs))
+	for name := range spec.VMs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		want := spec.VMs[name]
+		current, exists := config.VMs[name]
+		if !exists {
+			step := planStep{VM: name, Action: actionCreate}
+			for _, key := range specKeys() {
+				if value := keyValue(want, key); value != "" {
+					step.Changes = append(step.Changes, planChange{Key: key, To: value})
+				}
+			}
+			plan.Steps = append(plan.Steps, step)
+			continue
+		}
+
+		step := planStep{VM: name, Action: actionUpdate, Running: current.Status.Active()}
+		for _, key := range specKeys() {
+			if from, to := keyValue(current, key), keyValue(want, key); from != to {
+				step.Changes = append(step.Changes, planChange{Key: key, From: from, To: to})
+			}
+		}
+
+		// What the VM runs with can change through the defaults alone.
+		before, _, err := resolveVM(config.Defaults, current, settingOverrides{})
+		if err != nil {
+			return applyPlan{}, fmt.Errorf("VM '%s': %v", name, err)
+		}
+		after, _, err := resolveVM(defaults, want, settingOverrides{})
+		if err != nil {
+			return applyPlan{}, fmt.Errorf("vms.%s in spec: %v", name, err)
+		}
+		effective := false
+		for _, key := range specKeys() {
+			if keyValue(before, key) == keyValue(after, key) {
+				continue
+			}
+			effective = true
+			if recreateKeys[key] {
+				step.Action = actionRecreate
+			}
+			if restartKeys[key] {
+				step.Restart = step.Running
+			}
+		}
+
+		if len(step.Changes) > 0 || effective {
+			plan.Steps = append(plan.Steps, step)
+		}
+	}
+
+	if prune {
+		var stale []string
+		for name := range config.VMs {
+			if _, ok := spec.VMs[name]; !ok {
+				stale = append(stale, name)
+			}
+		}
+		sort.Strings(stale)
+		for _, name := range stale {
+			plan.Steps = append(plan.Steps, planStep{VM: name, Action: actionDelete, Running: config.VMs[name].Status.Active()})
+		}
+	}
+
+	return plan, nil
+}
+
+// applyTo makes config match spec as planned.
+func (p applyPlan) applyTo(config *Config, spec Config) {
+	if spec.Defaults != nil {
+		config.Defaults = nil
+		for key, value := range spec.Defaults {
+			if config.Defaults == nil {
+				config.Defaults = map[string]string{}
+			}
+			config.Defaults[key] = value
+		}
+	}
+
+	for _, step := range p.Steps {
+		switch step.Action {
+		case actionCreate, actionRecreate:
+			vm := VMConfig{Name: step.VM, Status: StateStopped, Created: time.Now()}
+			copySpecKeys(&vm, spec.VMs[step.VM])
+			if config.VMs == nil {
+				config.VMs = map[string]VMConfig{}
+			}
+			config.VMs[step.VM] = vm
+		case actionUpdate:
+			vm := config.VMs[step.VM]
+			copySpecKeys(&vm, spec.VMs[step.VM])
+			config.VMs[step.VM] = vm
+		case actionDelete:
+			delete(config.VMs, step.VM)
+		}
+	}
+}
+
+func copySpecKeys(dst *VMConfig, src VMConfig) {
+	for _, key := range specKeys() {
+		field, _ := fieldByPath(reflect.ValueOf(dst).Elem(), key)
+		setValue(field, keyValue(src, key))
+	}
+}
+
+// cloneConfig copies config deeply enough for applyTo to change the copy.
+func cloneConfig(config Config) Config {
+	clone := config
+	clone.VMs = make(map[string]VMConfig, len(config.VMs))
+	for name, vm := range config.VMs {
+		clone.VMs[name] = vm
+	}
+	clone.Defaults = make(map[string]string, len(config.Defaults))
+	for key, value := range config.Defaults {
+		clone.Defaults[key] = value
+	}
+	return clone
+}
+
+// sameChanges reports whether two plans change the same things, ignoring
+// which VMs are running.
+func sameChanges(a, b applyPlan) bool {
+	strip := func(p applyPlan) applyPlan {
+		steps := make([]planStep, len(p.Steps))
+		for i, step := range p.Steps {
+			steps[i] = planStep{VM: step.VM, Action: step.Action, Changes: step.Changes}
+		}
+		return applyPlan{Defaults: p.Defaults, Steps: steps}
+	}
+	return reflect.DeepEqual(strip(a), strip(b))
+}
+
+// printPlan shows the plan as a diff.
+func printPlan(plan applyPlan) {
+	for _, change := range plan.Defaults {
+		color.Yellow("~ defaults.%s: %s → %s", change.Key, orUnset(change.From), orUnset(change.To))
+	}
+
+	counts := map[planAction]int{}
+	restarts := 0
+	for _, step := range plan.Steps {
+		counts[step.Action]++
+		note := ""
+		if step.Restart {
+			restarts++
+			note = " (restart)"
+		} else if step.Running && step.Action == actionDelete {
+			note = " (stop)"
+		}
+
+		switch step.Action {
+		case actionCreate:
+			color.Green("+ create %s", step.VM)
+		case actionUpdate:
+			color.Yellow("~ update %s%s", step.VM, note)
+		case actionRecreate:
+			color.Yellow("± recreate %s%s", step.VM, note)
+		case actionDelete:
+			color.Red("- delete %s%s", step.VM, note)
+		}
+		for _, change := range step.Changes {
+			if step.Action == actionCreate {
+				fmt.Printf("    + %s = %s\n", change.Key, change.To)
+			} else {
+				fmt.Printf("    ~ %s: %s → %s\n", change.Key, orUnset(change.From), orUnset(change.To))
+			}
+		}
+	}
+
+	color.Cyan("\nPlan: %d to create, %d to update, %d to recreate, %d to delete, %d restart(s)",
+		counts[actionCreate], counts[actionUpdate], counts[actionRecreate], counts[actionDelete], restarts)
+}
+
+func orUnset(value string) string {
+	if value == "" {
+		return "(unset)"
+	}
+	return value
+}
+
+// applySpec is the `avm-go apply` action.
+func applySpec(c *cli.Context) error {
+	file := c.String("file")
+	if file == "" {
+		return fmt.Errorf("a spec file is required (-f)")
+	}
+	spec, err := loadSpec(expandPath(file))
+	if err != nil {
+		return fmt.Errorf("failed to read spec %s: %v", file, err)
+	}
+
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	prune := c.Bool("prune")
+	plan, err := planApply(config, spec, prune)
+	if err != nil {
+		return err
+	}
+	if plan.empty() {
+		color.Green("✅ No changes; the config matches %s", file)
+		return nil
+	}
+
+	color.Cyan("📋 Changes to apply from %s:", file)
+	printPlan(plan)
+
+	result := cloneConfig(config)
+	plan.applyTo(&result, spec)
+	violations, _ := settingViolations(result)
+	violations = append(violations, newPortClashes(config, result)...)
+	if err := validateDependencies(result.VMs); err != nil {
+		violations = append(violations, configViolation{Path: "vms", Message: err.Error()})
+	}
+	if err := checkHibernatedSize(config, result); err != nil {
+		violations = append(violations, configViolation{Path: "vms", Message: err.Error()})
+	}
+	if len(violations) > 0 {
+		for _, v := range violations {
+			color.Red("❌ %s: %s", v.Path, v.Message)
+		}
+		return fmt.Errorf("the spec would leave %d problem(s), nothing applied", len(violations))
+	}
+
+	if c.Bool("dry-run") {
+		color.Yellow("⚠️  Dry run, nothing applied")
+		return nil
+	}
+	if !c.Bool("yes") {
+		confirmed := false
+		if err := survey.AskOne(&survey.Confirm{Message: "Apply these changes?"}, &confirmed); err != nil {
+			return err
+		}
+		if !confirmed {
+			color.Yellow("⚠️  Apply cancelled")
+			return nil
+		}
+	}
+
+	if err := stopForApply(configPath, config, plan, c.Duration("timeout")); err != nil {
+		return err
+	}
+
+	_, err = updateConfig(configPath, func(current *Config) error {
+		again, err := planApply(*current, spec, prune)
+		if err != nil {
+			return err
+		}
+		if !sameChanges(again, plan) {
+			return fmt.Errorf("config changed while applying; run apply again")
+		}
+		plan.applyTo(current, spec)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save config: %v", err)
+	}
+
+	// A recreated VM's hibernation image belongs to the old VM.
+	for _, step := range plan.Steps {
+		if saved := config.VMs[step.VM].SavedState; saved != "" && step.Action != actionUpdate {
+			os.Remove(saved)
+		}
+	}
+
+	if err := restartAfterApply(configPath, result, plan); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"action": "apply",
+		"file":   file,
+	}).Info(describePlan(plan))
+	color.Green("✅ Applied %s", file)
+	return nil
+}
+
+// stopForApply stops running VMs that the plan restarts or deletes,
+// dependents first.
+func stopForApply(configPath string, config Config, plan applyPlan, timeout time.Duration) error {
+	stop := map[string]bool{}
+	for _, step := range plan.Steps {
+		if step.Running && (step.Restart || step.Action == actionDelete) {
+			stop[step.VM] = true
+		}
+	}
+	if len(stop) == 0 {
+		return nil
+	}
+
+	all := make([]string, 0, len(config.VMs))
+	for name := range config.VMs {
+		all = append(all, name)
+	}
+	order, err := startOrder(config.VMs, all)
+	if err != nil {
+		return err
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		if !stop[name] {
+			continue
+		}
+		color.Cyan("⏻  Stopping VM '%s'...", name)
+		if _, err := callDaemon(configPath, daemonRequest{Action: "stop", VM: name, Timeout: timeout}); err != nil {
+			return fmt.Errorf("failed to stop VM '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// restartAfterApply starts the VMs stopped for a restart, dependencies
+// first.
+func restartAfterApply(configPath string, result Config, plan applyPlan) error {
+	var names []string
+	for _, step := range plan.Steps {
+		if step.Restart {
+			names = append(names, step.VM)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	order, err := startOrder(result.VMs, names)
+	if err != nil {
+		return err
+	}
+	restart := map[string]bool{}
+	for _, name := range names {
+		restart[name] = true
+	}
+
+	overrides := envOverrides()
+	for _, name := range order {
+		if !restart[name] {
+			continue
+		}
+		resp, err := callDaemon(configPath, daemonRequest{Action: "start", VM: name, Overrides: overrides})
+		if err != nil {
+			return fmt.Errorf("failed to restart VM '%s': %v", name, err)
+		}
+		color.Green("✅ VM '%s' restarted (PID: %d)", name, resp.PID)
+	}
+	return nil
+}
+
+// describePlan is a one-line summary of a plan, for logs.
+func describePlan(plan applyPlan) string {
+	var parts []string
+	for _, step := range plan.Steps {
+		parts = append(parts, fmt.Sprintf("%s %s", step.Action, step.VM))
+	}
+	return strings.Join(parts, ", ")
+}
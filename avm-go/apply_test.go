@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanApply(t *testing.T) {
+	config := Config{
+		VMs: map[string]VMConfig{
+			"web":  {Name: "web", RAM: "2048", CPU: "2", SSHPort: "2222", Image: "web.qcow2", Status: StateRunning},
+			"db":   {Name: "db", RAM: "1024", CPU: "1", SSHPort: "2223", Image: "db.qcow2", Status: StateRunning},
+			"old":  {Name: "old", RAM: "1024", CPU: "1", SSHPort: "2224", Image: "old.qcow2", Status: StateStopped},
+			"same": {Name: "same", RAM: "1024", CPU: "1", SSHPort: "2225", Image: "same.qcow2", Status: StateRunning},
+		},
+	}
+	spec := Config{
+		VMs: map[string]VMConfig{
+			"web":  {RAM: "4G", CPU: "2", SSHPort: "2222", Image: "web.qcow2", Autostart: ptrTo(true)},
+			"db":   {RAM: "1024", CPU: "1", SSHPort: "2223", Image: "db-v2.qcow2"},
+			"new":  {RAM: "512M", SSHPort: "2226", Image: "new.qcow2"},
+			"same": {RAM: "1024", CPU: "1", SSHPort: "2225", Image: "same.qcow2"},
+		},
+	}
+
+	plan, err := planApply(config, spec, true)
+	if err != nil {
+		t.Fatalf("planApply failed: %v", err)
+	}
+
+	expected := map[string]struct {
+		action  planAction
+		restart bool
+	}{
+		"db":  {actionRecreate, true},
+		"new": {actionCreate, false},
+		"old": {actionDelete, false},
+		"web": {actionUpdate, true},
+	}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("Expected %d steps, got %+v", len(expected), plan.Steps)
+	}
+	for _, step := range plan.Steps {
+		want, ok := expected[step.VM]
+		if !ok || step.Action != want.action || step.Restart != want.restart {
+			t.Errorf("Unexpected step %+v", step)
+		}
+	}
+
+	result := cloneConfig(config)
+	plan.applyTo(&result, spec)
+	if _, ok := result.VMs["old"]; ok {
+		t.Error("Expected 'old' to be pruned")
+	}
+	if web := result.VMs["web"]; web.RAM != "4G" || !orZero(web.Autostart) || web.Status != StateRunning {
+		t.Errorf("Unexpected updated VM %+v", web)
+	}
+	if db := result.VMs["db"]; db.Image != "db-v2.qcow2" || db.Status != StateStopped {
+		t.Errorf("Unexpected recreated VM %+v", db)
+	}
+	if again, _ := planApply(result, spec, true); len(again.Steps) != 0 {
+		t.Errorf("Expected applied config to match the spec, got %+v", again.Steps)
+	}
+}
+
+func TestPlanApplyDefaultsOnly(t *testing.T) {
+	config := Config{VMs: map[string]VMConfig{"dev": {Name: "dev", SSHPort: "2222", Status: StateRunning}}}
+	spec := Config{
+		Defaults: map[string]string{"ram": "4G"},
+		VMs:      map[string]VMConfig{"dev": {SSHPort: "2222"}},
+	}
+
+	plan, err := planApply(config, spec, false)
+	if err != nil {
+		t.Fatalf("planApply failed: %v", err)
+	}
+	if len(plan.Defaults) != 1 || len(plan.Steps) != 1 || !plan.Steps[0].Restart {
+		t.Errorf("Expected a defaults change restarting 'dev', got %+v", plan)
+	}
+}
+
+func TestLoadSpecRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vms.yaml")
+	os.WriteFile(path, []byte("vms:\n  dev:\n    rams: 2G\n"), 0644)
+	if _, err := loadSpec(path); err == nil {
+		t.Error("Expected a misspelt key to be rejected")
+	}
+
+	os.WriteFile(path, []byte("vms:\n  dev:\n    ram: 2G\n    depends_on: [db]\n"), 0644)
+	spec, err := loadSpec(path)
+	if err != nil || spec.VMs["dev"].RAM != "2G" || spec.VMs["dev"].DependsOn[0] != "db" {
+		t.Errorf("Unexpected spec %+v, %v", spec, err)
+	}
+}
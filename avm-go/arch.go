@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	ArchX86_64  = "x86_64"
+	ArchAarch64 = "aarch64"
+	ArchRISCV64 = "riscv64"
+
+	FirmwareBIOS = "bios" // the machine's built-in firmware (SeaBIOS on x86)
+	FirmwareUEFI = "uefi" // edk2
+)
+
+// qemuDataDir is where firmware images live inside the proot distro that
+// runs QEMU.
+const qemuDataDir = "/usr/share/qemu"
+
+// archProfile describes how to run one guest architecture.
+type archProfile struct {
+	Binary          string
+	Machine         string
+	HostArch        string // GOARCH that can run this guest under KVM
+	CPUHotplug      bool   // vCPUs can be hot-added up to -smp maxcpus
+	DefaultFirmware string
+	// Firmware arguments by firmware kind; a kind missing here is not
+	// supported for the architecture.
+	Firmware map[string][]string
+}
+
+var archProfiles = map[string]archProfile{
+	ArchX86_64: {
+		Binary:          "qemu-system-x86_64",
+		Machine:         "pc",
+		HostArch:        "amd64",
+		CPUHotplug:      true,
+		DefaultFirmware: FirmwareBIOS,
+		Firmware: map[string][]string{
+			FirmwareBIOS: nil,
+			FirmwareUEFI: {"-bios", qemuDataDir + "/edk2-x86_64-code.fd"},
+		},
+	},
+	ArchAarch64: {
+		Binary:          "qemu-system-aarch64",
+		Machine:         "virt",
+		HostArch:        "arm64",
+		DefaultFirmware: FirmwareUEFI,
+		Firmware: map[string][]string{
+			FirmwareUEFI: {"-bios", qemuDataDir + "/edk2-aarch64-code.fd"},
+		},
+	},
+	ArchRISCV64: {
+		Binary:          "qemu-system-riscv64",
+		Machine:         "virt",
+		HostArch:        "riscv64",
+		DefaultFirmware: FirmwareUEFI,
+		Firmware: map[string][]string{
+			FirmwareUEFI: {"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + qemuDataDir + "/edk2-riscv-code.fd"},
+		},
+	},
+}
+
+// vmArch returns the VM's guest architecture, defaulting to x86_64 for
+// configs written before the field existed.
+func vmArch(vm VMConfig) string {
+	if vm.Arch == "" {
+		return ArchX86_64
+	}
+	return vm.Arch
+}
+
+// vmFirmware returns the VM's firmware kind, defaulting per architecture.
+func vmFirmware(vm VMConfig) string {
+	if vm.Firmware != "" {
+		return vm.Firmware
+	}
+	return archProfiles[vmArch(vm)].DefaultFirmware
+}
+
+// hostArch is the GOARCH of the machine running avm-go; tests override it.
+var hostArch = runtime.GOARCH
+
+// hostCanAccelerate reports whether KVM on this host can run the guest arch.
+func hostCanAccelerate(arch string) bool {
+	return archProfiles[arch].HostArch == hostArch
+}
+
+// validateArch checks the architecture/firmware pair and that the image, if
+// it already exists, looks like it was built for the architecture.
+func validateArch(vm VMConfig) error {
+	arch := vmArch(vm)
+	profile, ok := archProfiles[arch]
+	if !ok {
+		return fmt.Errorf("unsupported architecture '%s' (supported: %s, %s, %s)", arch, ArchX86_64, ArchAarch64, ArchRISCV64)
+	}
+
+	firmware := vmFirmware(vm)
+	if _, ok := profile.Firmware[firmware]; !ok {
+		return fmt.Errorf("firmware '%s' is not available for %s guests", firmware, arch)
+	}
+
+	imageArch, err := detectImageArch(vmImagePath(vm))
+	if err != nil || imageArch == "" {
+		// Missing or unreadable images are reported elsewhere; an image
+		// without recognizable markers gets the benefit of the doubt.
+		return nil
+	}
+	if imageArch != arch {
+		return fmt.Errorf("image %s looks like a %s image but the VM is %s", vm.Image, imageArch, arch)
+	}
+	return nil
+}
+
+// archNameHints maps substrings of image file names to architectures, as
+// used by distribution image names such as alpine-virt-3.18.4-aarch64.iso.
+var archNameHints = []struct {
+	hint string
+	arch string
+}{
+	{"aarch64", ArchAarch64},
+	{"arm64", ArchAarch64},
+	{"riscv64", ArchRISCV64},
+	{"x86_64", ArchX86_64},
+	{"x86-64", ArchX86_64},
+	{"amd64", ArchX86_64},
+}
+
+// efiBootMarkers are the removable-media EFI loader names, which give away
+// the architecture of ISO and disk images.
+var efiBootMarkers = []struct {
+	marker []byte
+	arch   string
+}{
+	{[]byte("BOOTAA64.EFI"), ArchAarch64},
+	{[]byte("BOOTRISCV64.EFI"), ArchRISCV64},
+	{[]byte("BOOTX64.EFI"), ArchX86_64},
+}
+
+// imageScanLimit bounds how much of an image is searched for boot markers.
+const imageScanLimit = 64 << 20
+
+// detectImageArch guesses an image's architecture from its file name, then
+// from EFI loader names near the start of the image. It returns "" when
+// there is no evidence either way.
+func detectImageArch(path string) (string, error) {
+	name := strings.ToLower(filepath.Base(path))
+	for _, h := range archNameHints {
+		if strings.Contains(name, h.hint) {
+			return h.arch, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1<<20)
+	overlap := 16
+	var tail []byte
+	var scanned int64
+	for scanned < imageScanLimit {
+		n, err := f.Read(buf)
+		if n > 0 {
+			chunk := append(tail, buf[:n]...)
+			for _, m := range efiBootMarkers {
+				if bytes.Contains(chunk, m.marker) {
+					return m.arch, nil
+				}
+			}
+			if len(chunk) > overlap {
+				tail = append([]byte(nil), chunk[len(chunk)-overlap:]...)
+			}
+			scanned += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
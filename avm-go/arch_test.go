@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectImageArch(t *testing.T) {
+	dir := t.TempDir()
+
+	byName := filepath.Join(dir, "alpine-virt-3.18.4-aarch64.iso")
+	if arch, _ := detectImageArch(byName); arch != ArchAarch64 {
+		t.Errorf("Expected aarch64 from file name, got %q", arch)
+	}
+
+	byContent := filepath.Join(dir, "disk.img")
+	content := make([]byte, 3<<20)
+	copy(content[(1<<20)-6:], "EFI/BOOT/BOOTX64.EFI") // straddles a read boundary
+	os.WriteFile(byContent, content, 0644)
+	if arch, err := detectImageArch(byContent); err != nil || arch != ArchX86_64 {
+		t.Errorf("Expected x86_64 from EFI loader name, got %q (%v)", arch, err)
+	}
+
+	blank := filepath.Join(dir, "blank.qcow2")
+	os.WriteFile(blank, make([]byte, 4096), 0644)
+	if arch, _ := detectImageArch(blank); arch != "" {
+		t.Errorf("Expected no guess for a blank image, got %q", arch)
+	}
+}
+
+func TestValidateArch(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "alpine-arm64.qcow2")
+	os.WriteFile(image, []byte("QFI\xfb"), 0644)
+
+	if err := validateArch(VMConfig{Name: "a", Image: image, Arch: ArchAarch64}); err != nil {
+		t.Errorf("Expected matching image to validate: %v", err)
+	}
+	if err := validateArch(VMConfig{Name: "b", Image: image}); err == nil {
+		t.Error("Expected an arm64 image to be rejected for an x86_64 VM")
+	}
+	if err := validateArch(VMConfig{Name: "c", Arch: ArchAarch64, Firmware: FirmwareBIOS}); err == nil {
+		t.Error("Expected BIOS firmware to be rejected for aarch64")
+	}
+	if err := validateArch(VMConfig{Name: "d", Arch: "mips"}); err == nil {
+		t.Error("Expected unsupported architecture to be rejected")
+	}
+}
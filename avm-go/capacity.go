@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Host admission control. Before a VM starts or a running VM grows, its
+// RAM and vCPUs are checked against the host's, scaled by the overcommit
+// ratios, less a reserve for the host itself and what active VMs hold.
+
+const (
+	defaultMemOvercommit = "1.0"
+	defaultCPUOvercommit = "4.0"
+	defaultHostReserve   = "1G"
+)
+
+// procRoot and sysRoot are where host information is read from. Tests
+// point them at a fake tree.
+var (
+	procRoot = "/proc"
+	sysRoot  = "/sys"
+)
+
+// hostCapacity is what the host has to give to VMs.
+type hostCapacity struct {
+	MemMB int
+	CPUs  int
+}
+
+// readHostCapacity reads total memory from /proc/meminfo and the online
+// CPUs from /sys/devices/system/cpu/online.
+func readHostCapacity() (hostCapacity, error) {
+	var host hostCapacity
+	f, err := os.Open(filepath.Join(procRoot, "meminfo"))
+	if err != nil {
+		return host, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return host, fmt.Errorf("invalid MemTotal in meminfo: %v", err)
+			}
+			host.MemMB = kb / 1024
+		}
+	}
+	if host.MemMB == 0 {
+		return host, fmt.Errorf("no MemTotal in %s", f.Name())
+	}
+
+	data, err := os.ReadFile(filepath.Join(sysRoot, "devices/system/cpu/online"))
+	if err != nil {
+		return host, err
+	}
+	if host.CPUs, err = parseCPUList(string(data)); err != nil {
+		return host, err
+	}
+	return host, nil
+}
+
+// parseCPUList counts the CPUs in a kernel CPU list such as "0-3,6".
+func parseCPUList(s string) (int, error) {
+	count := 0
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(first)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU list %q", s)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(last); err != nil || b < a {
+				return 0, fmt.Errorf("invalid CPU list %q", s)
+			}
+		}
+		count += b - a + 1
+	}
+	return count, nil
+}
+
+// parseRatio parses an overcommit ratio, falling back to def when unset.
+func parseRatio(s, def string) (float64, error) {
+	if s == "" {
+		s = def
+	}
+	r, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || r <= 0 {
+		return 0, fmt.Errorf("invalid overcommit ratio %q", s)
+	}
+	return r, nil
+}
+
+// vmUse is what one VM holds or asks for.
+type vmUse struct {
+	VM   string
+	RAM  int // MB
+	CPUs int
+}
+
+// admission is the capacity check for one VM, kept whole so it can be
+// shown as a breakdown.
+type admission struct {
+	Host          hostCapacity
+	MemOvercommit float64
+	CPUOvercommit float64
+	ReserveMB     int
+	Active        []vmUse // other active VMs, by name
+	Request       vmUse
+}
+
+// planAdmission works out whether vm, as resolved with its requested RAM
+// and vCPUs, fits on the host next to the other active VMs.
+func planAdmission(config Config, vm VMConfig) (admission, error) {
+	var a admission
+	var err error
+	if a.MemOvercommit, err = parseRatio(config.MemOvercommit, defaultMemOvercommit); err != nil {
+		return a, err
+	}
+	if a.CPUOvercommit, err = parseRatio(config.CPUOvercommit, defaultCPUOvercommit); err != nil {
+		return a, err
+	}
+	reserve := config.HostReserve
+	if reserve == "" {
+		reserve = defaultHostReserve
+	}
+	if a.ReserveMB, err = reserve.MB(); err != nil {
+		return a, err
+	}
+	if a.Host, err = readHostCapacity(); err != nil {
+		return a, fmt.Errorf("failed to read host capacity: %v", err)
+	}
+
+	a.Request = requestOf(vm)
+	for name, other := range resolvedVMs(config) {
+		if name != vm.Name && other.Status.Active() {
+			a.Active = append(a.Active, vmUseOf(other))
+		}
+	}
+	sort.Slice(a.Active, func(i, j int) bool { return a.Active[i].VM < a.Active[j].VM })
+	return a, nil
+}
+
+// vmUseOf is what vm holds: its current resources when it is active and
+// they are known, its configured ones otherwise. An active VM whose
+// balloon hasn't reported yet holds all the memory it booted with.
+func vmUseOf(vm VMConfig) vmUse {
+	use := requestOf(vm)
+	if vm.Status.Active() {
+		use.RAM = bootMemoryMB(vm, use.RAM)
+	}
+	if vm.Status.Active() && vm.Resources.CurrentRAM > 0 {
+		use.RAM = vm.Resources.CurrentRAM
+	}
+	if vm.Status.Active() && vm.Resources.CurrentCPU > 0 {
+		use.CPUs = vm.Resources.CurrentCPU
+	}
+	return use
+}
+
+// requestOf is what vm asks for: its configured RAM and vCPUs.
+func requestOf(vm VMConfig) vmUse {
+	use := vmUse{VM: vm.Name}
+	use.RAM, _ = vm.RAM.MB()
+	use.CPUs, _ = strconv.Atoi(vm.CPU)
+	return use
+}
+
+// memLimit and cpuLimit are what the host offers VMs in total.
+func (a admission) memLimit() int {
+	return int(float64(a.Host.MemMB)*a.MemOvercommit) - a.ReserveMB
+}
+
+func (a admission) cpuLimit() int {
+	return int(float64(a.Host.CPUs) * a.CPUOvercommit)
+}
+
+// held sums what the other active VMs hold.
+func (a admission) held() (ram, cpus int) {
+	for _, use := range a.Active {
+		ram += use.RAM
+		cpus += use.CPUs
+	}
+	return ram, cpus
+}
+
+// shortfalls lists what the request is short of, empty when it fits.
+func (a admission) shortfalls() []string {
+	ram, cpus := a.held()
+	var short []string
+	if free := a.memLimit() - ram; a.Request.RAM > free {
+		short = append(short, fmt.Sprintf("memory short by %d MB", a.Request.RAM-max(free, 0)))
+	}
+	if free := a.cpuLimit() - cpus; a.Request.CPUs > free {
+		short = append(short, fmt.Sprintf("vCPUs short by %d", a.Request.CPUs-max(free, 0)))
+	}
+	return short
+}
+
+// breakdown explains the check line by line.
+func (a admission) breakdown() []string {
+	ram, cpus := a.held()
+	var holders []string
+	for _, use := range a.Active {
+		holders = append(holders, fmt.Sprintf("%s %d MB/%d vCPUs", use.VM, use.RAM, use.CPUs))
+	}
+	if len(holders) == 0 {
+		holders = append(holders, "none")
+	}
+	return []string{
+		fmt.Sprintf("Memory: %d MB host × %g overcommit − %d MB reserve = %d MB", a.Host.MemMB, a.MemOvercommit, a.ReserveMB, a.memLimit()),
+		fmt.Sprintf("vCPUs:  %d online × %g overcommit = %d", a.Host.CPUs, a.CPUOvercommit, a.cpuLimit()),
+		fmt.Sprintf("Held by active VMs: %d MB, %d vCPUs (%s)", ram, cpus, strings.Join(holders, ", ")),
+		fmt.Sprintf("Free: %d MB, %d vCPUs", a.memLimit()-ram, a.cpuLimit()-cpus),
+		fmt.Sprintf("Requested by '%s': %d MB, %d vCPUs", a.Request.VM, a.Request.RAM, a.Request.CPUs),
+	}
+}
+
+// checkCapacity checks that vm fits on the host. When it doesn't, it
+// returns the breakdown, and an error unless force is set. A host whose
+// capacity can't be read is let through with a warning.
+func checkCapacity(config Config, vm VMConfig, force bool) ([]string, error) {
+	a, err := planAdmission(config, vm)
+	if err != nil {
+		log.Warnf("Skipping host capacity check for VM '%s': %v", vm.Name, err)
+		return nil, nil
+	}
+	short := a.shortfalls()
+	if len(short) == 0 {
+		return nil, nil
+	}
+	if force {
+		return a.breakdown(), nil
+	}
+	return a.breakdown(), fmt.Errorf("not enough host capacity for VM '%s' (%s); use --force to override, or tune mem_overcommit, cpu_overcommit and host_reserve with 'avm-go config set'",
+		vm.Name, strings.Join(short, ", "))
+}
+
+// admitVM is checkCapacity for a start in the daemon: the breakdown goes
+// into the error for the CLI to show, or into the log when forced.
+func admitVM(config Config, vm VMConfig, force bool) error {
+	breakdown, err := checkCapacity(config, vm, force)
+	if err != nil {
+		return fmt.Errorf("%v\n   %s", err, strings.Join(breakdown, "\n   "))
+	}
+	if breakdown != nil {
+		log.WithField("vm", vm.Name).Warnf("Starting without enough host capacity, forced: %s", strings.Join(breakdown, "; "))
+	}
+	return nil
+}
+
+// admit is checkCapacity for the CLI: when vm doesn't fit, the breakdown is
+// printed. before runs ahead of any output, e.g. to stop a spinner.
+func admit(config Config, vm VMConfig, force bool, before func()) error {
+	breakdown, err := checkCapacity(config, vm, force)
+	if breakdown == nil {
+		return nil
+	}
+
+	if before != nil {
+		before()
+	}
+	color.Yellow("⚠️  Not enough host capacity for VM '%s':", vm.Name)
+	for _, line := range breakdown {
+		color.Cyan("   %s", line)
+	}
+	if err == nil {
+		color.Yellow("⚠️  --force given, going ahead anyway")
+	}
+	return err
+}
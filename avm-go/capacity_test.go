@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withFakeHost points procRoot and sysRoot at a host with memMB of memory
+// and the given online CPU list.
+func withFakeHost(t *testing.T, memMB int, online string) {
+	dir := t.TempDir()
+	origProc, origSys := procRoot, sysRoot
+	procRoot, sysRoot = filepath.Join(dir, "proc"), filepath.Join(dir, "sys")
+	t.Cleanup(func() { procRoot, sysRoot = origProc, origSys })
+
+	cpuDir := filepath.Join(sysRoot, "devices/system/cpu")
+	os.MkdirAll(procRoot, 0755)
+	os.MkdirAll(cpuDir, 0755)
+	meminfo := "MemTotal:       " + strconv.Itoa(memMB*1024) + " kB\nMemFree:          123456 kB\n"
+	os.WriteFile(filepath.Join(procRoot, "meminfo"), []byte(meminfo), 0644)
+	os.WriteFile(filepath.Join(cpuDir, "online"), []byte(online+"\n"), 0644)
+}
+
+func TestParseCPUList(t *testing.T) {
+	cases := map[string]int{"0": 1, "0-7": 8, "0-3,6": 5, "0,2,4-5\n": 4}
+	for list, want := range cases {
+		if got, err := parseCPUList(list); err != nil || got != want {
+			t.Errorf("parseCPUList(%q) = %d, %v; want %d", list, got, err, want)
+		}
+	}
+	if _, err := parseCPUList("3-1"); err == nil {
+		t.Error("Expected an error for a backwards range")
+	}
+}
+
+func TestPlanAdmission(t *testing.T) {
+	withFakeHost(t, 6144, "0-7")
+
+	config := Config{VMs: map[string]VMConfig{
+		"db":   {Name: "db", RAM: "2G", CPU: "2", Status: StateRunning, Resources: VMResources{CurrentRAM: 3072, CurrentCPU: 2}},
+		"web":  {Name: "web", RAM: "4G", CPU: "4", Status: StateStopped},
+		"idle": {Name: "idle", RAM: "1G", CPU: "1", Status: StatePaused},
+	}}
+
+	a, err := planAdmission(config, config.displayVM("web"))
+	if err != nil {
+		t.Fatalf("planAdmission failed: %v", err)
+	}
+	if a.Host.MemMB != 6144 || a.Host.CPUs != 8 || a.ReserveMB != 1024 {
+		t.Errorf("Unexpected host capacity: %+v", a)
+	}
+	if ram, cpus := a.held(); ram != 4096 || cpus != 3 {
+		t.Errorf("Expected 4096 MB and 3 vCPUs held (db's current, idle's configured), got %d MB, %d", ram, cpus)
+	}
+	short := a.shortfalls()
+	if len(short) != 1 || short[0] != "memory short by 3072 MB" {
+		t.Errorf("Expected a 3072 MB memory shortfall, got %v", short)
+	}
+	if !strings.Contains(strings.Join(a.breakdown(), "\n"), "db 3072 MB/2 vCPUs, idle 1024 MB/1 vCPUs") {
+		t.Errorf("Expected the breakdown to name the active VMs, got %q", a.breakdown())
+	}
+
+	config.MemOvercommit = "2"
+	a, _ = planAdmission(config, config.displayVM("web"))
+	if short := a.shortfalls(); len(short) != 0 {
+		t.Errorf("Expected web to fit with 2x memory overcommit, got %v", short)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	withFakeHost(t, 4096, "0-1")
+	config := Config{HostReserve: "512M", CPUOvercommit: "1", VMs: map[string]VMConfig{
+		"dev": {Name: "dev", RAM: "2G", CPU: "4"},
+	}}
+	vm := config.displayVM("dev")
+
+	err := admit(config, vm, false, nil)
+	if err == nil || !strings.Contains(err.Error(), "vCPUs short by 2") {
+		t.Errorf("Expected a vCPU shortfall, got %v", err)
+	}
+
+	stopped := false
+	if err := admit(config, vm, true, func() { stopped = true }); err != nil {
+		t.Errorf("Expected --force to override, got %v", err)
+	}
+	if !stopped {
+		t.Error("Expected before to run ahead of the breakdown")
+	}
+}
+
+func TestAdmitVM(t *testing.T) {
+	withFakeHost(t, 4096, "0-1")
+	config := Config{HostReserve: "512M", CPUOvercommit: "1", VMs: map[string]VMConfig{
+		"dev": {Name: "dev", RAM: "2G", CPU: "4"},
+	}}
+	vm := config.displayVM("dev")
+
+	err := admitVM(config, vm, false)
+	if err == nil || !strings.Contains(err.Error(), "vCPUs short by 2") || !strings.Contains(err.Error(), "Requested by 'dev': 2048 MB, 4 vCPUs") {
+		t.Errorf("Expected the shortfall and breakdown in the error, got %v", err)
+	}
+	if err := admitVM(config, vm, true); err != nil {
+		t.Errorf("Expected force to override, got %v", err)
+	}
+}
+
+func TestVMUseCountsBootMemory(t *testing.T) {
+	vm := VMConfig{Name: "dev", RAM: "2G", CPU: "2", Status: StateRunning, Resources: VMResources{MaxRAM: ptrTo(4096)}}
+	if use := vmUseOf(vm); use.RAM != 4096 {
+		t.Errorf("Expected the 4096 MB boot memory before the balloon reports, got %d MB", use.RAM)
+	}
+	vm.Resources.CurrentRAM = 2048
+	if use := vmUseOf(vm); use.RAM != 2048 {
+		t.Errorf("Expected the balloon's 2048 MB once reported, got %d MB", use.RAM)
+	}
+	vm.Status, vm.Resources.CurrentRAM = StateStopped, 0
+	if use := vmUseOf(vm); use.RAM != 2048 {
+		t.Errorf("Expected a stopped VM to count its RAM, got %d MB", use.RAM)
+	}
+}
+
+func TestAdmitWithoutHostInfo(t *testing.T) {
+	orig := procRoot
+	procRoot = filepath.Join(t.TempDir(), "missing")
+	t.Cleanup(func() { procRoot = orig })
+
+	config := Config{VMs: map[string]VMConfig{"dev": {Name: "dev", RAM: "64G", CPU: "2"}}}
+	if err := admit(config, config.displayVM("dev"), false, nil); err != nil {
+		t.Errorf("Expected an unreadable host to skip the check, got %v", err)
+	}
+}
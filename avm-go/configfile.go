@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errConfigConflict is returned when a config is saved after someone else
+// changed the file since it was loaded. Load it again and retry.
+var errConfigConflict = errors.New("config was changed by another command since it was loaded; retry")
+
+// lockConfig takes an advisory lock on configPath's lock file, shared for
+// readers and exclusive for writers. The returned func releases it.
+func lockConfig(configPath string, exclusive bool) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(configPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config lock: %v", err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock config: %v", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// loadConfig reads and validates the config file.
+func loadConfig(configPath string) (Config, error) {
+	unlock, err := lockConfig(configPath, false)
+	if err != nil {
+		return Config{}, err
+	}
+	defer unlock()
+
+	return readConfigFile(configPath)
+}
+
+// loadConfigUnvalidated reads the config without validating it, for
+// commands that report on invalid configs.
+func loadConfigUnvalidated(configPath string) (Config, error) {
+	unlock, err := lockConfig(configPath, false)
+	if err != nil {
+		return Config{}, err
+	}
+	defer unlock()
+
+	return decodeConfigFile(configPath)
+}
+
+// readConfigFile decodes and validates the config file. The caller must
+// hold the lock.
+func readConfigFile(configPath string) (Config, error) {
+	config, err := decodeConfigFile(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	return config, validate.Struct(config)
+}
+
+// decodeConfigFile decodes the config file, upgrading older formats in
+// memory. The caller must hold the lock.
+func decodeConfigFile(configPath string) (Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	if data, err = configToJSON(configFormat(configPath), data); err != nil {
+		return Config{}, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+
+	config, changes, err := migrateConfigData(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+	if len(changes) > 0 {
+		log.Debugf("Migrated %s in memory: %s", configPath, strings.Join(changes, "; "))
+	}
+	return config, nil
+}
+
+// saveConfig writes config back if the file is still at the revision it
+// was loaded at, and bumps config.Revision. Otherwise it returns
+// errConfigConflict and leaves the file alone.
+func saveConfig(configPath string, config *Config) error {
+	unlock, err := lockConfig(configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if current, err := diskRevision(configPath); err != nil {
+		return err
+	} else if current != config.Revision {
+		return errConfigConflict
+	}
+
+	return writeConfigFile(configPath, config)
+}
+
+// updateConfig applies fn to the current config under the write lock and
+// saves the result, so concurrent read-modify-write cycles can't lose
+// each other's changes. Nothing is written if fn fails.
+func updateConfig(configPath string, fn func(config *Config) error) (Config, error) {
+	unlock, err := lockConfig(configPath, true)
+	if err != nil {
+		return Config{}, err
+	}
+	defer unlock()
+
+	if _, err := diskRevision(configPath); err != nil {
+		return Config{}, err
+	}
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := fn(&config); err != nil {
+		return config, err
+	}
+	return config, writeConfigFile(configPath, &config)
+}
+
+// replaceConfig overwrites the config file regardless of its revision, for
+// commands that create a config from scratch.
+func replaceConfig(configPath string, config *Config) error {
+	unlock, err := lockConfig(configPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if current, err := diskRevision(configPath); err == nil {
+		config.Revision = current
+	}
+	return writeConfigFile(configPath, config)
+}
+
+// diskRevision returns the revision of the config file on disk, 0 if it
+// does not exist yet. Legacy formats give errLegacyConfig so they are only
+// replaced by `config migrate`, which keeps a backup. The caller must hold
+// the lock.
+func diskRevision(configPath string) (int64, error) {
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if data, err = configToJSON(configFormat(configPath), data); err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+
+	var header struct {
+		Revision int64           `json:"revision"`
+		VMs      json.RawMessage `json:"vms"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil || header.VMs == nil {
+		return 0, errLegacyConfig
+	}
+	return header.Revision, nil
+}
+
+// writeConfigFile bumps the revision and atomically replaces the file via
+// a synced temp file in the same directory. The caller must hold the lock.
+func writeConfigFile(configPath string, config *Config) error {
+	config.SchemaVersion = currentSchemaVersion
+	config.Revision++
+	data, err := encodeConfig(configFormat(configPath), config)
+	if err != nil {
+		config.Revision--
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), "."+filepath.Base(configPath)+".*.tmp")
+	if err != nil {
+		config.Revision--
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), configPath)
+	}
+	if err != nil {
+		config.Revision--
+		return fmt.Errorf("failed to write %s: %v", configPath, err)
+	}
+	return nil
+}
+
+// updateVM applies fn to one VM's config under the write lock and saves it.
+func updateVM(configPath, vmName string, fn func(vm *VMConfig) error) (VMConfig, error) {
+	var updated VMConfig
+	_, err := updateConfig(configPath, func(config *Config) error {
+		vm, exists := config.VMs[vmName]
+		if !exists {
+			return fmt.Errorf("VM '%s' not found", vmName)
+		}
+		if err := fn(&vm); err != nil {
+			updated = vm
+			return err
+		}
+		config.VMs[vmName] = vm
+		updated = vm
+		return nil
+	})
+	return updated, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T) string {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := Config{
+		DefaultVM: "default",
+		VMs: map[string]VMConfig{
+			"default": {Name: "default", RAM: "2048", CPU: "2", SSHPort: "2222", Image: "/data/alpine.qcow2"},
+		},
+	}
+	if err := replaceConfig(configPath, &config); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return configPath
+}
+
+func TestUpdateConfigConcurrent(t *testing.T) {
+	configPath := writeTestConfig(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("vm%d", i)
+			_, err := updateConfig(configPath, func(config *Config) error {
+				config.VMs[name] = VMConfig{Name: name, RAM: "512", CPU: "1", SSHPort: "2200", Image: "/data/x.qcow2"}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("updateConfig failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if len(config.VMs) != 21 {
+		t.Errorf("Expected 21 VMs after concurrent updates, got %d", len(config.VMs))
+	}
+	if config.Revision != 21 {
+		t.Errorf("Expected revision 21, got %d", config.Revision)
+	}
+}
+
+func TestSaveConfigConflict(t *testing.T) {
+	configPath := writeTestConfig(t)
+
+	first, _ := loadConfig(configPath)
+	second, _ := loadConfig(configPath)
+
+	first.DefaultVM = "first"
+	if err := saveConfig(configPath, &first); err != nil {
+		t.Fatalf("First save failed: %v", err)
+	}
+	// A second save from the same copy carries the bumped revision.
+	if err := saveConfig(configPath, &first); err != nil {
+		t.Fatalf("Repeated save failed: %v", err)
+	}
+
+	second.DefaultVM = "second"
+	if err := saveConfig(configPath, &second); !errors.Is(err, errConfigConflict) {
+		t.Fatalf("Expected errConfigConflict for a stale writer, got %v", err)
+	}
+
+	config, _ := loadConfig(configPath)
+	if config.DefaultVM != "first" {
+		t.Errorf("Stale writer clobbered the config: default VM is %s", config.DefaultVM)
+	}
+}
+
+func TestSaveConfigLeavesNoTempFiles(t *testing.T) {
+	configPath := writeTestConfig(t)
+
+	config, _ := loadConfig(configPath)
+	if err := saveConfig(configPath, &config); err != nil {
+		t.Fatalf("saveConfig failed: %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(configPath))
+	for _, e := range entries {
+		if e.Name() != "config.json" && e.Name() != "config.json.lock" {
+			t.Errorf("Unexpected file left behind: %s", e.Name())
+		}
+	}
+}
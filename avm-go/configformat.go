@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/hashicorp/hcl"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats. The config file's format follows its extension;
+// anything unrecognised is JSON. Every format is converted to and from the
+// JSON form, so the json tags on Config are the only field names there are.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+	formatHCL  = "hcl"
+)
+
+// configFormat picks the format of a config file from its extension.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	case ".hcl":
+		return formatHCL
+	}
+	return formatJSON
+}
+
+// parseFormat checks a --format value.
+func parseFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return formatJSON, nil
+	case "yaml", "yml":
+		return formatYAML, nil
+	case "toml":
+		return formatTOML, nil
+	case "hcl":
+		return formatHCL, nil
+	}
+	return "", fmt.Errorf("unknown format '%s' (supported: json, yaml, toml, hcl)", name)
+}
+
+// configToJSON converts a config file's contents to JSON. JSON and the
+// legacy formats handled by migrateConfigData pass through unchanged.
+func configToJSON(format string, data []byte) ([]byte, error) {
+	var tree interface{}
+	var err error
+	switch format {
+	case formatYAML:
+		err = yaml.Unmarshal(data, &tree)
+	case formatTOML:
+		err = toml.Unmarshal(data, &tree)
+	case formatHCL:
+		err = hcl.Unmarshal(data, &tree)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", format, err)
+	}
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+	return json.Marshal(normalizeTree(tree))
+}
+
+// normalizeTree turns decoded YAML, TOML or HCL into values encoding/json
+// accepts: maps keyed by strings, and HCL's lists of blocks merged back
+// into objects.
+func normalizeTree(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalizeTree(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalizeTree(e)
+		}
+		return m
+	case []map[string]interface{}:
+		m := map[string]interface{}{}
+		for _, block := range v {
+			for k, e := range block {
+				m[k] = normalizeTree(e)
+			}
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeTree(e)
+		}
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// encodeConfig renders config in the given format.
+func encodeConfig(format string, config *Config) ([]byte, error) {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil || format == formatJSON {
+		return data, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	tree = plainTree(tree)
+
+	switch format {
+	case formatYAML:
+		return yaml.Marshal(tree)
+	case formatTOML:
+		return toml.Marshal(tree)
+	case formatHCL:
+		var b strings.Builder
+		writeHCL(&b, tree.(map[string]interface{}), "")
+		return []byte(b.String()), nil
+	}
+	return nil, fmt.Errorf("unknown format '%s'", format)
+}
+
+// plainTree converts json.Numbers to int64 or float64, and drops nulls,
+// which TOML and HCL can't represent.
+func plainTree(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if e == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = plainTree(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = plainTree(e)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// writeHCL writes m as HCL attributes and blocks, keys sorted.
+func writeHCL(b *strings.Builder, m map[string]interface{}, indent string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if block, ok := m[k].(map[string]interface{}); ok {
+			fmt.Fprintf(b, "%s%s {\n", indent, hclKey(k))
+			writeHCL(b, block, indent+"  ")
+			fmt.Fprintf(b, "%s}\n", indent)
+			continue
+		}
+		fmt.Fprintf(b, "%s%s = %s\n", indent, hclKey(k), hclValue(m[k]))
+	}
+}
+
+var hclIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// hclKey quotes keys, such as VM names, that aren't HCL identifiers.
+func hclKey(k string) string {
+	if hclIdent.MatchString(k) {
+		return k
+	}
+	return strconv.Quote(k)
+}
+
+func hclValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, e := range v {
+			items[i] = hclValue(e)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// findConfigFile returns the config file in dir, preferring config.json and
+// then the other formats, or dir/config.json if there is none yet.
+func findConfigFile(dir string) string {
+	for _, name := range []string{"config.json", "config.yaml", "config.yml", "config.toml", "config.hcl"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// exportConfig is the `avm-go config export` action.
+func exportConfig(c *cli.Context) error {
+	config, err := loadConfig(configPathFlag(c))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	output := c.String("output")
+	format := configFormat(output)
+	if c.IsSet("format") || output == "" {
+		if format, err = parseFormat(c.String("format")); err != nil {
+			return err
+		}
+	}
+
+	data, err := encodeConfig(format, &config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config as %s: %v", format, err)
+	}
+
+	if output == "" {
+		os.Stdout.Write(data)
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			fmt.Println()
+		}
+		return nil
+	}
+	if err := os.WriteFile(expandPath(output), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", output, err)
+	}
+	color.Green("✅ Config exported to %s (%s)", output, format)
+	return nil
+}
+
+// importConfig is the `avm-go config import` action. It replaces the
+// config with the given file, backing the old one up first. VMs already
+// in the config keep their runtime state.
+func importConfig(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: avm-go config import <file>")
+	}
+	source := expandPath(c.Args().First())
+	configPath := configPathFlag(c)
+
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", source, err)
+	}
+	format := configFormat(source)
+	if c.IsSet("format") {
+		if format, err = parseFormat(c.String("format")); err != nil {
+			return err
+		}
+	}
+	jsonData, err := configToJSON(format, data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", source, err)
+	}
+	imported, changes, err := migrateConfigData(jsonData)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", source, err)
+	}
+	for _, change := range changes {
+		color.Cyan("  • %s", change)
+	}
+
+	if violations, _ := settingViolations(imported); len(violations) > 0 {
+		for _, v := range violations {
+			color.Red("❌ %s: %s", v.Path, v.Message)
+		}
+		return fmt.Errorf("%s has %d problem(s), nothing imported", source, len(violations))
+	}
+
+	if current, err := loadReconciledConfig(configPath); err == nil {
+		if err := keepRuntimeState(&imported, current); err != nil {
+			return fmt.Errorf("%v, nothing imported", err)
+		}
+	}
+
+	if current, err := os.ReadFile(configPath); err == nil {
+		backup, err := backupConfigFile(configPath, current)
+		if err != nil {
+			return err
+		}
+		color.Cyan("💾 Previous config saved as %s", backup)
+	}
+
+	if err := replaceConfig(configPath, &imported); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	color.Green("✅ Imported %d VM(s) from %s into %s", len(imported.VMs), source, configPath)
+	return nil
+}
+
+// keepRuntimeState carries the runtime fields of the VMs in current over
+// to the same VMs in imported, so the config still matches the processes
+// avm-go runs. Dropping an active VM is refused: its process would be left
+// without a record.
+func keepRuntimeState(imported *Config, current Config) error {
+	for name, cur := range current.VMs {
+		vm, ok := imported.VMs[name]
+		if !ok {
+			if cur.Status.Active() {
+				return fmt.Errorf("VM '%s' is %s but not in the import; stop it first", name, cur.Status)
+			}
+			continue
+		}
+		vm.Status, vm.Created, vm.SavedState = cur.Status, cur.Created, cur.SavedState
+		vm.LastExitCode, vm.LastExitAt, vm.Restarts = cur.LastExitCode, cur.LastExitAt, cur.Restarts
+		vm.Resources.CurrentRAM, vm.Resources.CurrentCPU = cur.Resources.CurrentRAM, cur.Resources.CurrentCPU
+		vm.Resources.DiskUsage, vm.Resources.Guest = cur.Resources.DiskUsage, cur.Resources.Guest
+		imported.VMs[name] = vm
+	}
+	return nil
+}
+
+// backupConfigFile saves data, the contents of path, under the backups
+// directory and returns the backup's path.
+func backupConfigFile(path string, data []byte) (string, error) {
+	backup := filepath.Join(paths.Backups, fmt.Sprintf("%s.%s.bak", filepath.Base(path), time.Now().Format("20060102-150405")))
+	if err := os.MkdirAll(paths.Backups, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	if err := os.WriteFile(backup, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %v", path, err)
+	}
+	return backup, nil
+}
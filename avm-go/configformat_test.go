@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFormatsRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	config := Config{
+		SchemaVersion: currentSchemaVersion,
+		DefaultVM:     "dev",
+		Defaults:      map[string]string{"cpu": "4"},
+		VMs: map[string]VMConfig{
+			"dev": {
+				Name:    "dev",
+				RAM:     "2G",
+				SSHPort: "2222",
+				Image:   "dev.qcow2",
+				Status:  StateStopped,
+				Created: created,
+				Resources: VMResources{MaxRAM: ptrTo(4096), MaxCPU: ptrTo(4), DiskUsage: 1 << 34, Guest: &GuestMetrics{
+					Load1: 0.25, MemTotal: 2 << 30, MemAvailable: 1 << 30, Uptime: 3600, CollectedAt: created,
+					Filesystems: map[string]GuestFSUsage{
+						"/":     {Device: "vda3", Type: "ext4", Used: 1 << 34, Total: 1 << 35},
+						"/boot": {Device: "vda1", Type: "ext4", Used: 1 << 20, Total: 1 << 28},
+					},
+				}},
+				Autostart: ptrTo(true),
+				DependsOn: []string{"db.internal"},
+			},
+			"db.internal": {Name: "db", RAM: "1024", CPU: "1", SSHPort: "2223", Image: "db.qcow2", Created: created},
+		},
+	}
+
+	for _, ext := range []string{".json", ".yaml", ".toml", ".hcl"} {
+		path := filepath.Join(t.TempDir(), "config"+ext)
+		saved := config
+		if err := writeConfigFile(path, &saved); err != nil {
+			t.Fatalf("%s: write failed: %v", ext, err)
+		}
+
+		loaded, err := readConfigFile(path)
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", ext, err)
+		}
+		if !reflect.DeepEqual(loaded, saved) {
+			t.Errorf("%s: config changed in round trip:\n got: %+v\nwant: %+v", ext, loaded, saved)
+		}
+
+		if rev, err := diskRevision(path); err != nil || rev != saved.Revision {
+			t.Errorf("%s: diskRevision = %d, %v; expected %d", ext, rev, err, saved.Revision)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := parseFormat("YML"); err != nil || f != formatYAML {
+		t.Errorf("parseFormat(YML) = %q, %v", f, err)
+	}
+	if _, err := parseFormat("xml"); err == nil {
+		t.Error("Expected xml to be rejected")
+	}
+	if f := configFormat("/etc/avm/config.TOML"); f != formatTOML {
+		t.Errorf("configFormat = %q, expected toml", f)
+	}
+}
+
+func TestKeepRuntimeState(t *testing.T) {
+	current := Config{VMs: map[string]VMConfig{
+		"dev": {Name: "dev", RAM: "2G", Status: StateRunning, Restarts: 2, Resources: VMResources{CurrentRAM: 2048, CurrentCPU: 2, Guest: &GuestMetrics{Load1: 1}}},
+		"old": {Name: "old", Status: StateStopped},
+	}}
+	imported := Config{VMs: map[string]VMConfig{
+		"dev": {Name: "dev", RAM: "4G", Status: StateStopped},
+		"new": {Name: "new", Status: StateStopped},
+	}}
+
+	if err := keepRuntimeState(&imported, current); err != nil {
+		t.Fatalf("keepRuntimeState failed: %v", err)
+	}
+	dev := imported.VMs["dev"]
+	if dev.RAM != "4G" || dev.Status != StateRunning || dev.Restarts != 2 || dev.Resources.CurrentRAM != 2048 || dev.Resources.Guest == nil {
+		t.Errorf("Expected dev's settings imported and its runtime state kept, got %+v", dev)
+	}
+
+	delete(imported.VMs, "dev")
+	if err := keepRuntimeState(&imported, current); err == nil {
+		t.Error("Expected dropping a running VM to be refused")
+	}
+}
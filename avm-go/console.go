@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+const defaultDetachKey = "ctrl-]"
+
+// consoleSocketPath is the per-VM unix socket QEMU serves the guest's first
+// serial port on.
+func consoleSocketPath(vm VMConfig) string {
+	return runtimeSocketPath(vm, "console")
+}
+
+// parseDetachKey turns "ctrl-]" or "ctrl-a" style names into the control
+// byte a terminal sends for them.
+func parseDetachKey(name string) (byte, error) {
+	key := strings.ToLower(name)
+	if !strings.HasPrefix(key, "ctrl-") || len(key) != len("ctrl-")+1 {
+		return 0, fmt.Errorf("invalid detach key '%s', expected e.g. ctrl-] or ctrl-a", name)
+	}
+	c := key[len(key)-1]
+	switch {
+	case c >= 'a' && c <= 'z':
+		return c - 'a' + 1, nil
+	case c >= '[' && c <= '_':
+		return c - '@', nil
+	case c == '@':
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid detach key '%s', expected e.g. ctrl-] or ctrl-a", name)
+}
+
+// copyUntilDetach copies src to dst until src ends or the detach key is
+// read. Bytes typed before the key on the same read are still sent. It
+// returns true if the user detached.
+func copyUntilDetach(dst io.Writer, src io.Reader, key byte) (bool, error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			detach := false
+			for i, b := range chunk {
+				if b == key {
+					chunk, detach = chunk[:i], true
+					break
+				}
+			}
+			if len(chunk) > 0 {
+				if _, werr := dst.Write(chunk); werr != nil {
+					return false, werr
+				}
+			}
+			if detach {
+				return true, nil
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// attachConsole is the `avm-go console` action.
+func attachConsole(c *cli.Context) error {
+	vmName := c.String("vm")
+	configPath := configPathFlag(c)
+
+	key, err := parseDetachKey(c.String("detach-key"))
+	if err != nil {
+		return err
+	}
+
+	config, err := loadReconciledConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	vm, exists := config.VMs[vmName]
+	if !exists {
+		return fmt.Errorf("VM '%s' not found", vmName)
+	}
+	if !vm.Status.Active() {
+		return fmt.Errorf("VM '%s' is not running (%s)", vmName, vm.Status)
+	}
+
+	conn, err := net.Dial("unix", consoleSocketPath(vm))
+	if err != nil {
+		return fmt.Errorf("console unavailable for VM '%s': %v", vmName, err)
+	}
+	defer conn.Close()
+
+	color.Cyan("🔌 Attached to console of VM '%s'. Press %s to detach.", vmName, c.String("detach-key"))
+
+	fd := int(os.Stdin.Fd())
+	restore := func() {}
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to put terminal in raw mode: %v", err)
+		}
+		restore = func() {
+			term.Restore(fd, state)
+			fmt.Println()
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(closed)
+	}()
+
+	detached := make(chan error, 1)
+	go func() {
+		_, err := copyUntilDetach(conn, os.Stdin, key)
+		detached <- err
+	}()
+
+	select {
+	case err := <-detached:
+		restore()
+		if err != nil {
+			return fmt.Errorf("console error: %v", err)
+		}
+		color.Green("✅ Detached from VM '%s'", vmName)
+	case <-closed:
+		restore()
+		color.Yellow("⚠️  Console of VM '%s' closed", vmName)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseDetachKey(t *testing.T) {
+	cases := map[string]byte{
+		"ctrl-]":  0x1d,
+		"ctrl-a":  0x01,
+		"Ctrl-Q":  0x11,
+		"ctrl-\\": 0x1c,
+	}
+	for name, expected := range cases {
+		got, err := parseDetachKey(name)
+		if err != nil {
+			t.Errorf("parseDetachKey(%q) failed: %v", name, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("parseDetachKey(%q) = %#x, expected %#x", name, got, expected)
+		}
+	}
+
+	for _, name := range []string{"q", "ctrl-", "ctrl-ab", "alt-x"} {
+		if _, err := parseDetachKey(name); err == nil {
+			t.Errorf("Expected parseDetachKey(%q) to fail", name)
+		}
+	}
+}
+
+func TestCopyUntilDetach(t *testing.T) {
+	var out bytes.Buffer
+	detached, err := copyUntilDetach(&out, strings.NewReader("ls -l\r\x1dnot sent"), 0x1d)
+	if err != nil {
+		t.Fatalf("copyUntilDetach failed: %v", err)
+	}
+	if !detached {
+		t.Error("Expected detach on the detach key")
+	}
+	if out.String() != "ls -l\r" {
+		t.Errorf("Unexpected forwarded input %q", out.String())
+	}
+
+	out.Reset()
+	detached, err = copyUntilDetach(&out, strings.NewReader("echo hi\n"), 0x1d)
+	if err != nil || detached {
+		t.Errorf("Expected plain EOF, got detached=%v err=%v", detached, err)
+	}
+	if out.String() != "echo hi\n" {
+		t.Errorf("Unexpected forwarded input %q", out.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+)
+
+const qmpTimeout = 5 * time.Second
+
+// qmpSocketPath is the per-VM QMP control socket passed to QEMU with -qmp.
+func qmpSocketPath(vm VMConfig) string {
+	return runtimeSocketPath(vm, "qmp")
+}
+
+// dialQMP opens a QMP session to a running VM.
+func dialQMP(vm VMConfig) (*qmp.Client, error) {
+	client, err := qmp.Dial(qmpSocketPath(vm), qmpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("QMP unavailable for VM '%s': %v", vm.Name, err)
+	}
+	return client, nil
+}
+
+// dialQMPWhenReady dials a VM that is still starting, retrying until its
+// QMP socket accepts, ctx expires or done is closed because QEMU exited.
+func dialQMPWhenReady(ctx context.Context, vm VMConfig, done <-chan struct{}) (*qmp.Client, error) {
+	for {
+		client, err := dialQMP(vm)
+		if err == nil {
+			return client, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-done:
+			return nil, fmt.Errorf("QEMU exited")
+		case <-time.After(migratePollEvery):
+		}
+	}
+}
+
+// withQMP runs fn against a short-lived QMP session to the VM.
+func withQMP(vm VMConfig, fn func(ctx context.Context, client *qmp.Client) error) error {
+	client, err := dialQMP(vm)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), qmpTimeout)
+	defer cancel()
+	return fn(ctx, client)
+}
+
+// powerdownVM presses the guest's ACPI power button.
+func powerdownVM(vm VMConfig) error {
+	return withQMP(vm, func(ctx context.Context, client *qmp.Client) error {
+		return client.SystemPowerdown(ctx)
+	})
+}
+
+// reconcileRunState aligns a live VM's stored state with QEMU's own view of
+// whether its vCPUs are running, and reports whether anything changed.
+func reconcileRunState(vm *VMConfig) bool {
+	if vm.Status != StateRunning && vm.Status != StatePaused {
+		return false
+	}
+
+	var status qmp.Status
+	err := withQMP(*vm, func(ctx context.Context, client *qmp.Client) error {
+		var err error
+		status, err = client.QueryStatus(ctx)
+		return err
+	})
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case status.Running && vm.Status == StatePaused:
+		vm.Status = StateRunning
+	case !status.Running && status.Status == "paused" && vm.Status == StateRunning:
+		vm.Status = StatePaused
+	default:
+		return false
+	}
+	return true
+}
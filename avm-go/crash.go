@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	crashTailLines  = 50 // stderr and serial lines kept per crash record
+	crashRecordsMax = 20 // records kept per VM, oldest dropped first
+)
+
+// crashRecord is the post-mortem of a VM process that exited on its own.
+type crashRecord struct {
+	Time     time.Time     `json:"time"`
+	VM       string        `json:"vm"`
+	ExitCode int           `json:"exit_code"`
+	Signal   string        `json:"signal,omitempty"`
+	Uptime   time.Duration `json:"uptime"`
+	Restart  bool          `json:"restart"` // whether the restart policy relaunched it
+	Argv     []string      `json:"argv"`
+	Stderr   []string      `json:"stderr"`
+	Serial   []string      `json:"serial"`
+}
+
+// crashLogPath is the per-VM file crash records are appended to, one JSON
+// object per line.
+func crashLogPath(vmName string) string {
+	return filepath.Join(paths.Logs, "crashes", vmName+".jsonl")
+}
+
+// exitSignal names the signal that killed a process, or "" if it exited.
+func exitSignal(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal().String()
+	}
+	return ""
+}
+
+// tailBuffer is an io.Writer that keeps the last max lines written to it.
+type tailBuffer struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial string
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parts := strings.Split(t.partial+string(p), "\n")
+	t.partial = parts[len(parts)-1]
+	for _, line := range parts[:len(parts)-1] {
+		t.lines = append(t.lines, strings.TrimRight(line, "\r"))
+	}
+	if len(t.lines) > t.max {
+		t.lines = append([]string(nil), t.lines[len(t.lines)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns the retained lines, including an unterminated last line.
+func (t *tailBuffer) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string(nil), t.lines...)
+	if t.partial != "" {
+		lines = append(lines, t.partial)
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
+
+// tailFile returns the last n lines of a file, or nil if it can't be read.
+func tailFile(path string, n int) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	// The serial log grows without bound; only read its end.
+	const window = 64 << 10
+	if info, err := f.Stat(); err == nil && info.Size() > window {
+		f.Seek(info.Size()-window, 0)
+	}
+
+	tail := newTailBuffer(n)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), window)
+	for scanner.Scan() {
+		tail.Write(append(scanner.Bytes(), '\n'))
+	}
+	return tail.Lines()
+}
+
+// appendCrashRecord stores rec, keeping only the newest crashRecordsMax.
+func appendCrashRecord(rec crashRecord) error {
+	path := crashLogPath(rec.VM)
+	records, err := readCrashRecords(rec.VM)
+	if err != nil {
+		return err
+	}
+	records = append(records, rec)
+	if len(records) > crashRecordsMax {
+		records = records[len(records)-crashRecordsMax:]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// readCrashRecords returns a VM's crash records, oldest first.
+func readCrashRecords(vmName string) ([]crashRecord, error) {
+	data, err := os.ReadFile(crashLogPath(vmName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []crashRecord
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var rec crashRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			log.Warnf("Skipping unreadable crash record for VM '%s': %v", vmName, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// describeExit renders a record's exit status for humans.
+func (r crashRecord) describeExit() string {
+	if r.Signal != "" {
+		return "killed by " + r.Signal
+	}
+	if r.ExitCode > 128 {
+		// proot and bash report a signalled child as 128+signal.
+		return fmt.Sprintf("exit %d (%s)", r.ExitCode, syscall.Signal(r.ExitCode-128))
+	}
+	return fmt.Sprintf("exit %d", r.ExitCode)
+}
+
+// summary is a one-paragraph description used for AI diagnostics.
+func (r crashRecord) summary() string {
+	s := fmt.Sprintf("crashed at %s after %s, %s", r.Time.Format(time.RFC3339), r.Uptime.Round(time.Second), r.describeExit())
+	if n := len(r.Stderr); n > 0 {
+		s += fmt.Sprintf("; last QEMU stderr: %s", strings.Join(r.Stderr[max(0, n-5):], " | "))
+	}
+	if n := len(r.Serial); n > 0 {
+		s += fmt.Sprintf("; last console output: %s", strings.Join(r.Serial[max(0, n-5):], " | "))
+	}
+	return s
+}
+
+// listVMEvents is the `avm-go vm events` action.
+func listVMEvents(c *cli.Context) error {
+	vmName := c.String("name")
+	if vmName == "" {
+		return fmt.Errorf("VM name is required")
+	}
+	records, err := readCrashRecords(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to read crash records: %v", err)
+	}
+
+	if c.Bool("json") {
+		jsonData, _ := json.MarshalIndent(records, "", "  ")
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	if len(records) == 0 {
+		color.Green("✅ No crashes recorded for VM '%s'", vmName)
+		return nil
+	}
+
+	color.Cyan("💥 Crash records for VM '%s':", vmName)
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"#", "Time", "Exit", "Uptime", "Restarted"})
+	for i, rec := range records {
+		table.Append([]string{
+			fmt.Sprintf("%d", i+1),
+			rec.Time.Format("2006-01-02 15:04:05"),
+			rec.describeExit(),
+			rec.Uptime.Round(time.Second).String(),
+			fmt.Sprintf("%v", rec.Restart),
+		})
+	}
+	table.Render()
+
+	if !c.Bool("verbose") {
+		color.Cyan("Use --verbose for QEMU stderr, console output and argv of the latest crash")
+		return nil
+	}
+
+	last := records[len(records)-1]
+	color.Cyan("\nQEMU command:")
+	fmt.Println(strings.Join(last.Argv, " "))
+	color.Cyan("\nQEMU stderr (last %d lines):", len(last.Stderr))
+	for _, line := range last.Stderr {
+		fmt.Println(line)
+	}
+	color.Cyan("\nSerial console (last %d lines):", len(last.Serial))
+	for _, line := range last.Serial {
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tail := newTailBuffer(2)
+	tail.Write([]byte("one\ntw"))
+	tail.Write([]byte("o\r\nthree\nfour"))
+
+	expected := []string{"three", "four"}
+	if got := tail.Lines(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestCrashRecordsRoundTrip(t *testing.T) {
+	withPaths(t, avmPaths{Logs: t.TempDir()})
+
+	for i := 0; i < crashRecordsMax+3; i++ {
+		rec := crashRecord{
+			Time:     time.Now(),
+			VM:       "dev",
+			ExitCode: i,
+			Argv:     []string{"qemu-system-x86_64", "-m", "2048"},
+			Stderr:   []string{"qemu: terminating"},
+		}
+		if err := appendCrashRecord(rec); err != nil {
+			t.Fatalf("appendCrashRecord failed: %v", err)
+		}
+	}
+
+	records, err := readCrashRecords("dev")
+	if err != nil {
+		t.Fatalf("readCrashRecords failed: %v", err)
+	}
+	if len(records) != crashRecordsMax {
+		t.Fatalf("Expected %d records, got %d", crashRecordsMax, len(records))
+	}
+	if records[0].ExitCode != 3 || records[len(records)-1].ExitCode != crashRecordsMax+2 {
+		t.Errorf("Expected the oldest records to be dropped, got exit codes %d..%d", records[0].ExitCode, records[len(records)-1].ExitCode)
+	}
+
+	none, err := readCrashRecords("other")
+	if err != nil || len(none) != 0 {
+		t.Errorf("Expected no records for a VM that never crashed, got %v, %v", none, err)
+	}
+}
+
+func TestDescribeExit(t *testing.T) {
+	cases := map[string]crashRecord{
+		"killed by killed": {Signal: "killed"},
+		"exit 1":           {ExitCode: 1},
+		"exit 137":         {ExitCode: 137},
+	}
+	for expected, rec := range cases {
+		if got := rec.describeExit(); !strings.HasPrefix(got, expected) {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+}
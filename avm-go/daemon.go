@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// RestartPolicy controls what the daemon does when a VM process exits.
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+const (
+	restartBackoffMin = 1 * time.Second
+	restartBackoffMax = 2 * time.Minute
+	// A VM that stays up this long is considered healthy again and its
+	// backoff is reset.
+	restartStableAfter = 1 * time.Minute
+)
+
+// daemonRequest is a single newline-delimited JSON request sent by the CLI.
+type daemonRequest struct {
+	Action   string        `json:"action"` // ping, start, stop, hibernate
+	VM       string        `json:"vm,omitempty"`
+	Headless bool          `json:"headless,omitempty"`
+	Force    bool          `json:"force,omitempty"` // stop: kill; start: skip the capacity check
+	Timeout  time.Duration `json:"timeout,omitempty"`
+
+	// Overrides are the caller's AVM_* variables and setting flags for a
+	// start, see settings.go.
+	Overrides settingOverrides `json:"overrides,omitempty"`
+}
+
+// daemonResponse is the daemon's reply to a daemonRequest.
+type daemonResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	PID   int    `json:"pid,omitempty"`
+}
+
+// supervisor owns every QEMU process started through the daemon.
+type supervisor struct {
+	configPath string
+
+	mu  sync.Mutex
+	vms map[string]*supervisedVM
+}
+
+// supervisedVM tracks one running VM process and its restart state.
+type supervisedVM struct {
+	name      string
+	headless  bool
+	cmd       *exec.Cmd
+	startedAt time.Time
+	backoff   time.Duration
+	stopping  bool
+	done      chan struct{}
+	argv      []string    // QEMU argv of the current process, for crash records
+	stderr    *tailBuffer // recent QEMU output, for crash records
+
+	// restoreFailed is set when the process was killed because it could
+	// not load its hibernated state; it is not restarted.
+	restoreFailed bool
+
+	overrides     settingOverrides // from the start request, kept for restarts
+	force         bool             // start despite host capacity, kept for restarts
+	restartPolicy RestartPolicy    // resolved at launch
+}
+
+// daemonSocketPath is the socket of the daemon serving configPath, in the
+// runtime directory. Daemons for other config files get their own socket.
+func daemonSocketPath(configPath string) string {
+	name := "avmd.sock"
+	if configPath != paths.Config {
+		sum := sha256.Sum256([]byte(configPath))
+		name = fmt.Sprintf("avmd-%x.sock", sum[:4])
+	}
+	return filepath.Join(paths.Run, name)
+}
+
+func daemonLogPath() string {
+	return filepath.Join(paths.Logs, "avmd.log")
+}
+
+// runDaemon is the `avm-go daemon` action. It serves CLI requests on a unix
+// socket in the runtime directory until interrupted.
+func runDaemon(c *cli.Context) error {
+	configPath := configPathFlag(c)
+	socketPath := daemonSocketPath(configPath)
+
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("daemon already running on %s", socketPath)
+	}
+	os.Remove(socketPath)
+
+	// The runtime directory may not exist yet on a fresh AVM_HOME or
+	// XDG_RUNTIME_DIR.
+	if err := os.MkdirAll(paths.Run, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", paths.Run, err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+
+	sup := &supervisor{
+		configPath: configPath,
+		vms:        make(map[string]*supervisedVM),
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		listener.Close()
+	}()
+
+	stopMetrics := make(chan struct{})
+	defer close(stopMetrics)
+	go sup.recordMetrics(stopMetrics)
+
+	log.WithFields(logrus.Fields{
+		"action": "daemon",
+		"socket": socketPath,
+		"pid":    os.Getpid(),
+	}).Info("Daemon started")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go sup.serve(conn)
+	}
+
+	log.WithField("action", "daemon").Info("Daemon stopped, running VMs are left unsupervised")
+	return nil
+}
+
+func (s *supervisor) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var req daemonRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(daemonResponse{Error: fmt.Sprintf("bad request: %v", err)})
+		return
+	}
+
+	resp := daemonResponse{OK: true}
+	switch req.Action {
+	case "ping":
+		resp.PID = os.Getpid()
+	case "start":
+		pid, err := s.start(req.VM, req.Headless, req.Force, req.Overrides)
+		if err != nil {
+			resp = daemonResponse{Error: err.Error()}
+		}
+		resp.PID = pid
+	case "stop":
+		if err := s.stop(req.VM, shutdownOptions{Timeout: req.Timeout, Force: req.Force}); err != nil {
+			resp = daemonResponse{Error: err.Error()}
+		}
+	case "hibernate":
+		if err := s.hibernate(req.VM); err != nil {
+			resp = daemonResponse{Error: err.Error()}
+		}
+	default:
+		resp = daemonResponse{Error: fmt.Sprintf("unknown action '%s'", req.Action)}
+	}
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// start launches a VM and begins watching it.
+func (s *supervisor) start(vmName string, headless, force bool, overrides settingOverrides) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vm, ok := s.vms[vmName]; ok && !vm.stopping {
+		return vm.cmd.Process.Pid, fmt.Errorf("VM '%s' is already running", vmName)
+	}
+
+	sv := &supervisedVM{name: vmName, headless: headless, force: force, backoff: restartBackoffMin, overrides: overrides}
+	if err := s.launch(sv); err != nil {
+		return 0, err
+	}
+	s.vms[vmName] = sv
+	return sv.cmd.Process.Pid, nil
+}
+
+// launch spawns the VM process and records it in the config. The caller
+// must hold s.mu.
+func (s *supervisor) launch(sv *supervisedVM) error {
+	config, err := loadConfig(s.configPath)
+	if err != nil {
+		return err
+	}
+	if vm, ok := config.VMs[sv.name]; ok {
+		if resolved, _, err := resolveVM(config.Defaults, vm, sv.overrides); err == nil {
+			// A taken port would only show up as QEMU failing to start.
+			if err := checkPortsFree(config, sv.name, resolved); err != nil {
+				return fmt.Errorf("cannot start VM '%s': %v", sv.name, err)
+			}
+			// Every start, restart and `up` passes through here.
+			if err := admitVM(config, resolved, sv.force); err != nil {
+				return err
+			}
+		}
+	}
+
+	vmConfig, err := s.setState(sv.name, StateStarting)
+	if err != nil {
+		return err
+	}
+
+	vmConfig, _, err = resolveVM(config.Defaults, vmConfig, sv.overrides)
+	if err == nil {
+		err = validateVM(vmConfig)
+	}
+	if err != nil {
+		s.setState(sv.name, StateCrashed)
+		return fmt.Errorf("VM '%s' has invalid settings: %v", sv.name, err)
+	}
+	sv.restartPolicy = vmConfig.RestartPolicy
+
+	for _, dir := range []string{filepath.Dir(vmLogPath(vmConfig)), filepath.Dir(vmPIDFile(vmConfig)), paths.Run} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Warnf("Failed to create %s for VM '%s': %v", dir, sv.name, err)
+		}
+	}
+
+	q := buildQEMUCommand(vmConfig, qemuOptions{Headless: sv.headless})
+	log.WithField("vm", sv.name).Infof("QEMU accelerator: %s", q.Accel)
+	cmd := q.Command()
+	sv.stderr = newTailBuffer(crashTailLines)
+	cmd.Stdout = sv.stderr
+	cmd.Stderr = sv.stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		s.setState(sv.name, StateCrashed)
+		return fmt.Errorf("failed to start VM '%s': %v", sv.name, err)
+	}
+
+	sv.cmd = cmd
+	sv.restoreFailed = false
+	sv.argv = q.Argv()
+	sv.startedAt = time.Now()
+	sv.done = make(chan struct{})
+
+	if err := os.WriteFile(vmPIDFile(vmConfig), []byte(fmt.Sprintf("%d", cmd.Process.Pid)), 0644); err != nil {
+		log.Warnf("Failed to save PID file for VM '%s': %v", sv.name, err)
+	}
+
+	if _, err := s.setState(sv.name, StateRunning); err != nil {
+		log.Warnf("Failed to record VM '%s' as running: %v", sv.name, err)
+	}
+	// The guest holds its boot memory until the balloon reports otherwise,
+	// so current_ram stays unset until then and admission counts that.
+	ramMB, _ := vmConfig.RAM.MB()
+	cpus, _ := strconv.Atoi(vmConfig.CPU)
+	s.updateVM(sv.name, func(vm *VMConfig) error {
+		vm.Resources.CurrentRAM = 0
+		vm.Resources.CurrentCPU = cpus
+		return nil
+	})
+
+	log.WithFields(logrus.Fields{
+		"action": "start",
+		"vm":     sv.name,
+		"pid":    cmd.Process.Pid,
+	}).Info("VM started")
+
+	go s.watch(sv)
+	if vmConfig.SavedState != "" {
+		go s.restore(sv, vmConfig, sv.done)
+	} else if bootMemoryMB(vmConfig, ramMB) > ramMB {
+		// A restored VM brings its balloon target with its saved state.
+		done := sv.done
+		go func() {
+			current, err := setInitialBalloon(vmConfig, ramMB, done)
+			if err != nil {
+				log.Warnf("Failed to set initial memory of VM '%s': %v", sv.name, err)
+			}
+			if current > 0 {
+				s.updateVM(sv.name, func(vm *VMConfig) error {
+					vm.Resources.CurrentRAM = current
+					return nil
+				})
+			}
+		}()
+	}
+	return nil
+}
+
+// restore resumes a VM that was started from hibernated state and drops the
+// consumed state file. If the state can't be loaded QEMU would wait in
+// inmigrate forever, so it is killed and the VM recorded as crashed; the
+// state file is kept for another attempt.
+func (s *supervisor) restore(sv *supervisedVM, vmConfig VMConfig, done <-chan struct{}) {
+	vmName := sv.name
+	err := finishRestore(vmConfig, done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Warnf("Failed to restore VM '%s' from %s: %v", vmName, vmConfig.SavedState, err)
+		select {
+		case <-done:
+			// Already exited; watch recorded it.
+		default:
+			if !sv.stopping {
+				sv.restoreFailed = true
+				signalGroup(sv.cmd.Process.Pid, syscall.SIGKILL)
+			}
+		}
+		return
+	}
+
+	s.updateVM(vmName, func(vm *VMConfig) error {
+		vm.SavedState = ""
+		return nil
+	})
+	os.Remove(vmConfig.SavedState)
+
+	log.WithFields(logrus.Fields{"action": "restore", "vm": vmName}).Info("VM restored from hibernation")
+}
+
+// watch reaps the VM process, records how it exited and applies the
+// restart policy.
+func (s *supervisor) watch(sv *supervisedVM) {
+	err := sv.cmd.Wait()
+	exitCode := sv.cmd.ProcessState.ExitCode()
+	close(sv.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := StateStopped
+	if sv.restoreFailed || !sv.stopping && exitCode != 0 {
+		next = StateCrashed
+	}
+	restart := false
+	vmConfig, updateErr := s.updateVM(sv.name, func(vm *VMConfig) error {
+		if err := vm.transition(next); err != nil {
+			log.Warnf("Forcing VM '%s' to %s: %v", sv.name, next, err)
+			vm.Status = next
+		}
+		vm.LastExitCode = exitCode
+		vm.LastExitAt = time.Now()
+		vm.Resources.Guest = nil
+		restart = !sv.stopping && !sv.restoreFailed && shouldRestart(sv.restartPolicy, exitCode)
+		if restart {
+			vm.Restarts++
+		}
+		return nil
+	})
+	if updateErr != nil {
+		log.Warnf("Failed to record exit of VM '%s': %v", sv.name, updateErr)
+		delete(s.vms, sv.name)
+		return
+	}
+	os.Remove(vmPIDFile(vmConfig))
+
+	log.WithFields(logrus.Fields{
+		"action":    "exit",
+		"vm":        sv.name,
+		"exit_code": exitCode,
+		"requested": sv.stopping,
+	}).Infof("VM process exited: %v", err)
+
+	if next == StateCrashed {
+		rec := crashRecord{
+			Time:     vmConfig.LastExitAt,
+			VM:       sv.name,
+			ExitCode: exitCode,
+			Signal:   exitSignal(sv.cmd.ProcessState),
+			Uptime:   vmConfig.LastExitAt.Sub(sv.startedAt),
+			Restart:  restart,
+			Argv:     sv.argv,
+			Stderr:   sv.stderr.Lines(),
+			Serial:   tailFile(vmLogPath(vmConfig), crashTailLines),
+		}
+		if err := appendCrashRecord(rec); err != nil {
+			log.Warnf("Failed to save crash record for VM '%s': %v", sv.name, err)
+		}
+	}
+
+	if !restart {
+		delete(s.vms, sv.name)
+		return
+	}
+
+	if time.Since(sv.startedAt) > restartStableAfter {
+		sv.backoff = restartBackoffMin
+	}
+	delay := sv.backoff
+	sv.backoff *= 2
+	if sv.backoff > restartBackoffMax {
+		sv.backoff = restartBackoffMax
+	}
+
+	log.WithFields(logrus.Fields{
+		"action": "restart",
+		"vm":     sv.name,
+		"delay":  delay.String(),
+		"policy": sv.restartPolicy,
+	}).Info("Scheduling VM restart")
+
+	go func() {
+		time.Sleep(delay)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.vms[sv.name] != sv || sv.stopping {
+			return
+		}
+		if err := s.launch(sv); err != nil {
+			log.Warnf("Failed to restart VM '%s': %v", sv.name, err)
+			delete(s.vms, sv.name)
+		}
+	}()
+}
+
+// stop shuts a VM down and waits for its process to exit.
+func (s *supervisor) stop(vmName string, opts shutdownOptions) error {
+	s.mu.Lock()
+	sv, ok := s.vms[vmName]
+	if !ok {
+		s.mu.Unlock()
+		return s.stopUnsupervised(vmName, opts)
+	}
+	sv.stopping = true
+	done := sv.done
+
+	select {
+	case <-done:
+		// Already exited, possibly waiting out a restart backoff; the
+		// stopping flag cancels the restart.
+		delete(s.vms, vmName)
+		_, err := s.setState(vmName, StateStopped)
+		s.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to record VM '%s' as stopped: %v", vmName, err)
+		}
+		return nil
+	default:
+	}
+
+	pid := sv.cmd.Process.Pid
+	vmConfig, err := s.setState(vmName, StateStopping)
+	s.mu.Unlock()
+	if err != nil {
+		log.Warnf("Stopping VM '%s' without a config record: %v", vmName, err)
+		vmConfig = VMConfig{Name: vmName}
+	}
+	return shutdownVM(vmConfig, pid, done, opts)
+}
+
+// hibernate saves a supervised VM's machine state to disk and quits QEMU.
+func (s *supervisor) hibernate(vmName string) error {
+	s.mu.Lock()
+	sv, ok := s.vms[vmName]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("VM '%s' is not supervised by this daemon, stop and start it first", vmName)
+	}
+	done := sv.done
+	wasPaused := false
+	vmConfig, err := s.updateVM(vmName, func(vm *VMConfig) error {
+		wasPaused = vm.Status == StatePaused
+		if wasPaused {
+			return nil
+		}
+		return vm.transition(StatePausing)
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	client, err := dialQMP(vmConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	statePath := hibernateStatePath(vmName)
+	if err := saveMachineState(client, statePath); err != nil {
+		os.Remove(statePath)
+		if !wasPaused {
+			ctx, cancel := context.WithTimeout(context.Background(), qmpTimeout)
+			defer cancel()
+			client.Cont(ctx)
+			s.mu.Lock()
+			s.setState(vmName, StateRunning)
+			s.mu.Unlock()
+		}
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+
+	s.mu.Lock()
+	sv.stopping = true
+	s.setState(vmName, StatePaused)
+	s.setState(vmName, StateStopping)
+	s.updateVM(vmName, func(vm *VMConfig) error {
+		vm.SavedState = statePath
+		return nil
+	})
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), qmpTimeout)
+	defer cancel()
+	if err := client.Quit(ctx); err != nil && err != qmp.ErrClosed {
+		log.Warnf("QMP quit failed for VM '%s': %v", vmName, err)
+	}
+
+	if !waitExit(sv.cmd.Process.Pid, done, terminateGracePeriod) {
+		return shutdownVM(vmConfig, sv.cmd.Process.Pid, done, shutdownOptions{Force: true})
+	}
+	return nil
+}
+
+// stopUnsupervised stops a VM that was started before this daemon instance,
+// using only its PID file.
+func (s *supervisor) stopUnsupervised(vmName string, opts shutdownOptions) error {
+	s.mu.Lock()
+	vmConfig, err := s.setState(vmName, StateStopping)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// A PID that is gone, or now belongs to another process, is not
+	// signalled; the VM is just recorded as stopped.
+	if pid, alive := vmPID(vmConfig); alive {
+		if err := shutdownVM(vmConfig, pid, nil, opts); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(vmPIDFile(vmConfig))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.setState(vmName, StateStopped)
+	return err
+}
+
+// setState records a state transition for a VM and returns its updated
+// config. The caller must hold s.mu.
+func (s *supervisor) setState(vmName string, next VMState) (VMConfig, error) {
+	return s.updateVM(vmName, func(vm *VMConfig) error {
+		return vm.transition(next)
+	})
+}
+
+// updateVM applies fn to a VM's stored config and saves it. The caller
+// must hold s.mu.
+func (s *supervisor) updateVM(vmName string, fn func(vm *VMConfig) error) (VMConfig, error) {
+	return updateVM(s.configPath, vmName, fn)
+}
+
+func shouldRestart(policy RestartPolicy, exitCode int) bool {
+	switch policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// callDaemon sends a request to the daemon, starting it first if needed.
+func callDaemon(configPath string, req daemonRequest) (daemonResponse, error) {
+	if err := ensureDaemon(configPath); err != nil {
+		return daemonResponse{}, err
+	}
+
+	conn, err := net.Dial("unix", daemonSocketPath(configPath))
+	if err != nil {
+		return daemonResponse{}, fmt.Errorf("failed to connect to daemon: %v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return daemonResponse{}, fmt.Errorf("failed to send request to daemon: %v", err)
+	}
+
+	var resp daemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return daemonResponse{}, fmt.Errorf("failed to read daemon response: %v", err)
+	}
+	if !resp.OK {
+		return resp, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+// ensureDaemon starts a background daemon for configPath unless one is
+// already listening.
+func ensureDaemon(configPath string) error {
+	socketPath := daemonSocketPath(configPath)
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate avm-go binary: %v", err)
+	}
+
+	logPath := daemonLogPath()
+	os.MkdirAll(filepath.Dir(logPath), 0755)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open daemon log: %v", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, "daemon", "--config", configPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	detachProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %v", err)
+	}
+	color.Cyan("🛰️  Started avm-go daemon (PID: %d)", cmd.Process.Pid)
+	cmd.Process.Release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("daemon did not come up, see %s", logPath)
+}
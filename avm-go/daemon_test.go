@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestDaemonStartsInEmptyAVMHome(t *testing.T) {
+	t.Setenv("AVM_HOME", t.TempDir())
+	withPaths(t, resolvePaths())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- runDaemon(cli.NewContext(cli.NewApp(), flag.NewFlagSet("daemon", flag.ContinueOnError), nil))
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Dial directly: callDaemon would spawn a daemon of its own.
+		conn, err := net.Dial("unix", daemonSocketPath(paths.Config))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case err := <-errs:
+			t.Fatalf("Daemon exited: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Daemon did not come up in %s: %v", paths.Run, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	self, _ := os.FindProcess(os.Getpid())
+	self.Signal(syscall.SIGTERM)
+	if err := <-errs; err != nil {
+		t.Errorf("Daemon failed: %v", err)
+	}
+}
+
+func TestStopDuringRestartBackoff(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := Config{VMs: map[string]VMConfig{"dev": {Name: "dev", RAM: "1024", CPU: "1", Status: StateCrashed}}}
+	if err := replaceConfig(configPath, &config); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	sv := &supervisedVM{name: "dev", done: done}
+	s := &supervisor{configPath: configPath, vms: map[string]*supervisedVM{"dev": sv}}
+
+	if err := s.stop("dev", shutdownOptions{}); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if _, ok := s.vms["dev"]; ok || !sv.stopping {
+		t.Error("Expected the VM to leave supervision with its restart cancelled")
+	}
+	config, _ = loadConfig(configPath)
+	if got := config.VMs["dev"].Status; got != StateStopped {
+		t.Errorf("Expected the VM to be recorded as stopped, got %s", got)
+	}
+}
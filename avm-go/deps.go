@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// startOrder returns names plus everything they depend on, ordered so each
+// VM comes after its dependencies. Ties are broken by name so the order is
+// stable. It fails on unknown dependencies and on cycles.
+func startOrder(vms map[string]VMConfig, names []string) ([]string, error) {
+	const (
+		visiting = iota + 1
+		done
+	)
+	marks := make(map[string]int)
+	var order, path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case done:
+			return nil
+		case visiting:
+			start := 0
+			for i, n := range path {
+				if n == name {
+					start = i
+				}
+			}
+			cycle := append(append([]string(nil), path[start:]...), name)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		vm, exists := vms[name]
+		if !exists {
+			if len(path) > 0 {
+				return fmt.Errorf("VM '%s' depends on unknown VM '%s'", path[len(path)-1], name)
+			}
+			return fmt.Errorf("VM '%s' not found", name)
+		}
+
+		marks[name] = visiting
+		path = append(path, name)
+		deps := append([]string(nil), vm.DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = done
+		order = append(order, name)
+		return nil
+	}
+
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// validateDependencies checks every VM's depends_on for unknown VMs and
+// cycles.
+func validateDependencies(vms map[string]VMConfig) error {
+	names := make([]string, 0, len(vms))
+	for name := range vms {
+		names = append(names, name)
+	}
+	_, err := startOrder(vms, names)
+	return err
+}
+
+// dependentsOf lists the VMs that depend on name directly.
+func dependentsOf(vms map[string]VMConfig, name string) []string {
+	var dependents []string
+	for other, vm := range vms {
+		for _, dep := range vm.DependsOn {
+			if dep == name {
+				dependents = append(dependents, other)
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// hasDependents reports whether any VM in order depends on name.
+func hasDependents(vms map[string]VMConfig, order []string, name string) bool {
+	for _, other := range order {
+		for _, dep := range vms[other].DependsOn {
+			if dep == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upVMs is the `avm-go up` action: it starts the named VMs, or every
+// autostart VM, after their dependencies are up and reachable.
+func upVMs(c *cli.Context) error {
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	names := c.Args().Slice()
+	if len(names) == 0 {
+		for name := range config.VMs {
+			if orZero(config.displayVM(name).Autostart) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			color.Yellow("⚠️  No VMs are marked autostart")
+			return nil
+		}
+	}
+
+	order, err := startOrder(config.VMs, names)
+	if err != nil {
+		return err
+	}
+
+	color.Cyan("🚀 Bringing up: %s", strings.Join(order, " → "))
+	overrides := envOverrides()
+	for _, name := range order {
+		vm, _, err := resolveVM(config.Defaults, config.VMs[name], overrides)
+		if err != nil {
+			return fmt.Errorf("VM '%s' has invalid settings: %v", name, err)
+		}
+		if vm.Status.Active() {
+			color.Yellow("⚠️  VM '%s' is already %s", name, vm.Status)
+		} else {
+			resp, err := callDaemon(configPath, daemonRequest{
+				Action:    "start",
+				VM:        name,
+				Headless:  c.Bool("headless"),
+				Force:     c.Bool("force"),
+				Overrides: overrides,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to start VM '%s': %v", name, err)
+			}
+			color.Green("✅ VM '%s' started (PID: %d)", name, resp.PID)
+			vm.Status = StateRunning
+		}
+
+		if !hasDependents(config.VMs, order, name) {
+			continue
+		}
+		if err := waitForVM(vm, c.Duration("timeout")); err != nil {
+			return fmt.Errorf("VM '%s' is not ready, not starting its dependents: %v", name, err)
+		}
+		color.Green("✅ VM '%s' is ready", name)
+	}
+
+	return nil
+}
+
+// waitForVM blocks until vm passes its readiness checks.
+func waitForVM(vm VMConfig, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	alive := func() bool {
+		pid, ok := vmPID(vm)
+		return ok && processAlive(pid)
+	}
+	return waitReady(ctx, readinessPhases(vm), alive, func(phase string) {
+		color.Cyan("⏳ %s: %s...", vm.Name, phase)
+	})
+}
+
+// downVMs is the `avm-go down` action: it stops the named VMs and their
+// dependents, or every active VM, dependents first.
+func downVMs(c *cli.Context) error {
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	all := make([]string, 0, len(config.VMs))
+	for name := range config.VMs {
+		all = append(all, name)
+	}
+	order, err := startOrder(config.VMs, all)
+	if err != nil {
+		return err
+	}
+
+	// Stopping a VM takes down whatever depends on it, never what it
+	// depends on.
+	selected := make(map[string]bool)
+	var mark func(name string)
+	mark = func(name string) {
+		if selected[name] {
+			return
+		}
+		selected[name] = true
+		for _, dependent := range dependentsOf(config.VMs, name) {
+			mark(dependent)
+		}
+	}
+	for _, name := range c.Args().Slice() {
+		if _, exists := config.VMs[name]; !exists {
+			return fmt.Errorf("VM '%s' not found", name)
+		}
+		mark(name)
+	}
+
+	stopped := 0
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		if c.Args().Len() > 0 && !selected[name] {
+			continue
+		}
+		if !config.VMs[name].Status.Active() {
+			continue
+		}
+
+		color.Cyan("⏻  Stopping VM '%s'...", name)
+		_, err := callDaemon(configPath, daemonRequest{
+			Action:  "stop",
+			VM:      name,
+			Timeout: c.Duration("timeout"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to stop VM '%s': %v", name, err)
+		}
+		color.Green("✅ VM '%s' stopped", name)
+		stopped++
+	}
+
+	if stopped == 0 {
+		color.Yellow("⚠️  No VMs are running")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStartOrder(t *testing.T) {
+	vms := map[string]VMConfig{
+		"app":   {DependsOn: []string{"db", "cache"}},
+		"db":    {},
+		"cache": {DependsOn: []string{"db"}},
+		"other": {},
+	}
+
+	order, err := startOrder(vms, []string{"app"})
+	if err != nil {
+		t.Fatalf("startOrder failed: %v", err)
+	}
+	expected := []string{"db", "cache", "app"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected %v, got %v", expected, order)
+	}
+}
+
+func TestStartOrderCycle(t *testing.T) {
+	vms := map[string]VMConfig{
+		"a": {DependsOn: []string{"b"}},
+		"b": {DependsOn: []string{"c"}},
+		"c": {DependsOn: []string{"a"}},
+	}
+
+	err := validateDependencies(vms)
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("Expected the cycle to be reported, got %v", err)
+	}
+}
+
+func TestStartOrderUnknownDependency(t *testing.T) {
+	vms := map[string]VMConfig{"app": {DependsOn: []string{"db"}}}
+
+	err := validateDependencies(vms)
+	if err == nil || !strings.Contains(err.Error(), "unknown VM 'db'") {
+		t.Errorf("Expected unknown dependency error, got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Prometheus exporter. Every scrape reads the config and samples each VM
+// with the same collector `status` uses, and writes the result in the
+// Prometheus text exposition format. Scrapes never ask the guest agent:
+// disk usage is what the daemon's sampler or `status` last stored.
+
+const defaultExporterListen = ":9464"
+
+// scrapeQMPTimeout bounds each VM's balloon query during a scrape, well
+// under Prometheus's default 10s scrape timeout.
+const scrapeQMPTimeout = time.Second
+
+// promLabelName matches valid Prometheus label names.
+var promLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are label names the exporter sets itself, or that
+// Prometheus attaches to every target; VM labels can't use them.
+var reservedLabels = map[string]bool{
+	"vm": true, "state": true, "proto": true, "port": true, "use": true,
+	"job": true, "instance": true,
+}
+
+type promLabel struct {
+	Name, Value string
+}
+
+type promSample struct {
+	Labels []promLabel
+	Value  float64
+}
+
+// promFamily is one metric name with its HELP, TYPE and samples.
+type promFamily struct {
+	Name, Type, Help string
+	Samples          []promSample
+}
+
+// promRegistry collects families in the order they are first added.
+type promRegistry struct {
+	families []*promFamily
+	byName   map[string]*promFamily
+}
+
+func newPromRegistry() *promRegistry {
+	return &promRegistry{byName: map[string]*promFamily{}}
+}
+
+func (r *promRegistry) add(name, typ, help string, labels []promLabel, value float64) {
+	f := r.byName[name]
+	if f == nil {
+		f = &promFamily{Name: name, Type: typ, Help: help}
+		r.byName[name] = f
+		r.families = append(r.families, f)
+	}
+	f.Samples = append(f.Samples, promSample{Labels: labels, Value: value})
+}
+
+// write renders the registry in the text exposition format, version 0.0.4.
+func (r *promRegistry) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.Help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			bw.WriteString(f.Name)
+			if len(s.Labels) > 0 {
+				pairs := make([]string, len(s.Labels))
+				for i, l := range s.Labels {
+					pairs[i] = l.Name + `="` + escapeLabelValue(l.Value) + `"`
+				}
+				bw.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			bw.WriteString(" " + strconv.FormatFloat(s.Value, 'f', -1, 64) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// vmLabels is the vm label followed by the VM's own labels, sorted, and
+// then extra.
+func vmLabels(vm VMConfig, extra ...promLabel) []promLabel {
+	labels := []promLabel{{Name: "vm", Value: vm.Name}}
+	names := make([]string, 0, len(vm.Labels))
+	for name := range vm.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		labels = append(labels, promLabel{Name: name, Value: vm.Labels[name]})
+	}
+	return append(labels, extra...)
+}
+
+// allStates lists every state, for the avm_vm_state state set.
+var allStates = []VMState{StateCreating, StateStarting, StateRunning, StatePausing, StatePaused, StateStopping, StateStopped, StateCrashed}
+
+// exporter samples VMs for scrapes.
+type exporter struct {
+	configPath string
+	collector  *metricsCollector
+	balloon    func(vm VMConfig) (int64, error) // guest memory in bytes
+}
+
+func newExporter(configPath string) *exporter {
+	return &exporter{
+		configPath: configPath,
+		collector:  statusCollector,
+		balloon: func(vm VMConfig) (int64, error) {
+			client, err := qmp.Dial(qmpSocketPath(vm), scrapeQMPTimeout)
+			if err != nil {
+				return 0, err
+			}
+			defer client.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), scrapeQMPTimeout)
+			defer cancel()
+			info, err := client.QueryBalloon(ctx)
+			return info.Actual, err
+		},
+	}
+}
+
+// gather builds the exposition for every VM in the config.
+func (e *exporter) gather() (*promRegistry, error) {
+	config, err := loadConfig(e.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	names := make([]string, 0, len(config.VMs))
+	for name := range config.VMs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vms := make([]VMConfig, len(names))
+	for i, name := range names {
+		stored := config.VMs[name]
+		stored.Name = name
+		reconcileVM(&stored) // not saved; scrapes don't write the config
+		vm := config.displayVM(name)
+		vm.Name, vm.Status = name, stored.Status
+		vms[i] = vm
+	}
+	balloons := e.balloons(vms)
+
+	r := newPromRegistry()
+	for _, vm := range vms {
+		e.gatherVM(r, vm, balloons)
+	}
+	return r, nil
+}
+
+// balloons asks every live VM for its guest memory at once, so a slow
+// QEMU costs the scrape one scrapeQMPTimeout rather than one per VM. VMs
+// that didn't answer are left out.
+func (e *exporter) balloons(vms []VMConfig) map[string]int64 {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	actual := map[string]int64{}
+	for _, vm := range vms {
+		if _, alive := vmPID(vm); !alive {
+			continue
+		}
+		wg.Add(1)
+		go func(vm VMConfig) {
+			defer wg.Done()
+			if bytes, err := e.balloon(vm); err == nil {
+				mu.Lock()
+				actual[vm.Name] = bytes
+				mu.Unlock()
+			}
+		}(vm)
+	}
+	wg.Wait()
+	return actual
+}
+
+func (e *exporter) gatherVM(r *promRegistry, vm VMConfig, balloons map[string]int64) {
+	for _, state := range allStates {
+		value := 0.0
+		if vm.Status == state {
+			value = 1
+		}
+		r.add("avm_vm_state", "gauge", "VM lifecycle state; 1 for the current state.", vmLabels(vm, promLabel{"state", string(state)}), value)
+	}
+
+	pid, alive := vmPID(vm)
+	up := 0.0
+	if alive {
+		up = 1
+	}
+	r.add("avm_vm_up", "gauge", "Whether the VM's QEMU process is alive.", vmLabels(vm), up)
+
+	cpus, _ := strconv.Atoi(vm.CPU)
+	if alive && vm.Resources.CurrentCPU > 0 {
+		cpus = vm.Resources.CurrentCPU
+	}
+	r.add("avm_vm_vcpus", "gauge", "vCPUs, online ones while the VM runs.", vmLabels(vm), float64(cpus))
+
+	if mb, err := vm.RAM.MB(); err == nil {
+		r.add("avm_vm_memory_configured_bytes", "gauge", "Configured guest memory.", vmLabels(vm), float64(mb)*mib)
+	}
+	if alive {
+		actual, ok := balloons[vm.Name]
+		if !ok && vm.Resources.CurrentRAM > 0 {
+			actual, ok = int64(vm.Resources.CurrentRAM)*mib, true
+		}
+		if ok {
+			r.add("avm_vm_memory_actual_bytes", "gauge", "Guest memory after ballooning.", vmLabels(vm), float64(actual))
+		}
+
+		if m, err := e.collector.Collect(pid); err == nil {
+			r.add("avm_vm_cpu_seconds_total", "counter", "CPU time used by the VM's processes.", vmLabels(vm), m.CPUSeconds)
+			r.add("avm_vm_resident_memory_bytes", "gauge", "Resident memory of the VM's processes.", vmLabels(vm), float64(m.RSSBytes))
+			r.add("avm_vm_io_read_bytes_total", "counter", "Bytes the VM's processes read from storage.", vmLabels(vm), float64(m.ReadBytes))
+			r.add("avm_vm_io_write_bytes_total", "counter", "Bytes the VM's processes wrote to storage.", vmLabels(vm), float64(m.WriteBytes))
+			r.add("avm_vm_uptime_seconds", "gauge", "Time since the VM's process started.", vmLabels(vm), m.Uptime.Seconds())
+		}
+	}
+
+	r.add("avm_vm_disk_usage_bytes", "gauge", "Bytes used on the guest's filesystems, as last reported by the guest agent.", vmLabels(vm), float64(vm.Resources.DiskUsage))
+
+	for _, p := range vmPorts(vm) {
+		r.add("avm_vm_forwarded_port", "gauge", "Host ports forwarded to the VM; always 1.",
+			vmLabels(vm, promLabel{"proto", p.Proto}, promLabel{"port", strconv.Itoa(p.Port)}, promLabel{"use", p.Use}), 1)
+	}
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r, err := e.gather()
+	if err != nil {
+		log.Warnf("Exporter: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.write(w)
+}
+
+// runExporter is the `avm-go exporter` action.
+func runExporter(c *cli.Context) error {
+	listen := c.String("listen")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newExporter(configPathFlag(c)))
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintln(w, `<html><body><h1>avm-go exporter</h1><p><a href="/metrics">Metrics</a></p></body></html>`)
+	})
+
+	log.WithFields(logrus.Fields{"action": "exporter", "listen": listen}).Info("Exporter started")
+	color.Green("📡 Serving Prometheus metrics on %s/metrics", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		return fmt.Errorf("exporter failed: %v", err)
+	}
+	return nil
+}
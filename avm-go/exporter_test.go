@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromRegistryWrite(t *testing.T) {
+	r := newPromRegistry()
+	r.add("avm_vm_up", "gauge", "Whether it's up.", []promLabel{{"vm", "dev"}, {"note", "a \"b\" c\\d\ne"}}, 1)
+	r.add("avm_vm_up", "gauge", "Whether it's up.", []promLabel{{"vm", "db"}}, 0)
+	r.add("avm_vm_cpu_seconds_total", "counter", "CPU time.", nil, 1.5)
+
+	var out strings.Builder
+	if err := r.write(&out); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	want := `# HELP avm_vm_up Whether it's up.
+# TYPE avm_vm_up gauge
+avm_vm_up{vm="dev",note="a \"b\" c\\d\ne"} 1
+avm_vm_up{vm="db"} 0
+# HELP avm_vm_cpu_seconds_total CPU time.
+# TYPE avm_vm_cpu_seconds_total counter
+avm_vm_cpu_seconds_total 1.5
+`
+	if out.String() != want {
+		t.Errorf("Unexpected exposition:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestExporterScrape(t *testing.T) {
+	run := t.TempDir()
+	withPaths(t, avmPaths{Run: run})
+	pid := os.Getpid()
+	p := withFakeProc(t, 1000)
+	p.process(pid, 1, "qemu-system-x86", 5000, 40000, 1024, 4096, 512)
+	p.cmdline(pid, "qemu-system-x86_64", "-qmp", "unix:"+qmpSocketPath(VMConfig{Name: "dev"})+",server=on,wait=off")
+	if err := os.WriteFile(filepath.Join(run, "avm-dev.pid"), []byte(fmt.Sprint(pid)), 0644); err != nil {
+		t.Fatalf("Failed to write PID file: %v", err)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := Config{VMs: map[string]VMConfig{
+		"dev": {Name: "dev", RAM: "2048", CPU: "2", SSHPort: "2222", Status: StateRunning, Labels: map[string]string{"team": "infra", "env": "test"},
+			Resources: VMResources{CurrentCPU: 4, CurrentRAM: 1024, DiskUsage: 5<<30 + 1<<20}},
+		"db": {Name: "db", RAM: "1G", CPU: "1", SSHPort: "2223", Status: StateStopped, Resources: VMResources{DiskUsage: 3 << 30}},
+	}}
+	if err := replaceConfig(configPath, &config); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	e := newExporter(configPath)
+	e.collector = newMetricsCollector()
+	e.balloon = func(VMConfig) (int64, error) { return 0, fmt.Errorf("no QMP") }
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+
+	dev := `vm="dev",env="test",team="infra"`
+	for _, line := range []string{
+		`avm_vm_state{` + dev + `,state="running"} 1`,
+		`avm_vm_state{` + dev + `,state="stopped"} 0`,
+		`avm_vm_state{vm="db",state="stopped"} 1`,
+		`avm_vm_up{` + dev + `} 1`,
+		`avm_vm_up{vm="db"} 0`,
+		`avm_vm_vcpus{` + dev + `} 4`,
+		`avm_vm_vcpus{vm="db"} 1`,
+		`avm_vm_memory_configured_bytes{` + dev + `} 2147483648`,
+		`avm_vm_memory_configured_bytes{vm="db"} 1073741824`,
+		`avm_vm_memory_actual_bytes{` + dev + `} 1073741824`,
+		`avm_vm_cpu_seconds_total{` + dev + `} 50`,
+		`avm_vm_resident_memory_bytes{` + dev + `} 1048576`,
+		`avm_vm_io_read_bytes_total{` + dev + `} 4096`,
+		`avm_vm_uptime_seconds{` + dev + `} 600`,
+		`avm_vm_disk_usage_bytes{` + dev + `} 5369757696`,
+		`avm_vm_disk_usage_bytes{vm="db"} 3221225472`,
+		`avm_vm_forwarded_port{` + dev + `,proto="tcp",port="2222",use="ssh"} 1`,
+		`# TYPE avm_vm_cpu_seconds_total counter`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `avm_vm_cpu_seconds_total{vm="db"}`) {
+		t.Error("Expected no process metrics for a stopped VM")
+	}
+	if strings.Index(body, `avm_vm_up{vm="db"}`) > strings.Index(body, `avm_vm_up{`+dev) {
+		t.Error("Expected VMs in name order")
+	}
+}
+
+func TestValidateVMLabels(t *testing.T) {
+	for name, ok := range map[string]bool{"team": true, "env_2": true, "2env": false, "my-team": false, "vm": false, "__meta": false} {
+		vm := VMConfig{Name: "dev", RAM: "512", CPU: "1", SSHPort: "2222", Image: "a.qcow2", Labels: map[string]string{name: "x"}}
+		if err := validateVM(vm); (err == nil) != ok {
+			t.Errorf("Label %q: got %v, want ok=%v", name, err, ok)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+)
+
+// agentTimeout bounds a whole guest agent exchange. The socket accepts
+// even when no agent runs in the guest, so only this tells the two apart.
+const agentTimeout = 2 * time.Second
+
+// agentRetryEvery is how long a VM's guest agent is left alone after it
+// didn't answer. Each miss costs up to agentTimeout, and a VM without an
+// agent would pay it on every sample or refresh.
+const agentRetryEvery = 10 * time.Minute
+
+// agentSocketPath is the per-VM unix socket QEMU serves the guest agent's
+// virtio-serial channel on.
+func agentSocketPath(vm VMConfig) string {
+	return runtimeSocketPath(vm, "qga")
+}
+
+// collectGuestMetrics asks the guest agent for load, memory, uptime and
+// filesystem usage.
+func collectGuestMetrics(vm VMConfig) (GuestMetrics, error) {
+	client, err := qmp.DialGuestAgent(agentSocketPath(vm), agentTimeout)
+	if err != nil {
+		return GuestMetrics{}, fmt.Errorf("guest agent channel unavailable for VM '%s': %v", vm.Name, err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), agentTimeout)
+	defer cancel()
+	if err := client.GuestPing(ctx); err != nil {
+		return GuestMetrics{}, fmt.Errorf("no guest agent answering in VM '%s' (is qemu-guest-agent installed and running?): %v", vm.Name, err)
+	}
+	return readGuestMetrics(ctx, client)
+}
+
+// readGuestMetrics reads the guest's /proc files and filesystem list over
+// an agent session.
+func readGuestMetrics(ctx context.Context, client *qmp.Client) (GuestMetrics, error) {
+	g := GuestMetrics{CollectedAt: time.Now()}
+
+	data, err := client.GuestReadFile(ctx, "/proc/loadavg")
+	if err == nil {
+		g.Load1, g.Load5, g.Load15, err = parseLoadavg(string(data))
+	}
+	if err != nil {
+		return g, fmt.Errorf("failed to read guest load: %v", err)
+	}
+
+	data, err = client.GuestReadFile(ctx, "/proc/meminfo")
+	if err == nil {
+		g.MemTotal, g.MemAvailable, err = parseGuestMeminfo(string(data))
+	}
+	if err != nil {
+		return g, fmt.Errorf("failed to read guest memory: %v", err)
+	}
+
+	data, err = client.GuestReadFile(ctx, "/proc/uptime")
+	if err == nil {
+		g.Uptime, err = parseGuestUptime(string(data))
+	}
+	if err != nil {
+		return g, fmt.Errorf("failed to read guest uptime: %v", err)
+	}
+
+	filesystems, err := client.GuestGetFsinfo(ctx)
+	if err != nil {
+		return g, fmt.Errorf("failed to read guest filesystems: %v", err)
+	}
+	for _, fs := range filesystems {
+		if fs.UsedBytes == nil || fs.TotalBytes == nil {
+			continue
+		}
+		if g.Filesystems == nil {
+			g.Filesystems = map[string]GuestFSUsage{}
+		}
+		g.Filesystems[fs.Mountpoint] = GuestFSUsage{Device: fs.Name, Type: fs.Type, Used: *fs.UsedBytes, Total: *fs.TotalBytes}
+	}
+	return g, nil
+}
+
+// parseLoadavg parses the guest's /proc/loadavg.
+func parseLoadavg(s string) (load1, load5, load15 float64, err error) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return 0, 0, 0, fmt.Errorf("malformed loadavg %q", s)
+	}
+	var loads [3]float64
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("malformed loadavg %q", s)
+		}
+	}
+	return loads[0], loads[1], loads[2], nil
+}
+
+// parseGuestMeminfo returns total and available memory in bytes from the
+// guest's /proc/meminfo. Kernels before 3.14 have no MemAvailable; free
+// memory stands in for it.
+func parseGuestMeminfo(s string) (total, available int64, err error) {
+	values := map[string]int64{}
+	for _, line := range strings.Split(s, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if fields := strings.Fields(value); ok && len(fields) > 0 {
+			if kb, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				values[key] = kb * 1024
+			}
+		}
+	}
+	total, ok := values["MemTotal"]
+	if !ok {
+		return 0, 0, fmt.Errorf("no MemTotal in guest meminfo")
+	}
+	available, ok = values["MemAvailable"]
+	if !ok {
+		available = values["MemFree"]
+	}
+	return total, available, nil
+}
+
+// parseGuestUptime returns whole seconds from the guest's /proc/uptime.
+func parseGuestUptime(s string) (int64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("malformed uptime %q", s)
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed uptime %q", s)
+	}
+	return int64(secs), nil
+}
+
+// diskUsage sums the bytes used on the guest's filesystems.
+func (g GuestMetrics) diskUsage() int64 {
+	var used int64
+	for _, fs := range g.Filesystems {
+		used += fs.Used
+	}
+	return used
+}
+
+// agentBackoff remembers guest agents that didn't answer, so callers that
+// ask repeatedly skip them until agentRetryEvery has passed or the VM
+// runs as a new process.
+type agentBackoff struct {
+	mu   sync.Mutex
+	down map[string]agentMiss
+}
+
+type agentMiss struct {
+	PID int
+	At  time.Time
+}
+
+func newAgentBackoff() *agentBackoff {
+	return &agentBackoff{down: map[string]agentMiss{}}
+}
+
+// collect asks the agent of vm, whose process is pid, through collect
+// unless it missed within agentRetryEvery of now.
+func (b *agentBackoff) collect(vm VMConfig, pid int, now time.Time, collect func(VMConfig) (GuestMetrics, error)) (GuestMetrics, error) {
+	b.mu.Lock()
+	miss, ok := b.down[vm.Name]
+	b.mu.Unlock()
+	if ok && miss.PID == pid && now.Sub(miss.At) < agentRetryEvery {
+		return GuestMetrics{}, fmt.Errorf("no guest agent answered in VM '%s' at %s, next try after %s",
+			vm.Name, miss.At.Format("15:04:05"), miss.At.Add(agentRetryEvery).Format("15:04:05"))
+	}
+
+	g, err := collect(vm)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.down[vm.Name] = agentMiss{PID: pid, At: now}
+	} else {
+		delete(b.down, vm.Name)
+	}
+	return g, err
+}
+
+// displayAgents backs off agents for the status, TUI and monitor views,
+// which refresh every few seconds.
+var displayAgents = newAgentBackoff()
+
+// liveGuestMetrics collects guest metrics of a running VM for display.
+// Nothing is stored: the daemon's sampler keeps the config's copy, see
+// storeGuestMetrics.
+func liveGuestMetrics(vm VMConfig) (GuestMetrics, error) {
+	pid, alive := vmPID(vm)
+	if !alive {
+		return GuestMetrics{}, fmt.Errorf("VM '%s' is not running", vm.Name)
+	}
+	return displayAgents.collect(vm, pid, time.Now(), collectGuestMetrics)
+}
+
+// guestSummary renders load, memory and uptime on one line.
+func guestSummary(g GuestMetrics) string {
+	return fmt.Sprintf("load %.2f %.2f %.2f | %s free of %s | up %s",
+		g.Load1, g.Load5, g.Load15,
+		formatBytes(uint64(g.MemAvailable)), formatBytes(uint64(g.MemTotal)),
+		formatUptime(time.Duration(g.Uptime)*time.Second))
+}
+
+// printGuestMetrics shows a guest's metrics, one line per filesystem after
+// the summary.
+func printGuestMetrics(vmName string, g GuestMetrics) {
+	color.Cyan("🧭 Guest '%s': %s", vmName, guestSummary(g))
+
+	mounts := make([]string, 0, len(g.Filesystems))
+	for mount := range g.Filesystems {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+	for _, mount := range mounts {
+		fs := g.Filesystems[mount]
+		percent := 0.0
+		if fs.Total > 0 {
+			percent = float64(fs.Used) / float64(fs.Total) * 100
+		}
+		color.Cyan("   %-16s %s of %s used (%.0f%%, %s)", mount, formatBytes(uint64(fs.Used)), formatBytes(uint64(fs.Total)), percent, fs.Type)
+	}
+}
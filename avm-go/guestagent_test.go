@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp/qmptest"
+)
+
+// fakeGuestAgent serves a guest agent for vm whose guest has the given
+// files.
+func fakeGuestAgent(t *testing.T, vm VMConfig, files map[string]string) *qmptest.Server {
+	server, err := qmptest.NewGuestAgentServer(agentSocketPath(vm))
+	if err != nil {
+		t.Fatalf("Failed to start fake guest agent: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	var open []string
+	server.Handle("guest-file-open", func(args json.RawMessage) (interface{}, *qmp.Error) {
+		var in struct{ Path string }
+		json.Unmarshal(args, &in)
+		if _, ok := files[in.Path]; !ok {
+			return nil, &qmp.Error{Class: "GenericError", Desc: "failed to open file '" + in.Path + "'"}
+		}
+		open = append(open, in.Path)
+		return len(open) - 1, nil
+	})
+	server.Handle("guest-file-read", func(args json.RawMessage) (interface{}, *qmp.Error) {
+		var in struct{ Handle int }
+		json.Unmarshal(args, &in)
+		content := files[open[in.Handle]]
+		return map[string]interface{}{"count": len(content), "buf-b64": base64.StdEncoding.EncodeToString([]byte(content)), "eof": true}, nil
+	})
+	server.Handle("guest-file-close", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return struct{}{}, nil
+	})
+	server.Handle("guest-get-fsinfo", func(json.RawMessage) (interface{}, *qmp.Error) {
+		used, total := int64(3<<30), int64(8<<30)
+		return []qmp.GuestFilesystem{
+			{Name: "vda3", Mountpoint: "/", Type: "ext4", UsedBytes: &used, TotalBytes: &total},
+			{Name: "tmpfs", Mountpoint: "/run", Type: "tmpfs"},
+		}, nil
+	})
+	return server
+}
+
+func TestCollectGuestMetrics(t *testing.T) {
+	withPaths(t, avmPaths{Run: t.TempDir()})
+	vm := VMConfig{Name: "dev"}
+	fakeGuestAgent(t, vm, map[string]string{
+		"/proc/loadavg": "0.52 0.41 0.30 2/123 4567\n",
+		"/proc/meminfo": "MemTotal:        2039104 kB\nMemFree:          512000 kB\nMemAvailable:    1024000 kB\n",
+		"/proc/uptime":  "7384.21 14000.50\n",
+	})
+
+	g, err := collectGuestMetrics(vm)
+	if err != nil {
+		t.Fatalf("collectGuestMetrics failed: %v", err)
+	}
+	if g.Load1 != 0.52 || g.Load5 != 0.41 || g.Load15 != 0.30 {
+		t.Errorf("Unexpected load: %+v", g)
+	}
+	if g.MemTotal != 2039104*1024 || g.MemAvailable != 1024000*1024 || g.Uptime != 7384 {
+		t.Errorf("Unexpected memory or uptime: %+v", g)
+	}
+	if len(g.Filesystems) != 1 || g.Filesystems["/"].Used != 3<<30 || g.diskUsage() != 3<<30 {
+		t.Errorf("Expected only the root filesystem with its usage, got %+v", g.Filesystems)
+	}
+	if got := guestSummary(g); got != "load 0.52 0.41 0.30 | 1000.0 MiB free of 1.9 GiB | up 2h 3m" {
+		t.Errorf("Unexpected summary %q", got)
+	}
+}
+
+func TestCollectGuestMetricsWithoutAgent(t *testing.T) {
+	withPaths(t, avmPaths{Run: t.TempDir()})
+	_, err := collectGuestMetrics(VMConfig{Name: "dev"})
+	if err == nil || !strings.Contains(err.Error(), "guest agent channel unavailable") {
+		t.Errorf("Expected the missing channel to be reported, got %v", err)
+	}
+
+	vm := VMConfig{Name: "dev"}
+	server := fakeGuestAgent(t, vm, map[string]string{})
+	_, err = collectGuestMetrics(vm)
+	if err == nil || !strings.Contains(err.Error(), "guest load") {
+		t.Errorf("Expected an unreadable loadavg to be reported, got %v", err)
+	}
+	if cmds := server.Commands(); cmds[0] != "guest-ping" {
+		t.Errorf("Expected a guest-ping first, got %v", cmds)
+	}
+}
+
+func TestAgentBackoff(t *testing.T) {
+	b := newAgentBackoff()
+	vm := VMConfig{Name: "dev"}
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	asked := 0
+	missing := func(VMConfig) (GuestMetrics, error) {
+		asked++
+		return GuestMetrics{}, fmt.Errorf("no agent")
+	}
+
+	b.collect(vm, 100, now, missing)
+	if _, err := b.collect(vm, 100, now.Add(time.Minute), missing); err == nil || asked != 1 {
+		t.Errorf("Expected a recent miss to be skipped, asked %d times, got %v", asked, err)
+	}
+	b.collect(vm, 200, now.Add(time.Minute), missing)
+	if asked != 2 {
+		t.Errorf("Expected a restarted VM to be asked again, asked %d times", asked)
+	}
+	b.collect(vm, 200, now.Add(time.Minute+agentRetryEvery), missing)
+	if asked != 3 {
+		t.Errorf("Expected a retry after %v, asked %d times", agentRetryEvery, asked)
+	}
+}
+
+func TestParseGuestMeminfoWithoutMemAvailable(t *testing.T) {
+	total, available, err := parseGuestMeminfo("MemTotal: 1000 kB\nMemFree: 250 kB\n")
+	if err != nil || total != 1000*1024 || available != 250*1024 {
+		t.Errorf("parseGuestMeminfo = %d, %d, %v", total, available, err)
+	}
+	if _, _, err := parseGuestMeminfo("MemFree: 250 kB\n"); err == nil {
+		t.Error("Expected an error without MemTotal")
+	}
+}
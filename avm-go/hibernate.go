@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// Saving or restoring several GB of guest RAM on phone storage is slow.
+	hibernateTimeout = 10 * time.Minute
+	migratePollEvery = 500 * time.Millisecond
+)
+
+// hibernateStatePath is where a VM's saved machine state is written.
+func hibernateStatePath(vmName string) string {
+	return filepath.Join(paths.State, vmName+".vmstate")
+}
+
+// checkHibernatedSize refuses a config change that resizes a hibernated
+// VM's machine, since its saved state could not be restored into it.
+func checkHibernatedSize(before, after Config) error {
+	names := make([]string, 0, len(after.VMs))
+	for name := range after.VMs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if before.VMs[name].SavedState == "" || after.VMs[name].SavedState == "" {
+			continue
+		}
+		old, next := before.displayVM(name), after.displayVM(name)
+		oldMB, _ := old.RAM.MB()
+		nextMB, _ := next.RAM.MB()
+		oldRAM, oldSMP := machineSize(old)
+		newRAM, newSMP := machineSize(next)
+		// The balloon target is part of the saved state too.
+		if oldMB != nextMB || oldRAM != newRAM || oldSMP != newSMP {
+			return fmt.Errorf("VM '%s' is hibernated with -m %s -smp %s; start it, or start it with --discard-state, before changing its memory or CPUs", name, oldRAM, oldSMP)
+		}
+	}
+	return nil
+}
+
+// pauseVM freezes a running VM's vCPUs in memory.
+func pauseVM(c *cli.Context) error {
+	return setVMRunState(c, StateRunning, StatePausing, StatePaused, func(ctx context.Context, client *qmp.Client) error {
+		return client.Stop(ctx)
+	})
+}
+
+// resumeVM thaws a VM paused with pauseVM.
+func resumeVM(c *cli.Context) error {
+	return setVMRunState(c, StatePaused, StatePaused, StateRunning, func(ctx context.Context, client *qmp.Client) error {
+		return client.Cont(ctx)
+	})
+}
+
+// setVMRunState drives a pause or resume: it checks the VM is in from,
+// records via, runs the QMP action and records to.
+func setVMRunState(c *cli.Context, from, via, to VMState, action func(ctx context.Context, client *qmp.Client) error) error {
+	vmName := c.String("vm")
+	configPath := configPathFlag(c)
+
+	config, err := loadReconciledConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	vm, exists := config.VMs[vmName]
+	if !exists {
+		return fmt.Errorf("VM '%s' not found", vmName)
+	}
+	reconcileRunState(&vm)
+	if vm.Status == to {
+		color.Yellow("⚠️  VM '%s' is already %s", vmName, to)
+		return nil
+	}
+	if vm.Status != from {
+		return fmt.Errorf("VM '%s' is %s, expected %s", vmName, vm.Status, from)
+	}
+
+	if vm, err = updateVM(configPath, vmName, func(stored *VMConfig) error {
+		stored.Status = vm.Status // as just reported by QEMU
+		return stored.transition(via)
+	}); err != nil {
+		return err
+	}
+
+	if err := withQMP(vm, action); err != nil {
+		// Put the record back the way QEMU actually is.
+		updateVM(configPath, vmName, func(vm *VMConfig) error {
+			vm.Status = from
+			reconcileRunState(vm)
+			return nil
+		})
+		return fmt.Errorf("failed to change VM '%s' to %s: %v", vmName, to, err)
+	}
+
+	if _, err := updateVM(configPath, vmName, func(vm *VMConfig) error {
+		return vm.transition(to)
+	}); err != nil {
+		return err
+	}
+
+	color.Green("✅ VM '%s' is now %s", vmName, to)
+	log.WithFields(logrus.Fields{"action": string(to), "vm": vmName}).Info("VM run state changed")
+	return nil
+}
+
+// hibernateVM is the `avm-go hibernate` action. The daemon saves the VM's
+// full machine state and powers it off; the next start restores it.
+func hibernateVM(c *cli.Context) error {
+	vmName := c.String("vm")
+	configPath := configPathFlag(c)
+
+	config, err := loadReconciledConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	vm, exists := config.VMs[vmName]
+	if !exists {
+		return fmt.Errorf("VM '%s' not found", vmName)
+	}
+	if vm.Status != StateRunning && vm.Status != StatePaused {
+		return fmt.Errorf("VM '%s' is %s, only running or paused VMs can be hibernated", vmName, vm.Status)
+	}
+
+	color.Cyan("💤 Saving state of VM '%s' to disk...", vmName)
+	if _, err := callDaemon(configPath, daemonRequest{Action: "hibernate", VM: vmName}); err != nil {
+		return fmt.Errorf("failed to hibernate VM '%s': %v", vmName, err)
+	}
+
+	color.Green("✅ VM '%s' hibernated. 'avm-go start --vm %s' restores it", vmName, vmName)
+	return nil
+}
+
+// saveMachineState pauses the guest and streams its machine state into
+// path. The VM is left paused; the caller decides whether to quit QEMU.
+func saveMachineState(client *qmp.Client, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hibernateTimeout)
+	defer cancel()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := client.Stop(ctx); err != nil {
+		return err
+	}
+	if err := client.Migrate(ctx, "exec:cat > "+shellQuote(path)); err != nil {
+		return err
+	}
+
+	for {
+		info, err := client.QueryMigrate(ctx)
+		if err != nil {
+			return err
+		}
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("state save %s: %s", info.Status, info.ErrorDesc)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migratePollEvery):
+		}
+	}
+}
+
+// finishRestore waits for QEMU to load a hibernated VM's state and resumes
+// its vCPUs. done is closed if the QEMU process exits meanwhile.
+func finishRestore(vm VMConfig, done <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hibernateTimeout)
+	defer cancel()
+
+	client, err := dialQMPWhenReady(ctx, vm, done)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		status, err := client.QueryStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Status != "inmigrate" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return fmt.Errorf("QEMU exited while loading saved state")
+		case <-time.After(migratePollEvery):
+		}
+	}
+
+	return client.Cont(ctx)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp/qmptest"
+)
+
+func TestSaveMachineState(t *testing.T) {
+	dir := t.TempDir()
+	server, err := qmptest.NewServer(filepath.Join(dir, "qmp.sock"))
+	if err != nil {
+		t.Fatalf("Failed to start fake QMP server: %v", err)
+	}
+	defer server.Close()
+
+	var uri string
+	polls := 0
+	server.Handle("stop", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return struct{}{}, nil
+	})
+	server.Handle("migrate", func(args json.RawMessage) (interface{}, *qmp.Error) {
+		var in struct{ URI string }
+		json.Unmarshal(args, &in)
+		uri = in.URI
+		return struct{}{}, nil
+	})
+	server.Handle("query-migrate", func(json.RawMessage) (interface{}, *qmp.Error) {
+		polls++
+		if polls < 2 {
+			return qmp.MigrationInfo{Status: "active"}, nil
+		}
+		return qmp.MigrationInfo{Status: "completed"}, nil
+	})
+
+	client, err := qmp.Dial(server.Path, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	statePath := filepath.Join(dir, "it's", "vm1.vmstate")
+	if err := saveMachineState(client, statePath); err != nil {
+		t.Fatalf("saveMachineState failed: %v", err)
+	}
+
+	commands := strings.Join(server.Commands(), ",")
+	if !strings.HasPrefix(commands, "qmp_capabilities,stop,migrate,query-migrate") {
+		t.Errorf("Unexpected command sequence: %s", commands)
+	}
+	if uri != "exec:cat > "+shellQuote(statePath) || !strings.Contains(uri, `'"'"'`) {
+		t.Errorf("Expected migration to a quoted %s, got %q", statePath, uri)
+	}
+}
+
+func TestSaveMachineStateFailure(t *testing.T) {
+	server, err := qmptest.NewServer(filepath.Join(t.TempDir(), "qmp.sock"))
+	if err != nil {
+		t.Fatalf("Failed to start fake QMP server: %v", err)
+	}
+	defer server.Close()
+
+	ok := func(json.RawMessage) (interface{}, *qmp.Error) { return struct{}{}, nil }
+	server.Handle("stop", ok)
+	server.Handle("migrate", ok)
+	server.Handle("query-migrate", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return qmp.MigrationInfo{Status: "failed", ErrorDesc: "disk full"}, nil
+	})
+
+	client, err := qmp.Dial(server.Path, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	err = saveMachineState(client, filepath.Join(t.TempDir(), "vm.vmstate"))
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Expected migration failure to be reported, got %v", err)
+	}
+}
+
+func TestHibernatedVMKeepsItsSize(t *testing.T) {
+	config := Config{VMs: map[string]VMConfig{
+		"dev": {Name: "dev", RAM: "2048", CPU: "2", SSHPort: "2222", Image: "a.qcow2", SavedState: "/state/dev.vmstate"},
+	}}
+
+	if err := setConfigKey(&config, "vms.dev.ram", "4G"); err == nil || !strings.Contains(err.Error(), "hibernated") {
+		t.Errorf("Expected a RAM change on a hibernated VM to be refused, got %v", err)
+	}
+	config.VMs["dev"] = VMConfig{Name: "dev", RAM: "2048", CPU: "2", SSHPort: "2222", Image: "a.qcow2", SavedState: "/state/dev.vmstate"}
+	if err := setConfigKey(&config, "defaults.cpu", "4"); err != nil {
+		t.Errorf("Expected a default the VM overrides to be allowed, got %v", err)
+	}
+	if err := setConfigKey(&config, "vms.dev.ram", "2G"); err != nil {
+		t.Errorf("Expected the same size spelled differently to be allowed, got %v", err)
+	}
+	for key, value := range map[string]string{"vms.dev.cpu": "3", "vms.dev.resources.max_ram": "8192"} {
+		if err := setConfigKey(&config, key, value); err == nil {
+			t.Errorf("Expected %s = %s on a hibernated VM to be refused", key, value)
+		}
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,11 +23,9 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/fatih/color"
-	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/websocket"
 	"github.com/olekukonko/tablewriter"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/tdewolff/minify"
 	"github.com/urfave/cli/v2"
@@ -31,7 +33,7 @@ import (
 )
 
 var log = logrus.New()
-var validate = validator.New()
+var validate = newValidator()
 
 type AVM struct {
 	config     Config
@@ -40,38 +42,85 @@ type AVM struct {
 }
 
 type Config struct {
-	DefaultVM string               `json:"default_vm"`
-	VMs       map[string]VMConfig  `json:"vms" validate:"required"`
-	LogFile   string               `json:"log_file"`
+	SchemaVersion    int                 `json:"schema_version"` // see migrate.go
+	DefaultVM        string              `json:"default_vm"`
+	VMs              map[string]VMConfig `json:"vms" validate:"required,dive"`
+	Defaults         map[string]string   `json:"defaults,omitempty"`                                  // setting defaults for every VM, see settings.go
+	PortRange        string              `json:"port_range,omitempty" validate:"omitempty,portrange"` // see ports.go
+	MemOvercommit    string              `json:"mem_overcommit,omitempty" validate:"omitempty,ratio"` // see capacity.go
+	CPUOvercommit    string              `json:"cpu_overcommit,omitempty" validate:"omitempty,ratio"`
+	HostReserve      MemSize             `json:"host_reserve,omitempty" validate:"omitempty,memsize"`
+	MetricsInterval  string              `json:"metrics_interval,omitempty" validate:"omitempty,span"` // see metricstore.go
+	MetricsRetention string              `json:"metrics_retention,omitempty" validate:"omitempty,span"`
+	LogFile          string              `json:"log_file"`
+	Revision         int64               `json:"revision"` // bumped on every save, see configfile.go
 }
 
 type VMConfig struct {
-	Name      string `json:"name" validate:"required"`
-	RAM       string `json:"ram" validate:"required"`
-	CPU       string `json:"cpu" validate:"required"`
-	SSHPort   string `json:"ssh_port" validate:"required"`
-	VNCPort   string `json:"vnc_port"`
-	Image     string `json:"image" validate:"required"`
-	Status    string `json:"status"` // running, stopped, suspended
-	PIDFile   string `json:"pid_file"`
-	LogFile   string `json:"log_file"`
-	Created   time.Time `json:"created"`
-	Resources VMResources `json:"resources"`
+	Name          string            `json:"name" validate:"required"`
+	RAM           MemSize           `json:"ram" validate:"omitempty,memsize"` // empty settings resolve from defaults, see settings.go
+	CPU           string            `json:"cpu" validate:"omitempty,cpus"`
+	SSHPort       Port              `json:"ssh_port" validate:"omitempty,port"`
+	VNCPort       Port              `json:"vnc_port" validate:"omitempty,port"`
+	Image         string            `json:"image"`
+	Status        VMState           `json:"status"`   // see state.go for the lifecycle
+	PIDFile       string            `json:"pid_file"` // empty: resolved by vmPIDFile
+	LogFile       string            `json:"log_file"` // empty: resolved by vmLogPath
+	Created       time.Time         `json:"created"`
+	Resources     VMResources       `json:"resources"`
+	RestartPolicy RestartPolicy     `json:"restart_policy" validate:"omitempty,oneof=never on-failure always"`
+	LastExitCode  int               `json:"last_exit_code"`
+	LastExitAt    time.Time         `json:"last_exit_at"`
+	Restarts      int               `json:"restarts"`
+	SavedState    string            `json:"saved_state,omitempty"`                                             // hibernation image restored on next start
+	Accel         string            `json:"accel,omitempty"`                                                   // auto, kvm, tcg
+	Arch          string            `json:"arch,omitempty"`                                                    // x86_64, aarch64, riscv64
+	Firmware      string            `json:"firmware,omitempty"`                                                // bios, uefi
+	Autostart     *bool             `json:"autostart,omitempty"`                                               // started by `avm-go up`; nil resolves from defaults
+	DependsOn     []string          `json:"depends_on,omitempty"`                                              // VMs that must be up first
+	Forwards      []string          `json:"forwards,omitempty" validate:"omitempty,dive,forward"`              // extra [tcp:|udp:]host:guest forwards
+	Labels        map[string]string `json:"labels,omitempty" validate:"omitempty,dive,keys,labelname,endkeys"` // exported as Prometheus labels
 }
 
 type VMResources struct {
-	CurrentRAM int `json:"current_ram"`
-	CurrentCPU int `json:"current_cpu"`
-	MaxRAM     int `json:"max_ram"`
-	MaxCPU     int `json:"max_cpu"`
-	DiskUsage  int64 `json:"disk_usage"`
+	CurrentRAM int   `json:"current_ram"`
+	CurrentCPU int   `json:"current_cpu"`
+	MaxRAM     *int  `json:"max_ram,omitempty"` // nil resolves from defaults, 0 is no limit
+	MaxCPU     *int  `json:"max_cpu,omitempty"`
+	DiskUsage  int64 `json:"disk_usage"` // bytes used on the guest's filesystems
+
+	Guest *GuestMetrics `json:"guest,omitempty"` // last guest agent report, see guestagent.go
+}
+
+// GuestMetrics is what the guest agent reported about the guest.
+type GuestMetrics struct {
+	Load1        float64                 `json:"load1"`
+	Load5        float64                 `json:"load5"`
+	Load15       float64                 `json:"load15"`
+	MemTotal     int64                   `json:"mem_total"`             // bytes
+	MemAvailable int64                   `json:"mem_available"`         // bytes
+	Uptime       int64                   `json:"uptime"`                // seconds
+	Filesystems  map[string]GuestFSUsage `json:"filesystems,omitempty"` // by mount point
+	CollectedAt  time.Time               `json:"collected_at"`
+}
+
+// GuestFSUsage is one mounted filesystem in the guest.
+type GuestFSUsage struct {
+	Device string `json:"device"`
+	Type   string `json:"type"`
+	Used   int64  `json:"used"`  // bytes
+	Total  int64  `json:"total"` // bytes
 }
 
 type VMStatus struct {
-	IsRunning bool    `json:"is_running"`
-	CPUUsage  float64 `json:"cpu_usage"`
-	MemUsage  float64 `json:"mem_usage"`
-	Uptime    string  `json:"uptime"`
+	IsRunning  bool    `json:"is_running"`
+	CPUUsage   float64 `json:"cpu_usage"` // percent of one host CPU
+	MemUsage   float64 `json:"mem_usage"` // resident MB
+	ReadBytes  uint64  `json:"read_bytes"`
+	WriteBytes uint64  `json:"write_bytes"`
+	Uptime     string  `json:"uptime"`
+
+	Guest *GuestMetrics `json:"guest,omitempty"` // nil without a guest agent
 }
 
 type AIResponse struct {
@@ -94,7 +143,7 @@ func main() {
 				Name:   "start",
 				Usage:  "Start the Alpine VM",
 				Action: startVM,
-				Flags: []cli.Flag{
+				Flags: append(settingFlags(),
 					&cli.BoolFlag{
 						Name:  "headless",
 						Usage: "Start VM without display",
@@ -104,12 +153,29 @@ func main() {
 						Usage: "VM name to start",
 						Value: "default",
 					},
+					&cli.BoolFlag{
+						Name:  "discard-state",
+						Usage: "Boot fresh instead of restoring a hibernated VM",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Start even if the host lacks the memory or CPUs for the VM",
+					},
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "Wait until the guest answers on its SSH port",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long --wait waits for the guest to boot",
+						Value: defaultReadyTimeout,
+					},
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "Path to config file",
-						Value: "~/.avm/config.json",
+						Value: paths.Config,
 					},
-				},
+				),
 			},
 			{
 				Name:   "stop",
@@ -121,13 +187,40 @@ func main() {
 						Usage: "VM name to stop",
 						Value: "default",
 					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Kill the VM immediately instead of powering it down",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "Time to wait for the guest to power off before sending signals",
+						Value: defaultShutdownTimeout,
+					},
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "Path to config file",
-						Value: "~/.avm/config.json",
+						Value: paths.Config,
 					},
 				},
 			},
+			{
+				Name:   "pause",
+				Usage:  "Freeze a running VM's vCPUs in memory",
+				Action: pauseVM,
+				Flags:  vmCommandFlags("VM name to pause"),
+			},
+			{
+				Name:   "resume",
+				Usage:  "Resume a paused VM",
+				Action: resumeVM,
+				Flags:  vmCommandFlags("VM name to resume"),
+			},
+			{
+				Name:   "hibernate",
+				Usage:  "Save the VM's full state to disk and power it off; start restores it",
+				Action: hibernateVM,
+				Flags:  vmCommandFlags("VM name to hibernate"),
+			},
 			{
 				Name:   "status",
 				Usage:  "Check VM status with detailed metrics",
@@ -140,7 +233,7 @@ func main() {
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "Path to config file",
-						Value: "~/.avm/config.json",
+						Value: paths.Config,
 					},
 				},
 			},
@@ -157,7 +250,125 @@ func main() {
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "Path to config file",
-						Value: "~/.avm/config.json",
+						Value: paths.Config,
+					},
+				},
+			},
+			{
+				Name:      "up",
+				Usage:     "Start autostart VMs (or the named VMs) in dependency order",
+				ArgsUsage: "[vm...]",
+				Action:    upVMs,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "headless",
+						Usage: "Start VMs without display",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Start VMs even if the host lacks the memory or CPUs for them",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long to wait for each dependency to boot",
+						Value: defaultReadyTimeout,
+					},
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file",
+						Value: paths.Config,
+					},
+				},
+			},
+			{
+				Name:      "down",
+				Usage:     "Stop all running VMs (or the named VMs and their dependents), dependents first",
+				ArgsUsage: "[vm...]",
+				Action:    downVMs,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "Time to wait for each guest to power off before sending signals",
+						Value: defaultShutdownTimeout,
+					},
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file",
+						Value: paths.Config,
+					},
+				},
+			},
+			{
+				Name:   "apply",
+				Usage:  "Make the VMs match a spec file, showing the plan first",
+				Action: applySpec,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "Spec file (YAML, TOML, HCL or JSON) with a vms block and optional defaults",
+					},
+					&cli.BoolFlag{
+						Name:  "prune",
+						Usage: "Delete VMs that are not in the spec",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show the plan without applying it",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Apply without asking for confirmation",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "Time to wait for each guest to power off when it must be restarted",
+						Value: defaultShutdownTimeout,
+					},
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file",
+						Value: paths.Config,
+					},
+				},
+			},
+			{
+				Name:   "console",
+				Usage:  "Attach to a VM's serial console",
+				Action: attachConsole,
+				Flags: append(vmCommandFlags("VM name to attach to"), &cli.StringFlag{
+					Name:  "detach-key",
+					Usage: "Key that detaches from the console",
+					Value: defaultDetachKey,
+				}),
+			},
+			{
+				Name:   "daemon",
+				Usage:  "Run the supervisor that owns and restarts VM processes",
+				Action: runDaemon,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file",
+						Value: paths.Config,
+					},
+				},
+			},
+			{
+				Name:   "exporter",
+				Usage:  "Serve per-VM metrics for Prometheus",
+				Action: runExporter,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to serve /metrics on",
+						Value: defaultExporterListen,
+					},
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "Path to config file",
+						Value: paths.Config,
 					},
 				},
 			},
@@ -186,11 +397,46 @@ func main() {
 				Name:   "monitor",
 				Usage:  "Real-time VM performance monitoring",
 				Action: monitorVM,
-				Flags: []cli.Flag{
+				Flags: append(vmCommandFlags("VM name to monitor"),
 					&cli.BoolFlag{
 						Name:  "continuous",
 						Usage: "Continuous monitoring mode",
 					},
+				),
+			},
+			{
+				Name:  "metrics",
+				Usage: "Query the metrics history the daemon records",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "query",
+						Usage:  "Print one metric of a VM over time",
+						Action: queryMetrics,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "vm",
+								Usage: "VM name",
+							},
+							&cli.StringFlag{
+								Name:  "metric",
+								Usage: "cpu, mem, io_read, io_write, load, guest_mem_free or disk",
+								Value: "cpu",
+							},
+							&cli.StringFlag{
+								Name:  "since",
+								Usage: "Start of the range, as a span back from now (24h, 7d) or an RFC 3339 time",
+								Value: "24h",
+							},
+							&cli.StringFlag{
+								Name:  "until",
+								Usage: "End of the range, like --since (default: now)",
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "Print JSON instead of a table",
+							},
+						},
+					},
 				},
 			},
 			{
@@ -239,13 +485,37 @@ func main() {
 							},
 							&cli.StringFlag{
 								Name:  "ssh-port",
-								Usage: "SSH port",
-								Value: "2222",
+								Usage: "SSH port (default: the first free port in port_range)",
+							},
+							&cli.StringFlag{
+								Name:  "vnc-port",
+								Usage: "VNC port, or 'auto' to pick a free one",
+							},
+							&cli.StringSliceFlag{
+								Name:  "forward",
+								Usage: "Extra port forward [tcp:|udp:]host:guest (repeatable)",
 							},
 							&cli.StringFlag{
 								Name:  "image",
-								Usage: "VM image path",
-								Value: "~/alpine-vm.qcow2",
+								Usage: "VM image path; relative paths are under the images directory",
+								Value: "alpine-vm.qcow2",
+							},
+							&cli.StringFlag{
+								Name:  "arch",
+								Usage: "Guest architecture (x86_64, aarch64, riscv64)",
+								Value: ArchX86_64,
+							},
+							&cli.StringFlag{
+								Name:  "firmware",
+								Usage: "Firmware (bios, uefi); defaults per architecture",
+							},
+							&cli.BoolFlag{
+								Name:  "autostart",
+								Usage: "Start this VM with 'avm-go up'",
+							},
+							&cli.StringSliceFlag{
+								Name:  "depends-on",
+								Usage: "VM that must be up before this one (repeatable)",
 							},
 						},
 					},
@@ -260,6 +530,30 @@ func main() {
 							},
 						},
 					},
+					{
+						Name:   "events",
+						Usage:  "List crash records for a VM",
+						Action: listVMEvents,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "name",
+								Usage: "VM name",
+							},
+							&cli.BoolFlag{
+								Name:  "verbose",
+								Usage: "Show QEMU stderr, console output and argv of the latest crash",
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "Output in JSON format",
+							},
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
 					{
 						Name:   "switch",
 						Usage:  "Switch active VM",
@@ -277,7 +571,7 @@ func main() {
 						Subcommands: []*cli.Command{
 							{
 								Name:   "scale",
-								Usage:  "Scale VM resources (RAM/CPU)",
+								Usage:  "Scale VM resources (RAM/CPU), live when the VM is running",
 								Action: scaleVMResources,
 								Flags: []cli.Flag{
 									&cli.StringFlag{
@@ -292,10 +586,14 @@ func main() {
 										Name:  "cpu",
 										Usage: "New CPU cores count",
 									},
+									&cli.BoolFlag{
+										Name:  "force",
+										Usage: "Grow a running VM even if the host lacks the memory or CPUs",
+									},
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -315,7 +613,7 @@ func main() {
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -345,7 +643,7 @@ func main() {
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -361,7 +659,7 @@ func main() {
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -387,7 +685,7 @@ func main() {
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -408,7 +706,7 @@ func main() {
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -424,7 +722,7 @@ func main() {
 									&cli.StringFlag{
 										Name:  "config",
 										Usage: "Path to config file",
-										Value: "~/.avm/config.json",
+										Value: paths.Config,
 									},
 								},
 							},
@@ -441,10 +739,137 @@ func main() {
 						Usage:  "Initialize default configuration",
 						Action: initConfig,
 					},
+					{
+						Name:   "migrate",
+						Usage:  "Upgrade a legacy config (alpine-vm.sh, single-VM JSON) to the current schema",
+						Action: migrateConfig,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "from",
+								Usage: "Config to migrate (default: --config, or " + legacyShellConfig + " if that doesn't exist)",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "Report the changes without writing anything",
+							},
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
 					{
 						Name:   "validate",
 						Usage:  "Validate configuration file",
 						Action: validateConfig,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
+					{
+						Name:   "export",
+						Usage:  "Print the config as YAML, TOML, HCL or JSON",
+						Action: exportConfig,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Output format: yaml, toml, hcl or json (default: from --output's extension, else json)",
+								Value: formatJSON,
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Write to this file instead of stdout",
+							},
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
+					{
+						Name:      "import",
+						Usage:     "Replace the config with a YAML, TOML, HCL or JSON file, backing up the old one",
+						ArgsUsage: "<file>",
+						Action:    importConfig,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Format of the file (default: from its extension)",
+							},
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
+					{
+						Name:      "get",
+						Usage:     "Print a config value, e.g. vms.dev.ram (VM settings are resolved)",
+						ArgsUsage: "<key.path>",
+						Action:    configGet,
+						Flags: append(settingFlags(), &cli.StringFlag{
+							Name:  "config",
+							Usage: "Path to config file",
+							Value: paths.Config,
+						}),
+					},
+					{
+						Name:      "set",
+						Usage:     "Set a config value, e.g. vms.dev.ram 4G or defaults.cpu 4",
+						ArgsUsage: "<key.path> <value>",
+						Action:    configSet,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
+					{
+						Name:      "unset",
+						Usage:     "Remove a config value so it falls back to the defaults",
+						ArgsUsage: "<key.path>",
+						Action:    configUnset,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						},
+					},
+					{
+						Name:   "show",
+						Usage:  "Print the config, or with --resolved each VM setting and where it came from",
+						Action: showConfig,
+						Flags: append(settingFlags(),
+							&cli.BoolFlag{
+								Name:  "resolved",
+								Usage: "Show resolved VM settings and their sources",
+							},
+							&cli.StringFlag{
+								Name:  "vm",
+								Usage: "Only show this VM",
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "Output in JSON format",
+							},
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to config file",
+								Value: paths.Config,
+							},
+						),
 					},
 				},
 			},
@@ -456,29 +881,20 @@ func main() {
 	}
 }
 
-func loadConfig(configPath string) (Config, error) {
-	viper.SetConfigFile(configPath)
-	viper.SetConfigType("json")
-
-	if err := viper.ReadInConfig(); err != nil {
-		return Config{}, err
-	}
-
-	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
-		return Config{}, err
-	}
-
-	return config, validate.Struct(config)
-}
-
-func saveConfig(configPath string, config Config) error {
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
+// vmCommandFlags are the --vm and --config flags shared by single-VM commands.
+func vmCommandFlags(vmUsage string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "vm",
+			Usage: vmUsage,
+			Value: "default",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Path to config file",
+			Value: paths.Config,
+		},
 	}
-
-	return os.WriteFile(configPath, data, 0644)
 }
 
 func startVM(c *cli.Context) error {
@@ -491,8 +907,8 @@ func startVM(c *cli.Context) error {
 	s.Suffix = fmt.Sprintf(" Starting VM '%s'...", vmName)
 	s.Start()
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		s.Stop()
 		return fmt.Errorf("failed to load config: %v", err)
@@ -504,47 +920,68 @@ func startVM(c *cli.Context) error {
 		return fmt.Errorf("VM '%s' not found in config", vmName)
 	}
 
-	if vmConfig.Status == "running" {
+	if vmConfig.Status.Active() {
 		s.Stop()
-		return fmt.Errorf("VM '%s' is already running", vmName)
+		return fmt.Errorf("VM '%s' is already %s", vmName, vmConfig.Status)
 	}
 
-	cmd := exec.Command("proot-distro", "login", "alpine", "--termux-home", "--", "bash", "-c",
-		fmt.Sprintf("qemu-system-x86_64 -m %s -smp %s -hda %s -nographic -enable-kvm -cpu host -net nic,model=virtio -net user,hostfwd=tcp::%s-:22 -device virtio-rng-pci",
-			vmConfig.RAM, vmConfig.CPU, vmConfig.Image, vmConfig.SSHPort))
-
-	if c.Bool("headless") {
-		cmd.Args = append(cmd.Args, "-display", "none")
+	if vmConfig.SavedState != "" {
+		if c.Bool("discard-state") {
+			os.Remove(vmConfig.SavedState)
+			vmConfig.SavedState = ""
+			config.VMs[vmName] = vmConfig
+			if err := saveConfig(configPath, &config); err != nil {
+				s.Stop()
+				return fmt.Errorf("failed to save config: %v", err)
+			}
+		} else {
+			s.Suffix = fmt.Sprintf(" Restoring VM '%s' from hibernation...", vmName)
+		}
 	}
 
-	err = cmd.Start()
+	overrides := contextOverrides(c)
+	vmConfig, _, err = resolveVM(config.Defaults, vmConfig, overrides)
+	if err == nil {
+		err = validateVM(vmConfig)
+	}
 	if err != nil {
 		s.Stop()
-		return fmt.Errorf("failed to start VM '%s': %v", vmName, err)
+		return fmt.Errorf("VM '%s' has invalid settings: %v", vmName, err)
 	}
 
-	// Update VM status
-	vmConfig.Status = "running"
-	config.VMs[vmName] = vmConfig
-
-	err = os.WriteFile(vmConfig.PIDFile, []byte(fmt.Sprintf("%d", cmd.Process.Pid)), 0644)
+	resp, err := callDaemon(configPath, daemonRequest{
+		Action:    "start",
+		VM:        vmName,
+		Headless:  c.Bool("headless"),
+		Force:     c.Bool("force"),
+		Overrides: overrides,
+	})
 	if err != nil {
-		log.Warnf("Failed to save PID file for VM '%s': %v", vmName, err)
+		s.Stop()
+		return fmt.Errorf("failed to start VM '%s': %v", vmName, err)
 	}
 
-	// Save updated config
-	if err := saveConfig(configPath, config); err != nil {
-		log.Warnf("Failed to save config: %v", err)
+	if !c.Bool("wait") {
+		s.Stop()
+		color.Green("✅ VM '%s' started successfully (PID: %d)!", vmName, resp.PID)
+		return nil
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+	alive := func() bool { return processAlive(resp.PID) }
+	err = waitReady(ctx, readinessPhases(vmConfig), alive, func(phase string) {
+		s.Suffix = fmt.Sprintf(" %s...", phase)
+	})
 	s.Stop()
-	color.Green("✅ VM '%s' started successfully (PID: %d)!", vmName, cmd.Process.Pid)
-	log.WithFields(logrus.Fields{
-		"action": "start",
-		"vm":     vmName,
-		"pid":    cmd.Process.Pid,
-	}).Info("VM started")
+	if errors.Is(err, errNotReady) {
+		return cli.Exit(fmt.Sprintf("VM '%s' started (PID: %d) but %v after %s", vmName, resp.PID, err, c.Duration("timeout")), exitStartTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("VM '%s' failed to boot: %v", vmName, err)
+	}
 
+	color.Green("✅ VM '%s' is up and accepting SSH on port %s (PID: %d)", vmName, vmConfig.SSHPort, resp.PID)
 	return nil
 }
 
@@ -554,8 +991,8 @@ func stopVM(c *cli.Context) error {
 		vmName = "default"
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -565,52 +1002,47 @@ func stopVM(c *cli.Context) error {
 		return fmt.Errorf("VM '%s' not found", vmName)
 	}
 
-	if vm.Status != "running" {
-		color.Yellow("⚠️  VM '%s' is not running", vmName)
+	if !vm.Status.Active() {
+		color.Yellow("⚠️  VM '%s' is not running (%s)", vmName, vm.Status)
 		return nil
 	}
 
-	pidFile := vm.PIDFile
-	if pidFile == "" {
-		pidFile = fmt.Sprintf("/tmp/avm-%s.pid", vmName)
-	}
-
-	pidData, err := os.ReadFile(pidFile)
-	if err != nil {
-		return fmt.Errorf("failed to read PID file for VM '%s': %v", vmName, err)
+	if !c.Bool("force") {
+		color.Cyan("⏻  Powering down VM '%s' (timeout %s)...", vmName, c.Duration("timeout"))
 	}
 
-	pid := strings.TrimSpace(string(pidData))
-	cmd := exec.Command("kill", pid)
-	err = cmd.Run()
+	_, err = callDaemon(configPath, daemonRequest{
+		Action:  "stop",
+		VM:      vmName,
+		Force:   c.Bool("force"),
+		Timeout: c.Duration("timeout"),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to stop VM '%s': %v", vmName, err)
 	}
 
-	os.Remove(pidFile)
-	
-	// Update VM status
-	vm.Status = "stopped"
-	config.VMs[vmName] = vm
-	err = saveConfig(configPath, config)
-	if err != nil {
-		log.Warn("Failed to update config after stopping VM: %v", err)
-	}
-
 	color.Green("✅ VM '%s' stopped successfully", vmName)
-	log.Info("VM '%s' stopped", vmName)
 
 	return nil
 }
 
 func statusVM(c *cli.Context) error {
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
 	if c.Bool("json") {
+		for name, vm := range config.VMs {
+			if vm.Status != StateRunning {
+				continue
+			}
+			if g, err := liveGuestMetrics(vm); err == nil {
+				vm.Resources.Guest, vm.Resources.DiskUsage = &g, g.diskUsage()
+				config.VMs[name] = vm
+			}
+		}
 		jsonData, _ := json.MarshalIndent(config, "", "  ")
 		fmt.Println(string(jsonData))
 		return nil
@@ -620,38 +1052,58 @@ func statusVM(c *cli.Context) error {
 	color.Cyan("=====================")
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"VM Name", "Status", "RAM", "CPU", "SSH Port", "PID"})
+	table.SetHeader([]string{"VM Name", "Status", "RAM", "CPU", "SSH Port", "PID", "CPU %", "RSS", "Uptime"})
 
 	for name, vm := range config.VMs {
-		status := vm.Status
-		if status == "" {
-			status = "stopped"
-		}
-
-		statusIcon := "🔴"
-		if status == "running" {
-			statusIcon = "🟢"
+		if reconcileRunState(&vm) {
+			config.VMs[name] = vm
+			if err := saveConfig(configPath, &config); err != nil {
+				log.Warnf("Failed to save config: %v", err)
+			}
 		}
 
-		pid := "N/A"
-		if vm.Status == "running" {
-			if pidData, err := os.ReadFile(vm.PIDFile); err == nil {
-				pid = string(pidData)
+		pid, cpuUsage, rss, uptime := "N/A", "-", "-", "-"
+		if p, alive := vmPID(vm); alive {
+			pid = strconv.Itoa(p)
+			if m, err := statusCollector.Collect(p); err == nil {
+				cpuUsage = fmt.Sprintf("%.1f", m.CPUPercent)
+				rss = formatBytes(m.RSSBytes)
+				uptime = formatUptime(m.Uptime)
 			}
 		}
 
+		settings := config.displayVM(name)
 		table.Append([]string{
 			name,
-			statusIcon + " " + status,
-			vm.RAM + "MB",
-			vm.CPU,
-			vm.SSHPort,
+			stateIcon(vm.Status) + " " + string(vm.Status),
+			settings.RAM.String(),
+			settings.CPU,
+			string(settings.SSHPort),
 			pid,
+			cpuUsage,
+			rss,
+			uptime,
 		})
 	}
 
 	table.Render()
 
+	names := make([]string, 0, len(config.VMs))
+	for name, vm := range config.VMs {
+		if vm.Status == StateRunning {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g, err := liveGuestMetrics(config.VMs[name])
+		if err != nil {
+			color.Yellow("⚠️  %v", err)
+			continue
+		}
+		printGuestMetrics(name, g)
+	}
+
 	// Show default VM
 	color.Cyan("\n🎯 Default VM: %s", config.DefaultVM)
 	return nil
@@ -663,24 +1115,24 @@ func sshVM(c *cli.Context) error {
 		vmName = "default"
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	vm, exists := config.VMs[vmName]
-	if !exists {
-		return fmt.Errorf("VM '%s' not found", vmName)
+	vm, err := config.resolvedVM(vmName)
+	if err != nil {
+		return err
 	}
 
-	if vm.Status != "running" {
-		return fmt.Errorf("VM '%s' is not running", vmName)
+	if vm.Status != StateRunning {
+		return fmt.Errorf("VM '%s' is not running (%s)", vmName, vm.Status)
 	}
 
 	color.Cyan("🔐 Connecting to VM '%s' via SSH on port %s...", vmName, vm.SSHPort)
 
-	cmd := exec.Command("ssh", "-p", vm.SSHPort, "-o", "StrictHostKeyChecking=no", "root@localhost")
+	cmd := exec.Command("ssh", "-p", string(vm.SSHPort), "-o", "StrictHostKeyChecking=no", "root@localhost")
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -795,10 +1247,20 @@ func aiAssist(c *cli.Context) error {
 }
 
 func monitorVM(c *cli.Context) error {
-	color.Cyan("📊 Real-time VM Performance Monitor")
+	vmName := c.String("vm")
+	configPath := configPathFlag(c)
+	color.Cyan("📊 Real-time VM Performance Monitor: %s", vmName)
 
-	if !isRunning() {
-		color.Yellow("⚠️  VM is not running")
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	vm, exists := config.VMs[vmName]
+	if !exists {
+		return fmt.Errorf("VM '%s' not found", vmName)
+	}
+	if _, alive := vmPID(vm); !alive {
+		color.Yellow("⚠️  VM '%s' is not running", vmName)
 		return nil
 	}
 
@@ -810,8 +1272,11 @@ func monitorVM(c *cli.Context) error {
 	for {
 		select {
 		case <-ticker.C:
-			status := getVMStatus()
+			status := getVMStatus(configPath, vmName)
 			fmt.Printf("\r[%s] CPU: %.1f%% | Mem: %.1f MB | Status: ", time.Now().Format("15:04:05"), status.CPUUsage, status.MemUsage)
+			if status.Guest != nil {
+				fmt.Printf("Guest: %s | ", guestSummary(*status.Guest))
+			}
 			if status.IsRunning {
 				color.Green("🟢 RUNNING")
 			} else {
@@ -846,7 +1311,7 @@ func backupVM(c *cli.Context) error {
 	time.Sleep(3 * time.Second) // Simulate backup process
 
 	s.Stop()
-	color.Green("✅ Backup created: alpine-vm-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+	color.Green("✅ Backup created: %s", filepath.Join(paths.Backups, fmt.Sprintf("alpine-vm-backup-%s.tar.gz", time.Now().Format("20060102-150405"))))
 
 	return nil
 }
@@ -863,10 +1328,10 @@ func restoreVM(c *cli.Context) error {
 func initConfig(c *cli.Context) error {
 	color.Cyan("⚙️  Initializing default configuration...")
 
-	configDir := os.Getenv("HOME") + "/.avm"
-	logsDir := configDir + "/logs"
-	os.MkdirAll(configDir, 0755)
-	os.MkdirAll(logsDir, 0755)
+	for _, dir := range []string{filepath.Dir(paths.Config), paths.Images, paths.Logs, paths.Backups} {
+		os.MkdirAll(dir, 0755)
+	}
+	os.MkdirAll(paths.Run, 0700) // sockets and PID files
 
 	// Create default VM
 	defaultVM := VMConfig{
@@ -874,15 +1339,9 @@ func initConfig(c *cli.Context) error {
 		RAM:     "2048",
 		CPU:     "2",
 		SSHPort: "2222",
-		Image:   "~/alpine-vm.qcow2",
-		Status:  "stopped",
-		PIDFile: "/tmp/avm-default.pid",
-		LogFile: logsDir + "/default.log",
+		Image:   "alpine-vm.qcow2",
+		Status:  StateStopped,
 		Created: time.Now(),
-		Resources: VMResources{
-			MaxRAM: 4096,
-			MaxCPU: 4,
-		},
 	}
 
 	defaultConfig := Config{
@@ -890,14 +1349,12 @@ func initConfig(c *cli.Context) error {
 		VMs: map[string]VMConfig{
 			"default": defaultVM,
 		},
-		LogFile: logsDir + "/avm.log",
+		LogFile: filepath.Join(paths.Logs, "avm.log"),
 	}
 
-	configData, _ := json.MarshalIndent(defaultConfig, "", "  ")
-	configPath := configDir + "/config.json"
+	configPath := paths.Config
 
-	err := os.WriteFile(configPath, configData, 0644)
-	if err != nil {
+	if err := replaceConfig(configPath, &defaultConfig); err != nil {
 		return fmt.Errorf("failed to write config: %v", err)
 	}
 
@@ -909,22 +1366,32 @@ func initConfig(c *cli.Context) error {
 func validateConfig(c *cli.Context) error {
 	color.Cyan("🔍 Validating configuration...")
 
-	config, err := loadConfig("~/.avm/config.json")
+	configPath := configPathFlag(c)
+	config, err := loadConfigUnvalidated(configPath)
 	if err != nil {
 		return fmt.Errorf("invalid config: %v", err)
 	}
 
+	violations := configViolations(config)
+	for _, v := range violations {
+		color.Red("❌ %s: %s", v.Path, v.Message)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("configuration has %d problem(s)", len(violations))
+	}
+
 	color.Green("✅ Configuration is valid")
-	fmt.Printf("VM Name: %s\n", config.VMName)
-	fmt.Printf("RAM: %s MB\n", config.VMRAM)
-	fmt.Printf("CPU: %s cores\n", config.VMCPU)
+	for name := range config.VMs {
+		vm := config.displayVM(name)
+		fmt.Printf("VM %s: %s, %s RAM, %s cores\n", name, vmArch(vm), vm.RAM, vm.CPU)
+	}
 
 	return nil
 }
 
 // Helper functions
 func isRunning(vmName string) bool {
-	pidFile := fmt.Sprintf("/tmp/avm-%s.pid", vmName)
+	pidFile := vmPIDFile(VMConfig{Name: vmName})
 	if _, err := os.Stat(pidFile); os.IsNotExist(err) {
 		return false
 	}
@@ -939,18 +1406,39 @@ func isRunning(vmName string) bool {
 	return cmd.Run() == nil
 }
 
-func getVMStatus(vmName string) VMStatus {
-	if !isRunning(vmName) {
+// statusCollector keeps the previous sample of each VM so repeated
+// getVMStatus calls report CPU usage over the interval between them.
+var statusCollector = newMetricsCollector()
+
+func getVMStatus(configPath, vmName string) VMStatus {
+	vm := VMConfig{Name: vmName}
+	if config, err := loadConfig(configPath); err == nil {
+		if stored, ok := config.VMs[vmName]; ok {
+			vm = stored
+		}
+	}
+	pid, alive := vmPID(vm)
+	if !alive {
 		return VMStatus{IsRunning: false}
 	}
 
-	// Simulate getting real metrics
-	return VMStatus{
-		IsRunning: true,
-		CPUUsage:  15.7,
-		MemUsage:  512.3,
-		Uptime:    "2h 34m",
+	m, err := statusCollector.Collect(pid)
+	if err != nil {
+		log.Warnf("Failed to collect metrics for VM '%s': %v", vmName, err)
+		return VMStatus{IsRunning: true}
 	}
+	status := VMStatus{
+		IsRunning:  true,
+		CPUUsage:   m.CPUPercent,
+		MemUsage:   float64(m.RSSBytes) / mib,
+		ReadBytes:  m.ReadBytes,
+		WriteBytes: m.WriteBytes,
+		Uptime:     formatUptime(m.Uptime),
+	}
+	if g, err := liveGuestMetrics(vm); err == nil {
+		status.Guest = &g
+	}
+	return status
 }
 
 // TUI Model
@@ -1009,8 +1497,8 @@ func (m model) View() string {
 
 // VM Management Functions
 func listVMs(c *cli.Context) error {
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1023,17 +1511,13 @@ func listVMs(c *cli.Context) error {
 	table.SetBorder(false)
 
 	for name, vm := range config.VMs {
-		status := vm.Status
-		if status == "" {
-			status = "stopped"
-		}
-
 		created := "N/A"
 		if !vm.Created.IsZero() {
 			created = vm.Created.Format("2006-01-02")
 		}
 
-		table.Append([]string{name, status, vm.RAM + "MB", vm.CPU, vm.SSHPort, created})
+		settings := config.displayVM(name)
+		table.Append([]string{name, string(vm.Status), settings.RAM.String(), settings.CPU, string(settings.SSHPort), created})
 	}
 
 	table.Render()
@@ -1042,9 +1526,9 @@ func listVMs(c *cli.Context) error {
 
 func createVM(c *cli.Context) error {
 	vmName := c.String("name")
-	configPath := c.String("config")
+	configPath := configPathFlag(c)
 
-	config, err := loadConfig(configPath)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		// If config doesn't exist, create default
 		config = Config{
@@ -1057,29 +1541,73 @@ func createVM(c *cli.Context) error {
 		return fmt.Errorf("VM '%s' already exists", vmName)
 	}
 
+	existing := resolvedVMs(config)
+	reserved := map[int]bool{}
+	allocate := func(flag string) (Port, error) {
+		if value := c.String(flag); value != "" && value != "auto" {
+			return Port(value), nil
+		}
+		port, err := allocatePort(config, existing, reserved)
+		reserved[port] = true
+		return Port(strconv.Itoa(port)), err
+	}
+	sshPort, err := allocate("ssh-port")
+	if err != nil {
+		return err
+	}
+	var vncPort Port
+	if c.IsSet("vnc-port") {
+		if vncPort, err = allocate("vnc-port"); err != nil {
+			return err
+		}
+	}
+
 	vmConfig := VMConfig{
-		Name:    vmName,
-		RAM:     c.String("ram"),
-		CPU:     c.String("cpu"),
-		SSHPort: c.String("ssh-port"),
-		Image:   c.String("image"),
-		Status:  "stopped",
-		PIDFile: fmt.Sprintf("/tmp/avm-%s.pid", vmName),
-		LogFile: fmt.Sprintf("~/.avm/logs/%s.log", vmName),
-		Created: time.Now(),
-		Resources: VMResources{
-			MaxRAM: 4096, // Default max
-			MaxCPU: 4,    // Default max
-		},
+		Name:      vmName,
+		RAM:       MemSize(c.String("ram")),
+		CPU:       c.String("cpu"),
+		SSHPort:   sshPort,
+		VNCPort:   vncPort,
+		Forwards:  c.StringSlice("forward"),
+		Image:     c.String("image"),
+		Arch:      c.String("arch"),
+		Firmware:  c.String("firmware"),
+		DependsOn: c.StringSlice("depends-on"),
+		Status:    StateStopped,
+		Created:   time.Now(),
+	}
+	if c.IsSet("autostart") {
+		vmConfig.Autostart = ptrTo(c.Bool("autostart"))
+	}
+
+	if err := validateVM(vmConfig); err != nil {
+		return fmt.Errorf("invalid VM '%s': %v", vmName, err)
+	}
+	if err := validateArch(vmConfig); err != nil {
+		return fmt.Errorf("invalid VM '%s': %v", vmName, err)
 	}
 
+	// Only clashes with the new VM count; `config validate` reports the rest.
+	before := cloneConfig(config)
 	config.VMs[vmName] = vmConfig
+	if violations := newPortClashes(before, config); len(violations) > 0 {
+		return fmt.Errorf("invalid VM '%s': %s", vmName, violations[0].Message)
+	}
+	for _, p := range vmPorts(vmConfig) {
+		if !portFree(p.Proto, p.Port) {
+			color.Yellow("⚠️  %s port %d (%s) is in use on the host right now; the VM won't start until it is free", p.Proto, p.Port, p.Use)
+		}
+	}
+
+	if err := validateDependencies(config.VMs); err != nil {
+		return fmt.Errorf("invalid VM '%s': %v", vmName, err)
+	}
 
-	if err := saveConfig(configPath, config); err != nil {
+	if err := saveConfig(configPath, &config); err != nil {
 		return fmt.Errorf("failed to save config: %v", err)
 	}
 
-	color.Green("✅ VM '%s' created successfully!", vmName)
+	color.Green("✅ VM '%s' created successfully! SSH port: %s", vmName, vmConfig.SSHPort)
 	color.Cyan("💡 Use 'avm-go start --vm %s' to start this VM", vmName)
 
 	return nil
@@ -1091,8 +1619,8 @@ func deleteVM(c *cli.Context) error {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1102,14 +1630,18 @@ func deleteVM(c *cli.Context) error {
 		return fmt.Errorf("VM '%s' not found", vmName)
 	}
 
-	if vmConfig.Status == "running" {
-		return fmt.Errorf("cannot delete running VM '%s'. Stop it first", vmName)
+	if vmConfig.Status.Active() {
+		return fmt.Errorf("cannot delete %s VM '%s'. Stop it first", vmConfig.Status, vmName)
+	}
+
+	if dependents := dependentsOf(config.VMs, vmName); len(dependents) > 0 {
+		return fmt.Errorf("cannot delete VM '%s': %s depend(s) on it", vmName, strings.Join(dependents, ", "))
 	}
 
 	// Remove VM from config
 	delete(config.VMs, vmName)
 
-	if err := saveConfig(configPath, config); err != nil {
+	if err := saveConfig(configPath, &config); err != nil {
 		return fmt.Errorf("failed to save config: %v", err)
 	}
 
@@ -1123,8 +1655,8 @@ func switchVM(c *cli.Context) error {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1135,7 +1667,7 @@ func switchVM(c *cli.Context) error {
 
 	config.DefaultVM = vmName
 
-	if err := saveConfig(configPath, config); err != nil {
+	if err := saveConfig(configPath, &config); err != nil {
 		return fmt.Errorf("failed to save config: %v", err)
 	}
 
@@ -1143,63 +1675,14 @@ func switchVM(c *cli.Context) error {
 	return nil
 }
 
-func scaleVMResources(c *cli.Context) error {
-	vmName := c.String("name")
-	if vmName == "" {
-		return fmt.Errorf("VM name is required")
-	}
-
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to load config: %v", err)
-	}
-
-	vm, exists := config.VMs[vmName]
-	if !exists {
-		return fmt.Errorf("VM '%s' not found", vmName)
-	}
-
-	// Get new resource values
-	newRAM := c.String("ram")
-	newCPU := c.String("cpu")
-
-	if newRAM == "" && newCPU == "" {
-		return fmt.Errorf("at least one resource (ram or cpu) must be specified")
-	}
-
-	// Update RAM if specified
-	if newRAM != "" {
-		vm.RAM = newRAM
-		color.Cyan("📈 Scaling VM '%s' RAM to %s MB", vmName, newRAM)
-	}
-
-	// Update CPU if specified
-	if newCPU != "" {
-		vm.CPU = newCPU
-		color.Cyan("📈 Scaling VM '%s' CPU to %s cores", vmName, newCPU)
-	}
-
-	// Save updated config
-	config.VMs[vmName] = vm
-	if err := saveConfig(configPath, config); err != nil {
-		return fmt.Errorf("failed to save config: %v", err)
-	}
-
-	color.Green("✅ VM '%s' resources updated successfully!", vmName)
-	color.Yellow("⚠️  Restart the VM for changes to take effect")
-
-	return nil
-}
-
 func monitorVMResources(c *cli.Context) error {
 	vmName := c.String("name")
 	if vmName == "" {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1209,26 +1692,27 @@ func monitorVMResources(c *cli.Context) error {
 		return fmt.Errorf("VM '%s' not found", vmName)
 	}
 
-	if vm.Status != "running" {
-		return fmt.Errorf("VM '%s' is not running", vmName)
+	if vm.Status != StateRunning {
+		return fmt.Errorf("VM '%s' is not running (%s)", vmName, vm.Status)
 	}
 
 	color.Cyan("📊 Monitoring resources for VM '%s':", vmName)
 	color.Cyan("=====================================")
 
 	// Get PID to monitor process
-	pidFile := vm.PIDFile
-	if pidFile == "" {
-		pidFile = fmt.Sprintf("/tmp/avm-%s.pid", vmName)
-	}
+	pidFile := vmPIDFile(vm)
 
 	pidData, err := os.ReadFile(pidFile)
 	if err != nil {
 		return fmt.Errorf("failed to read PID file: %v", err)
 	}
 
-	pid := strings.TrimSpace(string(pidData))
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidData)))
+	if err != nil {
+		return fmt.Errorf("invalid PID file %s: %v", pidFile, err)
+	}
 
+	collector := newMetricsCollector()
 	if c.Bool("continuous") {
 		color.Cyan("🔄 Continuous monitoring (Ctrl+C to stop)...")
 		ticker := time.NewTicker(2 * time.Second)
@@ -1237,40 +1721,40 @@ func monitorVMResources(c *cli.Context) error {
 		for {
 			select {
 			case <-ticker.C:
-				displayResourceUsage(pid, vmName)
+				if err := displayResourceUsage(collector, pid); err != nil {
+					return err
+				}
+				displayGuestUsage(vm)
 			}
 		}
-	} else {
-		displayResourceUsage(pid, vmName)
 	}
-
+	if err := displayResourceUsage(collector, pid); err != nil {
+		return err
+	}
+	displayGuestUsage(vm)
 	return nil
 }
 
-func displayResourceUsage(pid, vmName string) {
-	// Get memory usage
-	memCmd := exec.Command("ps", "-o", "rss=", "-p", pid)
-	memOutput, err := memCmd.Output()
-	memUsage := "N/A"
-	if err == nil {
-		memMB := strings.TrimSpace(string(memOutput))
-		if memMB != "" {
-			if memInt, err := strconv.Atoi(memMB); err == nil {
-				memUsage = fmt.Sprintf("%.1f MB", float64(memInt)/1024)
-			}
-		}
+// displayGuestUsage prints what the VM's guest agent reports.
+func displayGuestUsage(vm VMConfig) {
+	g, err := liveGuestMetrics(vm)
+	if err != nil {
+		color.Yellow("⚠️  %v", err)
+		return
 	}
+	printGuestMetrics(vm.Name, g)
+}
 
-	// Get CPU usage
-	cpuCmd := exec.Command("ps", "-o", "pcpu=", "-p", pid)
-	cpuOutput, err := cpuCmd.Output()
-	cpuUsage := "N/A"
-	if err == nil {
-		cpuUsage = strings.TrimSpace(string(cpuOutput)) + "%"
+// displayResourceUsage prints one sample of the VM's process tree.
+func displayResourceUsage(collector *metricsCollector, pid int) error {
+	m, err := collector.Collect(pid)
+	if err != nil {
+		return err
 	}
-
-	color.Cyan("Memory Usage: %s | CPU Usage: %s | Time: %s",
-		memUsage, cpuUsage, time.Now().Format("15:04:05"))
+	color.Cyan("Memory Usage: %s | CPU Usage: %.1f%% | I/O: %s read, %s written | Uptime: %s | Time: %s",
+		formatBytes(m.RSSBytes), m.CPUPercent, formatBytes(m.ReadBytes), formatBytes(m.WriteBytes),
+		formatUptime(m.Uptime), m.Time.Format("15:04:05"))
+	return nil
 }
 
 func isolateVMNetwork(c *cli.Context) error {
@@ -1279,8 +1763,8 @@ func isolateVMNetwork(c *cli.Context) error {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1290,7 +1774,7 @@ func isolateVMNetwork(c *cli.Context) error {
 		return fmt.Errorf("VM '%s' not found", vmName)
 	}
 
-	if vm.Status != "running" {
+	if vm.Status != StateRunning {
 		return fmt.Errorf("VM '%s' must be running to configure network isolation", vmName)
 	}
 
@@ -1336,8 +1820,8 @@ func networkIsolationStatus(c *cli.Context) error {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1351,7 +1835,7 @@ func networkIsolationStatus(c *cli.Context) error {
 	color.Cyan("================================")
 
 	status := "Isolated"
-	if vm.Status != "running" {
+	if vm.Status != StateRunning {
 		status = "VM not running"
 	}
 
@@ -1378,8 +1862,8 @@ func optimizeVMWithAI(c *cli.Context) error {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1417,7 +1901,7 @@ func optimizeVMWithAI(c *cli.Context) error {
 
 		// Save updated config
 		config.VMs[vmName] = vm
-		if err := saveConfig(configPath, config); err != nil {
+		if err := saveConfig(configPath, &config); err != nil {
 			return fmt.Errorf("failed to save config: %v", err)
 		}
 
@@ -1439,15 +1923,15 @@ func predictVMResources(c *cli.Context) error {
 		return fmt.Errorf("invalid days value: %v", err)
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	vm, exists := config.VMs[vmName]
-	if !exists {
-		return fmt.Errorf("VM '%s' not found", vmName)
+	vm, err := config.resolvedVM(vmName)
+	if err != nil {
+		return err
 	}
 
 	color.Cyan("🔮 Predicting resource needs for VM '%s' (%d days)...", vmName, daysInt)
@@ -1461,8 +1945,14 @@ func predictVMResources(c *cli.Context) error {
 	}
 
 	// Generate simple predictive model
-	currentRAM, _ := strconv.Atoi(vm.RAM)
-	currentCPU, _ := strconv.Atoi(vm.CPU)
+	currentRAM, err := vm.RAM.MB()
+	if err != nil {
+		return fmt.Errorf("VM '%s': %v", vmName, err)
+	}
+	currentCPU, err := strconv.Atoi(vm.CPU)
+	if err != nil {
+		return fmt.Errorf("VM '%s': invalid CPU count %q", vmName, vm.CPU)
+	}
 
 	predictedRAM := currentRAM + (daysInt * 100) // Simple growth model
 	predictedCPU := currentCPU
@@ -1482,8 +1972,8 @@ func diagnoseVMWithAI(c *cli.Context) error {
 		return fmt.Errorf("VM name is required")
 	}
 
-	configPath := c.String("config")
-	config, err := loadConfig(configPath)
+	configPath := configPathFlag(c)
+	config, err := loadReconciledConfig(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
@@ -1496,28 +1986,30 @@ func diagnoseVMWithAI(c *cli.Context) error {
 	color.Cyan("🔍 AI-powered diagnostics for VM '%s'...", vmName)
 
 	// Gather diagnostic information
-	diagnosticInfo := fmt.Sprintf("VM %s status: %s, RAM: %s MB, CPU: %s cores", vmName, vm.Status, vm.RAM, vm.CPU)
+	settings := config.displayVM(vmName)
+	diagnosticInfo := fmt.Sprintf("VM %s status: %s, RAM: %s MB, CPU: %s cores", vmName, vm.Status, settings.RAM, settings.CPU)
 
-	if vm.Status == "running" {
+	if vm.Status == StateRunning {
 		// Get real-time metrics
-		pidFile := vm.PIDFile
-		if pidFile == "" {
-			pidFile = fmt.Sprintf("/tmp/avm-%s.pid", vmName)
-		}
+		pidFile := vmPIDFile(vm)
 
-		if pidData, err := os.ReadFile(pidFile); err == nil {
-			pid := strings.TrimSpace(string(pidData))
-			diagnosticInfo += fmt.Sprintf(", PID: %s", pid)
+		if pid, err := readPIDFile(pidFile); err == nil {
+			diagnosticInfo += fmt.Sprintf(", PID: %d", pid)
 
-			// Get memory usage
-			memCmd := exec.Command("ps", "-o", "rss=", "-p", pid)
-			if memOutput, err := memCmd.Output(); err == nil {
-				memMB := strings.TrimSpace(string(memOutput))
-				diagnosticInfo += fmt.Sprintf(", Memory: %s KB", memMB)
+			if m, err := statusCollector.Collect(pid); err == nil {
+				diagnosticInfo += fmt.Sprintf(", Memory: %d KB, CPU: %.1f%%, uptime %s", m.RSSBytes/1024, m.CPUPercent, formatUptime(m.Uptime))
 			}
 		}
 	}
 
+	// Include the most recent crashes
+	if records, err := readCrashRecords(vmName); err == nil && len(records) > 0 {
+		diagnosticInfo += fmt.Sprintf(", %d recorded crash(es)", len(records))
+		for _, rec := range records[max(0, len(records)-3):] {
+			diagnosticInfo += "; " + rec.summary()
+		}
+	}
+
 	// Get AI diagnostics
 	aiResp := GetAISuggestions(fmt.Sprintf("diagnose VM issues: %s", diagnosticInfo))
 
@@ -1602,4 +2094,4 @@ func extractVMNameFromQuery(query string) string {
 
 	// Default to "default" if no specific VM mentioned
 	return "default"
-}
\ No newline at end of file
+}
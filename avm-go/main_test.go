@@ -56,8 +56,12 @@ func TestLoadConfig(t *testing.T) {
 		t.Fatalf("Failed to load config: %v", err)
 	}
 
-	if config.VMName != "test-vm" {
-		t.Errorf("Expected VM name 'test-vm', got '%s'", config.VMName)
+	vm, exists := config.VMs["test-vm"]
+	if !exists {
+		t.Fatalf("Expected VM 'test-vm' after migration, got %v", config.VMs)
+	}
+	if vm.RAM != "1024" || vm.Image != "test.img" {
+		t.Errorf("Expected migrated RAM 1024 and image test.img, got %s and %s", vm.RAM, vm.Image)
 	}
 }
 
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-VM process metrics, read from procfs. A VM is the proot wrapper in
+// its PID file plus every descendant, QEMU among them, so figures are
+// summed over that process tree.
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. It is
+// 100 on every Linux and Android ABI.
+const clockTicks = 100
+
+// procStat is what is used from /proc/<pid>/stat.
+type procStat struct {
+	PID       int
+	PPID      int
+	Ticks     uint64 // utime + stime
+	StartTick uint64 // start time, in ticks since boot
+}
+
+// readProcStat parses /proc/<pid>/stat. The command name is in parentheses
+// and may itself contain spaces and parentheses, so fields are counted
+// from the last ')'.
+func readProcStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	s := string(data)
+	end := strings.LastIndexByte(s, ')')
+	if end < 0 {
+		return procStat{}, fmt.Errorf("malformed stat for PID %d", pid)
+	}
+	// fields[0] is field 3 of proc(5), the state.
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 20 {
+		return procStat{}, fmt.Errorf("malformed stat for PID %d", pid)
+	}
+
+	st := procStat{PID: pid}
+	var utime, stime uint64
+	st.PPID, err = strconv.Atoi(fields[1])
+	if err == nil {
+		utime, err = strconv.ParseUint(fields[11], 10, 64)
+	}
+	if err == nil {
+		stime, err = strconv.ParseUint(fields[12], 10, 64)
+	}
+	if err == nil {
+		st.StartTick, err = strconv.ParseUint(fields[19], 10, 64)
+	}
+	if err != nil {
+		return procStat{}, fmt.Errorf("malformed stat for PID %d: %v", pid, err)
+	}
+	st.Ticks = utime + stime
+	return st, nil
+}
+
+// readProcKeyValues reads a "Key: value" file such as /proc/<pid>/status
+// or /proc/<pid>/io, returning the first number of each value.
+func readProcKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	return values, scanner.Err()
+}
+
+// processTree returns root and all of its descendants.
+func processTree(root int) ([]procStat, error) {
+	rootStat, err := readProcStat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	children := map[int][]procStat{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == root {
+			continue
+		}
+		// Processes come and go while we look; skip the ones that went.
+		if st, err := readProcStat(pid); err == nil {
+			children[st.PPID] = append(children[st.PPID], st)
+		}
+	}
+
+	tree := []procStat{rootStat}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i].PID]...)
+	}
+	return tree, nil
+}
+
+// bootTime returns when the host booted, from /proc/uptime.
+func bootTime(now time.Time) (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, "uptime"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("malformed %s", filepath.Join(procRoot, "uptime"))
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed %s: %v", filepath.Join(procRoot, "uptime"), err)
+	}
+	return now.Add(-time.Duration(secs * float64(time.Second))), nil
+}
+
+// processMetrics describes a VM's process tree at one moment.
+type processMetrics struct {
+	PID        int
+	Processes  int
+	CPUPercent float64 // of one host CPU, so 4 busy vCPUs show 400
+	RSSBytes   uint64
+	ReadBytes  uint64 // storage I/O since start
+	WriteBytes uint64
+	CPUSeconds float64 // CPU time since start
+	Uptime     time.Duration
+	Time       time.Time
+}
+
+// metricsCollector samples process trees. CPU usage is the change in CPU
+// time since the previous sample of the same root PID; the first sample
+// reports the average since the process started, as ps does.
+type metricsCollector struct {
+	mu   sync.Mutex
+	last map[int]processMetrics
+	now  func() time.Time // replaced in tests
+}
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{last: map[int]processMetrics{}, now: time.Now}
+}
+
+// Collect samples the process tree rooted at pid.
+func (c *metricsCollector) Collect(pid int) (processMetrics, error) {
+	tree, err := processTree(pid)
+	if err != nil {
+		return processMetrics{}, fmt.Errorf("failed to read process %d: %v", pid, err)
+	}
+	now := c.now()
+	m := processMetrics{PID: pid, Processes: len(tree), Time: now}
+
+	var ticks uint64
+	for _, st := range tree {
+		ticks += st.Ticks
+		dir := filepath.Join(procRoot, strconv.Itoa(st.PID))
+		if status, err := readProcKeyValues(filepath.Join(dir, "status")); err == nil {
+			m.RSSBytes += status["VmRSS"] * 1024
+		}
+		// io is only readable by the process owner; leave it out otherwise.
+		if io, err := readProcKeyValues(filepath.Join(dir, "io")); err == nil {
+			m.ReadBytes += io["read_bytes"]
+			m.WriteBytes += io["write_bytes"]
+		}
+	}
+	m.CPUSeconds = float64(ticks) / clockTicks
+
+	if boot, err := bootTime(now); err == nil {
+		started := boot.Add(time.Duration(tree[0].StartTick) * time.Second / clockTicks)
+		m.Uptime = now.Sub(started)
+	}
+
+	c.mu.Lock()
+	prev, seen := c.last[pid]
+	c.last[pid] = m
+	c.mu.Unlock()
+
+	switch {
+	case seen && now.After(prev.Time) && m.CPUSeconds >= prev.CPUSeconds:
+		m.CPUPercent = (m.CPUSeconds - prev.CPUSeconds) / now.Sub(prev.Time).Seconds() * 100
+	case m.Uptime > 0:
+		m.CPUPercent = m.CPUSeconds / m.Uptime.Seconds() * 100
+	}
+	return m, nil
+}
+
+// formatBytes renders a byte count in binary units.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatUptime renders a duration as e.g. "2h 34m".
+func formatUptime(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days, hours, minutes := int(d/(24*time.Hour)), int(d/time.Hour)%24, int(d/time.Minute)%60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
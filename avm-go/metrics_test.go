@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProc is a procfs tree for tests. withFakeProc points procRoot at it.
+type fakeProc struct {
+	t    *testing.T
+	root string
+}
+
+func withFakeProc(t *testing.T, uptime float64) *fakeProc {
+	orig := procRoot
+	procRoot = filepath.Join(t.TempDir(), "proc")
+	t.Cleanup(func() { procRoot = orig })
+
+	p := &fakeProc{t: t, root: procRoot}
+	p.write("uptime", fmt.Sprintf("%.2f 1234.00\n", uptime))
+	return p
+}
+
+func (p *fakeProc) write(name, content string) {
+	path := filepath.Join(p.root, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		p.t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// process adds a process with CPU ticks split between utime and stime,
+// started startTick ticks after boot.
+func (p *fakeProc) process(pid, ppid int, comm string, ticks, startTick, rssKB, read, written uint64) {
+	dir := fmt.Sprint(pid)
+	p.write(dir+"/stat", fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 1000 0 0 0 %d %d 0 0 20 0 4 0 %d 123456 789 18446744073709551615\n",
+		pid, comm, ppid, pid, pid, ticks/2, ticks-ticks/2, startTick))
+	p.write(dir+"/status", fmt.Sprintf("Name:\t%s\nState:\tS (sleeping)\nPPid:\t%d\nVmRSS:\t%d kB\nThreads:\t4\n", comm, ppid, rssKB))
+	p.write(dir+"/io", fmt.Sprintf("rchar: 1\nwchar: 2\nread_bytes: %d\nwrite_bytes: %d\ncancelled_write_bytes: 0\n", read, written))
+}
+
+// cmdline sets a process's command line, as vmPID checks it.
+func (p *fakeProc) cmdline(pid int, args ...string) {
+	p.write(fmt.Sprint(pid)+"/cmdline", strings.Join(args, "\x00")+"\x00")
+}
+
+func TestReadProcStatOddCommand(t *testing.T) {
+	p := withFakeProc(t, 100)
+	p.process(42, 1, "qemu (x86) )", 30, 500, 1, 0, 0)
+
+	st, err := readProcStat(42)
+	if err != nil {
+		t.Fatalf("readProcStat failed: %v", err)
+	}
+	if st.PPID != 1 || st.Ticks != 30 || st.StartTick != 500 {
+		t.Errorf("Unexpected stat: %+v", st)
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	p := withFakeProc(t, 1000)
+	// proot-distro -> bash -> qemu, plus an unrelated process.
+	p.process(100, 1, "proot-distro", 100, 40000, 2048, 0, 0)
+	p.process(101, 100, "bash", 0, 40010, 1024, 0, 0)
+	p.process(102, 101, "qemu-system-x86", 9900, 40020, 512*1024, 4096, 8192)
+	p.process(200, 1, "sshd", 50000, 100, 4096, 1, 1)
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newMetricsCollector()
+	c.now = func() time.Time { return now }
+
+	m, err := c.Collect(100)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if m.Processes != 3 {
+		t.Errorf("Expected the 3-process tree, got %d", m.Processes)
+	}
+	if m.RSSBytes != (2048+1024+512*1024)*1024 || m.ReadBytes != 4096 || m.WriteBytes != 8192 {
+		t.Errorf("Unexpected totals: %+v", m)
+	}
+	// Booted 1000s ago, started 400s after boot: up 600s with 100s of CPU.
+	if m.Uptime != 600*time.Second {
+		t.Errorf("Expected 10m uptime, got %s", m.Uptime)
+	}
+	if m.CPUPercent < 16.6 || m.CPUPercent > 16.7 {
+		t.Errorf("Expected the lifetime average of 16.7%% on the first sample, got %.2f", m.CPUPercent)
+	}
+
+	// 10s later QEMU has used 15s more CPU: 150% over the interval.
+	now = now.Add(10 * time.Second)
+	p.write("uptime", "1010.00 1234.00\n")
+	p.process(102, 101, "qemu-system-x86", 9900+1500, 40020, 512*1024, 4096, 8192)
+	m, err = c.Collect(100)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if m.CPUPercent < 149.9 || m.CPUPercent > 150.1 {
+		t.Errorf("Expected 150%% between samples, got %.2f", m.CPUPercent)
+	}
+}
+
+func TestMetricsCollectorGoneProcess(t *testing.T) {
+	withFakeProc(t, 1000)
+	if _, err := newMetricsCollector().Collect(4242); err == nil {
+		t.Error("Expected an error for a missing process")
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	cases := map[uint64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 3 << 30: "3.0 GiB"}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+	if got := formatUptime(2*time.Hour + 34*time.Minute); got != "2h 34m" {
+		t.Errorf("Unexpected uptime %q", got)
+	}
+	if got := formatUptime(50 * time.Hour); got != "2d 2h 0m" {
+		t.Errorf("Unexpected uptime %q", got)
+	}
+}
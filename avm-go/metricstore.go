@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli/v2"
+)
+
+// Metrics history. The daemon samples every VM it supervises each
+// metrics_interval and appends the sample to
+// <metrics>/<vm>/<tier>/<UTC day>.jsonl. Old days are rolled up into
+// coarser tiers, and anything older than metrics_retention is deleted.
+
+const (
+	defaultMetricsInterval  = "30s"
+	defaultMetricsRetention = "30d"
+	metricsCompactEvery     = time.Hour
+)
+
+// metricsTier is one resolution of the store. Days older than Keep are
+// averaged into the next tier; the last tier is kept for the retention.
+type metricsTier struct {
+	Name string
+	Step time.Duration // bucket width; 0 for raw samples
+	Keep time.Duration
+}
+
+var metricsTiers = []metricsTier{
+	{Name: "raw", Keep: 24 * time.Hour},
+	{Name: "5m", Step: 5 * time.Minute, Keep: 7 * 24 * time.Hour},
+	{Name: "1h", Step: time.Hour},
+}
+
+// historyMetric is a metric the store records.
+type historyMetric struct {
+	Name string
+	Unit string // %, bytes, bytes/s or empty
+	Help string
+}
+
+var historyMetrics = []historyMetric{
+	{Name: "cpu", Unit: "%", Help: "CPU usage of the VM's processes, percent of one host CPU"},
+	{Name: "mem", Unit: "bytes", Help: "resident memory of the VM's processes"},
+	{Name: "io_read", Unit: "bytes/s", Help: "storage reads by the VM's processes"},
+	{Name: "io_write", Unit: "bytes/s", Help: "storage writes by the VM's processes"},
+	{Name: "load", Help: "guest 1-minute load average"},
+	{Name: "guest_mem_free", Unit: "bytes", Help: "memory available in the guest"},
+	{Name: "disk", Unit: "bytes", Help: "bytes used on the guest's filesystems"},
+}
+
+func findHistoryMetric(name string) (historyMetric, bool) {
+	for _, m := range historyMetrics {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return historyMetric{}, false
+}
+
+// metricPoint is one line of the store: a sample, or the average of Count
+// samples over a bucket starting at Time in a downsampled tier.
+type metricPoint struct {
+	Time   time.Time          `json:"t"`
+	Values map[string]float64 `json:"v"`
+	Max    map[string]float64 `json:"max,omitempty"`
+	Count  int                `json:"n,omitempty"`
+	Tier   string             `json:"-"`
+}
+
+// parseSpan parses a duration that may also be given in days, e.g. "7d".
+func parseSpan(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q, expected e.g. 30s, 24h or 7d", s)
+	}
+	return d, nil
+}
+
+// metricsPolicy returns the sampling interval and retention from config.
+func metricsPolicy(config Config) (interval, retention time.Duration, err error) {
+	or := func(s, def string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	}
+	if interval, err = parseSpan(or(config.MetricsInterval, defaultMetricsInterval)); err != nil {
+		return 0, 0, err
+	}
+	if retention, err = parseSpan(or(config.MetricsRetention, defaultMetricsRetention)); err != nil {
+		return 0, 0, err
+	}
+	if interval <= 0 {
+		return 0, 0, fmt.Errorf("metrics_interval must be positive")
+	}
+	return interval, retention, nil
+}
+
+func metricsTierDir(vmName, tier string) string {
+	return filepath.Join(paths.Metrics, vmName, tier)
+}
+
+func metricsDayFile(vmName, tier string, t time.Time) string {
+	return filepath.Join(metricsTierDir(vmName, tier), t.UTC().Format("2006-01-02")+".jsonl")
+}
+
+// appendMetricPoints adds points to a tier's day files.
+func appendMetricPoints(vmName, tier string, points []metricPoint) error {
+	if err := os.MkdirAll(metricsTierDir(vmName, tier), 0755); err != nil {
+		return err
+	}
+	byFile := map[string][]metricPoint{}
+	for _, p := range points {
+		path := metricsDayFile(vmName, tier, p.Time)
+		byFile[path] = append(byFile[path], p)
+	}
+	for path, points := range byFile {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		for _, p := range points {
+			enc.Encode(p)
+		}
+		err = w.Flush()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// mergeMetricPoints writes downsampled points into a tier's day files,
+// replacing any point already there for the same bucket. Each file is
+// rewritten through a temp file and rename, so redoing a compaction that
+// was cut short before its source day was removed doesn't count that day
+// twice.
+func mergeMetricPoints(vmName, tier string, points []metricPoint) error {
+	dir := metricsTierDir(vmName, tier)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	byFile := map[string][]metricPoint{}
+	for _, p := range points {
+		path := metricsDayFile(vmName, tier, p.Time)
+		byFile[path] = append(byFile[path], p)
+	}
+	for path, points := range byFile {
+		existing, err := readMetricFile(path, tier)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		byTime := map[int64]metricPoint{}
+		for _, p := range append(existing, points...) {
+			byTime[p.Time.UnixNano()] = p
+		}
+		merged := make([]metricPoint, 0, len(byTime))
+		for _, p := range byTime {
+			merged = append(merged, p)
+		}
+		sort.Slice(merged, func(i, j int) bool { return merged[i].Time.Before(merged[j].Time) })
+
+		tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(tmp)
+		enc := json.NewEncoder(w)
+		for _, p := range merged {
+			enc.Encode(p)
+		}
+		err = w.Flush()
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// readMetricFile reads one day file. A line cut short by a crash is
+// skipped.
+func readMetricFile(path, tier string) ([]metricPoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []metricPoint
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var p metricPoint
+		if err := json.Unmarshal(scanner.Bytes(), &p); err == nil {
+			p.Tier = tier
+			points = append(points, p)
+		}
+	}
+	return points, scanner.Err()
+}
+
+// dayFiles lists a tier's day files with the day each covers.
+func dayFiles(vmName, tier string) (map[string]time.Time, error) {
+	entries, err := os.ReadDir(metricsTierDir(vmName, tier))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	days := map[string]time.Time{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		if day, err := time.Parse("2006-01-02", name); err == nil {
+			days[filepath.Join(metricsTierDir(vmName, tier), e.Name())] = day
+		}
+	}
+	return days, nil
+}
+
+// queryMetricPoints returns the VM's points in [since, until], from every
+// tier, oldest first.
+func queryMetricPoints(vmName string, since, until time.Time) ([]metricPoint, error) {
+	var points []metricPoint
+	for _, tier := range metricsTiers {
+		files, err := dayFiles(vmName, tier.Name)
+		if err != nil {
+			return nil, err
+		}
+		for path, day := range files {
+			if !day.Add(24*time.Hour).After(since) || day.After(until) {
+				continue
+			}
+			filePoints, err := readMetricFile(path, tier.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range filePoints {
+				if !p.Time.Before(since) && !p.Time.After(until) {
+					points = append(points, p)
+				}
+			}
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// downsample averages points into buckets of step. Averages are weighted
+// by how many samples each point already stands for.
+func downsample(points []metricPoint, step time.Duration) []metricPoint {
+	type bucket struct {
+		sum, max map[string]float64
+		weight   map[string]int
+		count    int
+	}
+	buckets := map[time.Time]*bucket{}
+	for _, p := range points {
+		start := p.Time.UTC().Truncate(step)
+		b := buckets[start]
+		if b == nil {
+			b = &bucket{sum: map[string]float64{}, max: map[string]float64{}, weight: map[string]int{}}
+			buckets[start] = b
+		}
+		n := max(p.Count, 1)
+		b.count += n
+		for name, v := range p.Values {
+			b.sum[name] += v * float64(n)
+			b.weight[name] += n
+			peak := v
+			if m, ok := p.Max[name]; ok {
+				peak = m
+			}
+			if cur, ok := b.max[name]; !ok || peak > cur {
+				b.max[name] = peak
+			}
+		}
+	}
+
+	out := make([]metricPoint, 0, len(buckets))
+	for start, b := range buckets {
+		p := metricPoint{Time: start, Values: map[string]float64{}, Max: b.max, Count: b.count}
+		for name, sum := range b.sum {
+			p.Values[name] = sum / float64(b.weight[name])
+		}
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// compactMetrics rolls a VM's day files that have aged out of their tier
+// into the next one, and deletes days older than retention.
+func compactMetrics(vmName string, now time.Time, retention time.Duration) error {
+	for i, tier := range metricsTiers {
+		files, err := dayFiles(vmName, tier.Name)
+		if err != nil {
+			return err
+		}
+		for path, day := range files {
+			end := day.Add(24 * time.Hour)
+			if !end.After(now.Add(-retention)) {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				continue
+			}
+			if i == len(metricsTiers)-1 || end.After(now.Add(-tier.Keep)) {
+				continue
+			}
+			points, err := readMetricFile(path, tier.Name)
+			if err != nil {
+				return err
+			}
+			next := metricsTiers[i+1]
+			if err := mergeMetricPoints(vmName, next.Name, downsample(points, next.Step)); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// metricsSampler turns process and guest metrics into history points. It
+// keeps the previous I/O counters of each VM to report rates.
+type metricsSampler struct {
+	collector *metricsCollector
+	last      map[string]processMetrics
+	agents    *agentBackoff
+	reported  map[string]GuestMetrics                 // agent answers not yet stored in the config
+	guest     func(vm VMConfig) (GuestMetrics, error) // replaced in tests
+}
+
+func newMetricsSampler(collector *metricsCollector) *metricsSampler {
+	return &metricsSampler{
+		collector: collector,
+		last:      map[string]processMetrics{},
+		agents:    newAgentBackoff(),
+		reported:  map[string]GuestMetrics{},
+		guest:     collectGuestMetrics,
+	}
+}
+
+// sample takes one point for a VM whose process is pid. Guest metrics are
+// left out when the VM has no guest agent, and not asked for again until
+// agentRetryEvery has passed or the VM restarts.
+func (s *metricsSampler) sample(vm VMConfig, pid int) (metricPoint, error) {
+	m, err := s.collector.Collect(pid)
+	if err != nil {
+		return metricPoint{}, err
+	}
+	p := metricPoint{Time: m.Time.UTC(), Values: map[string]float64{
+		"cpu": m.CPUPercent,
+		"mem": float64(m.RSSBytes),
+	}}
+	if prev, ok := s.last[vm.Name]; ok && prev.PID == pid && m.Time.After(prev.Time) {
+		secs := m.Time.Sub(prev.Time).Seconds()
+		if m.ReadBytes >= prev.ReadBytes && m.WriteBytes >= prev.WriteBytes {
+			p.Values["io_read"] = float64(m.ReadBytes-prev.ReadBytes) / secs
+			p.Values["io_write"] = float64(m.WriteBytes-prev.WriteBytes) / secs
+		}
+	}
+	s.last[vm.Name] = m
+
+	g, err := s.agents.collect(vm, pid, m.Time, s.guest)
+	if err != nil {
+		return p, nil
+	}
+	s.reported[vm.Name] = g
+	p.Values["load"] = g.Load1
+	p.Values["guest_mem_free"] = float64(g.MemAvailable)
+	p.Values["disk"] = float64(g.diskUsage())
+	return p, nil
+}
+
+// storeGuestMetrics saves the guest agent answers of the last round in
+// the VMs' resources, in one config write, so readers such as the
+// exporter don't have to ask the agent themselves.
+func (s *metricsSampler) storeGuestMetrics(configPath string) error {
+	if len(s.reported) == 0 {
+		return nil
+	}
+	_, err := updateConfig(configPath, func(config *Config) error {
+		for name, g := range s.reported {
+			vm, exists := config.VMs[name]
+			if !exists {
+				continue
+			}
+			g := g
+			vm.Resources.Guest, vm.Resources.DiskUsage = &g, g.diskUsage()
+			config.VMs[name] = vm
+		}
+		return nil
+	})
+	s.reported = map[string]GuestMetrics{}
+	return err
+}
+
+// recordMetrics samples every VM the daemon runs each metrics interval,
+// and compacts the store every metricsCompactEvery, until stop is closed.
+func (s *supervisor) recordMetrics(stop <-chan struct{}) {
+	sampler := newMetricsSampler(newMetricsCollector())
+	var lastCompact time.Time
+
+	for {
+		config, err := loadConfig(s.configPath)
+		if err != nil {
+			log.Warnf("Metrics: failed to load config: %v", err)
+		}
+		interval, retention, err := metricsPolicy(config)
+		if err != nil {
+			log.Warnf("Metrics: %v, using defaults", err)
+			interval, retention, _ = metricsPolicy(Config{})
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		pids := map[string]int{}
+		s.mu.Lock()
+		for name, sv := range s.vms {
+			select {
+			case <-sv.done:
+				continue // exited, possibly waiting to restart
+			default:
+			}
+			if !sv.stopping {
+				pids[name] = sv.cmd.Process.Pid
+			}
+		}
+		s.mu.Unlock()
+
+		for name, pid := range pids {
+			p, err := sampler.sample(config.displayVM(name), pid)
+			if err == nil {
+				err = appendMetricPoints(name, metricsTiers[0].Name, []metricPoint{p})
+			}
+			if err != nil {
+				log.Warnf("Metrics: failed to record VM '%s': %v", name, err)
+			}
+		}
+		if err := sampler.storeGuestMetrics(s.configPath); err != nil {
+			log.Warnf("Metrics: failed to store guest metrics: %v", err)
+		}
+
+		if time.Since(lastCompact) >= metricsCompactEvery {
+			lastCompact = time.Now()
+			entries, _ := os.ReadDir(paths.Metrics)
+			for _, e := range entries {
+				if err := compactMetrics(e.Name(), lastCompact, retention); err != nil {
+					log.Warnf("Metrics: failed to compact history of VM '%s': %v", e.Name(), err)
+				}
+			}
+		}
+	}
+}
+
+// parseSince parses --since: a span back from now, or an RFC 3339 time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := parseSpan(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q, expected e.g. 24h, 7d or 2024-03-01T00:00:00Z", s)
+	}
+	return now.Add(-d), nil
+}
+
+// formatMetricValue renders v in the metric's unit.
+func formatMetricValue(m historyMetric, v float64) string {
+	switch m.Unit {
+	case "%":
+		return fmt.Sprintf("%.1f%%", v)
+	case "bytes":
+		return formatBytes(uint64(v))
+	case "bytes/s":
+		return formatBytes(uint64(v)) + "/s"
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// queryMetrics is the `avm-go metrics query` action.
+func queryMetrics(c *cli.Context) error {
+	vmName := c.String("vm")
+	if vmName == "" {
+		return fmt.Errorf("--vm is required")
+	}
+	metric, ok := findHistoryMetric(c.String("metric"))
+	if !ok {
+		names := make([]string, len(historyMetrics))
+		for i, m := range historyMetrics {
+			names[i] = m.Name
+		}
+		return fmt.Errorf("unknown metric '%s' (available: %s)", c.String("metric"), strings.Join(names, ", "))
+	}
+
+	now := time.Now()
+	since, err := parseSince(c.String("since"), now)
+	if err != nil {
+		return err
+	}
+	until := now
+	if c.IsSet("until") {
+		if until, err = parseSince(c.String("until"), now); err != nil {
+			return err
+		}
+	}
+
+	points, err := queryMetricPoints(vmName, since, until)
+	if err != nil {
+		return fmt.Errorf("failed to read metrics history: %v", err)
+	}
+
+	type row struct {
+		Time       time.Time `json:"time"`
+		Value      float64   `json:"value"`
+		Max        *float64  `json:"max,omitempty"`
+		Resolution string    `json:"resolution"`
+	}
+	rows := []row{}
+	for _, p := range points {
+		v, ok := p.Values[metric.Name]
+		if !ok {
+			continue
+		}
+		r := row{Time: p.Time, Value: v, Resolution: p.Tier}
+		if m, ok := p.Max[metric.Name]; ok {
+			r.Max = &m
+		}
+		rows = append(rows, r)
+	}
+
+	if c.Bool("json") {
+		data, _ := json.MarshalIndent(rows, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(rows) == 0 {
+		color.Yellow("⚠️  No %s history for VM '%s' since %s (is the daemon running?)", metric.Name, vmName, since.Format(time.RFC3339))
+		return nil
+	}
+	color.Cyan("📈 %s for VM '%s' (%s):", metric.Name, vmName, metric.Help)
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Time", "Value", "Max", "Resolution"})
+	for _, r := range rows {
+		peak := "-"
+		if r.Max != nil {
+			peak = formatMetricValue(metric, *r.Max)
+		}
+		table.Append([]string{r.Time.Local().Format("2006-01-02 15:04:05"), formatMetricValue(metric, r.Value), peak, r.Resolution})
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSpan(t *testing.T) {
+	cases := map[string]time.Duration{"30s": 30 * time.Second, "24h": 24 * time.Hour, "7d": 7 * 24 * time.Hour, "1.5d": 36 * time.Hour}
+	for s, want := range cases {
+		if got, err := parseSpan(s); err != nil || got != want {
+			t.Errorf("parseSpan(%q) = %s, %v; want %s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "soon", "-1h", "xd"} {
+		if _, err := parseSpan(s); err == nil {
+			t.Errorf("Expected parseSpan(%q) to fail", s)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	points := []metricPoint{
+		{Time: base, Values: map[string]float64{"cpu": 10}},
+		{Time: base.Add(2 * time.Minute), Values: map[string]float64{"cpu": 30, "load": 1}},
+		{Time: base.Add(7 * time.Minute), Values: map[string]float64{"cpu": 50}, Max: map[string]float64{"cpu": 90}, Count: 3},
+	}
+
+	out := downsample(points, 5*time.Minute)
+	if len(out) != 2 {
+		t.Fatalf("Expected two 5m buckets, got %+v", out)
+	}
+	if out[0].Time != base || out[0].Count != 2 || out[0].Values["cpu"] != 20 || out[0].Max["cpu"] != 30 || out[0].Values["load"] != 1 {
+		t.Errorf("Unexpected first bucket: %+v", out[0])
+	}
+
+	hourly := downsample(append(out, metricPoint{Time: base.Add(20 * time.Minute), Values: map[string]float64{"cpu": 0}}), time.Hour)
+	// (20*2 + 50*3 + 0*1) / 6 samples.
+	if len(hourly) != 1 || hourly[0].Count != 6 || fmt.Sprintf("%.3f", hourly[0].Values["cpu"]) != "31.667" || hourly[0].Max["cpu"] != 90 {
+		t.Errorf("Expected a sample-weighted hourly average, got %+v", hourly)
+	}
+}
+
+func TestMetricsStoreQueryAndCompact(t *testing.T) {
+	withPaths(t, avmPaths{Metrics: t.TempDir()})
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	var raw []metricPoint
+	for _, day := range []time.Time{now.Add(-72 * time.Hour), now.Add(-time.Hour)} {
+		for i := 0; i < 4; i++ {
+			raw = append(raw, metricPoint{Time: day.Add(time.Duration(i) * time.Minute), Values: map[string]float64{"cpu": float64(10 * i)}})
+		}
+	}
+	if err := appendMetricPoints("dev", "raw", raw); err != nil {
+		t.Fatalf("appendMetricPoints failed: %v", err)
+	}
+	old := []metricPoint{{Time: now.Add(-40 * 24 * time.Hour), Values: map[string]float64{"cpu": 1}, Count: 120}}
+	if err := appendMetricPoints("dev", "1h", old); err != nil {
+		t.Fatalf("appendMetricPoints failed: %v", err)
+	}
+
+	points, err := queryMetricPoints("dev", now.Add(-2*time.Hour), now)
+	if err != nil || len(points) != 4 || points[0].Tier != "raw" || points[3].Values["cpu"] != 30 {
+		t.Fatalf("Expected today's 4 raw samples, got %+v, %v", points, err)
+	}
+
+	if err := compactMetrics("dev", now, 30*24*time.Hour); err != nil {
+		t.Fatalf("compactMetrics failed: %v", err)
+	}
+	if _, err := os.Stat(metricsDayFile("dev", "raw", now.Add(-72*time.Hour))); !os.IsNotExist(err) {
+		t.Error("Expected the 3-day-old raw file to be rolled up")
+	}
+	if _, err := os.Stat(metricsDayFile("dev", "1h", old[0].Time)); !os.IsNotExist(err) {
+		t.Error("Expected history beyond the retention to be deleted")
+	}
+
+	points, _ = queryMetricPoints("dev", now.Add(-7*24*time.Hour), now)
+	if len(points) != 5 || points[0].Tier != "5m" || points[0].Count != 4 || points[0].Values["cpu"] != 15 || points[0].Max["cpu"] != 30 {
+		t.Errorf("Expected one 5m average then today's raw samples, got %+v", points)
+	}
+
+	// A crash after the roll-up but before the raw file was removed makes
+	// the next compaction see the same day again; it must not count twice.
+	if err := appendMetricPoints("dev", "raw", raw[:4]); err != nil {
+		t.Fatalf("appendMetricPoints failed: %v", err)
+	}
+	if err := compactMetrics("dev", now, 30*24*time.Hour); err != nil {
+		t.Fatalf("compactMetrics failed: %v", err)
+	}
+	points, _ = queryMetricPoints("dev", now.Add(-7*24*time.Hour), now)
+	if len(points) != 5 || points[0].Count != 4 || points[0].Values["cpu"] != 15 {
+		t.Errorf("Expected a redone roll-up to replace the 5m point, got %+v", points)
+	}
+}
+
+func TestMetricsSampler(t *testing.T) {
+	p := withFakeProc(t, 1000)
+	p.process(100, 1, "qemu-system-x86", 1000, 40000, 1024, 1<<20, 0)
+
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	collector := newMetricsCollector()
+	collector.now = func() time.Time { return now }
+	sampler := newMetricsSampler(collector)
+	sampler.guest = func(VMConfig) (GuestMetrics, error) {
+		return GuestMetrics{Load1: 0.5, MemAvailable: 1 << 30, Filesystems: map[string]GuestFSUsage{"/": {Used: 5 << 30}}}, nil
+	}
+
+	vm := VMConfig{Name: "dev"}
+	first, err := sampler.sample(vm, 100)
+	if err != nil {
+		t.Fatalf("sample failed: %v", err)
+	}
+	if _, ok := first.Values["io_read"]; ok {
+		t.Error("Expected no I/O rate on the first sample")
+	}
+	if first.Values["mem"] != 1<<20 || first.Values["load"] != 0.5 || first.Values["disk"] != 5<<30 {
+		t.Errorf("Unexpected first sample: %+v", first.Values)
+	}
+
+	now = now.Add(10 * time.Second)
+	p.process(100, 1, "qemu-system-x86", 1000, 40000, 1024, 11<<20, 0)
+	sampler.guest = func(VMConfig) (GuestMetrics, error) { return GuestMetrics{}, fmt.Errorf("no agent") }
+	second, err := sampler.sample(vm, 100)
+	if err != nil {
+		t.Fatalf("sample failed: %v", err)
+	}
+	if second.Values["io_read"] != 1<<20 {
+		t.Errorf("Expected 1 MiB/s of reads, got %v", second.Values["io_read"])
+	}
+	if _, ok := second.Values["load"]; ok {
+		t.Error("Expected guest metrics to be left out without an agent")
+	}
+
+	asked := 0
+	sampler.guest = func(VMConfig) (GuestMetrics, error) {
+		asked++
+		return GuestMetrics{Load1: 1}, nil
+	}
+	now = now.Add(10 * time.Second)
+	if third, _ := sampler.sample(vm, 100); asked != 0 || third.Values["load"] != 0 {
+		t.Errorf("Expected the agent to be skipped after a miss, asked %d times", asked)
+	}
+	now = now.Add(agentRetryEvery)
+	if fourth, _ := sampler.sample(vm, 100); asked != 1 || fourth.Values["load"] != 1 {
+		t.Errorf("Expected the agent to be asked again after %v, asked %d times", agentRetryEvery, asked)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := replaceConfig(configPath, &Config{VMs: map[string]VMConfig{"dev": {Name: "dev", RAM: "1024", CPU: "1"}}}); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	sampler.reported["dev"] = GuestMetrics{Filesystems: map[string]GuestFSUsage{"/": {Used: 7 << 30}}}
+	if err := sampler.storeGuestMetrics(configPath); err != nil {
+		t.Fatalf("storeGuestMetrics failed: %v", err)
+	}
+	config, _ := loadConfig(configPath)
+	if got := config.VMs["dev"].Resources.DiskUsage; got != 7<<30 || len(sampler.reported) != 0 {
+		t.Errorf("Expected the disk usage to be stored once, got %d with %d pending", got, len(sampler.reported))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// Config schema versions. Files written before versioning that already
+// have a "vms" map are treated as version 2.
+const (
+	schemaFlatJSON       = 1 // single VM: {"vm_name": ..., "vm_ram": ...}
+	schemaVMMap          = 2 // Config with a vms map
+	schemaExplicitLimits = 3 // resources.max_ram/max_cpu of 0 mean no limit, not unset
+	currentSchemaVersion = schemaExplicitLimits
+)
+
+// legacyShellConfig is the KEY=VALUE file written by scripts/alpine-vm.sh.
+const legacyShellConfig = "~/.alpine-vm.conf"
+
+// errLegacyConfig is returned when saving over a file that is in a format
+// only `config migrate` should replace.
+var errLegacyConfig = fmt.Errorf("config is in a legacy format; run 'avm-go config migrate' first")
+
+// flatConfig is the original single-VM JSON format.
+type flatConfig struct {
+	VMName  string `json:"vm_name"`
+	VMRAM   string `json:"vm_ram"`
+	VMCPU   string `json:"vm_cpu"`
+	SSHPort string `json:"ssh_port"`
+	VNCPort string `json:"vnc_port"`
+	VMImage string `json:"vm_image"`
+	LogFile string `json:"log_file"`
+	PIDFile string `json:"pid_file"`
+}
+
+// migrateConfigData decodes a config in any known format and upgrades it
+// to the current schema. changes describes what was converted; it is empty
+// when data was already current.
+func migrateConfigData(data []byte) (Config, []string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return migrateShellConfig(data)
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &keys); err != nil {
+		return Config{}, nil, err
+	}
+
+	if _, ok := keys["vms"]; !ok {
+		if _, flat := keys["vm_name"]; flat {
+			return migrateFlatConfig(trimmed)
+		}
+		if _, flat := keys["vm_ram"]; flat {
+			return migrateFlatConfig(trimmed)
+		}
+	}
+
+	var config Config
+	if err := json.Unmarshal(trimmed, &config); err != nil {
+		return Config{}, nil, err
+	}
+	var changes []string
+	switch {
+	case config.SchemaVersion > currentSchemaVersion:
+		return Config{}, nil, fmt.Errorf("config schema version %d is newer than this avm-go supports (%d)", config.SchemaVersion, currentSchemaVersion)
+	case config.SchemaVersion < currentSchemaVersion:
+		if config.SchemaVersion < schemaExplicitLimits {
+			changes = append(changes, unsetZeroLimits(&config)...)
+		}
+		changes = append(changes, fmt.Sprintf("set schema_version to %d", currentSchemaVersion))
+		config.SchemaVersion = currentSchemaVersion
+	}
+	return config, changes, nil
+}
+
+// unsetZeroLimits drops the 0 that older versions wrote for every unset
+// resources.max_ram and max_cpu, so they resolve from defaults rather than
+// meaning no limit.
+func unsetZeroLimits(config *Config) []string {
+	var changes []string
+	for name, vm := range config.VMs {
+		for key, limit := range map[string]**int{"max_ram": &vm.Resources.MaxRAM, "max_cpu": &vm.Resources.MaxCPU} {
+			if *limit != nil && **limit == 0 {
+				*limit = nil
+				changes = append(changes, fmt.Sprintf("vms.%s.resources.%s of 0 unset", name, key))
+			}
+		}
+		config.VMs[name] = vm
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func migrateFlatConfig(data []byte) (Config, []string, error) {
+	var flat flatConfig
+	if err := json.Unmarshal(data, &flat); err != nil {
+		return Config{}, nil, err
+	}
+
+	name := flat.VMName
+	if name == "" {
+		name = "default"
+	}
+	vm := VMConfig{
+		Name:    name,
+		RAM:     MemSize(flat.VMRAM),
+		CPU:     flat.VMCPU,
+		SSHPort: Port(flat.SSHPort),
+		VNCPort: Port(flat.VNCPort),
+		Image:   flat.VMImage,
+		LogFile: flat.LogFile,
+		PIDFile: flat.PIDFile,
+		Status:  StateStopped,
+		Created: time.Now(),
+	}
+
+	changes := []string{fmt.Sprintf("converted single-VM JSON config into VM '%s'", name)}
+	for _, m := range []struct{ from, to, value string }{
+		{"vm_ram", "ram", flat.VMRAM},
+		{"vm_cpu", "cpu", flat.VMCPU},
+		{"ssh_port", "ssh_port", flat.SSHPort},
+		{"vnc_port", "vnc_port", flat.VNCPort},
+		{"vm_image", "image", flat.VMImage},
+		{"log_file", "log_file", flat.LogFile},
+		{"pid_file", "pid_file", flat.PIDFile},
+	} {
+		if m.value != "" {
+			changes = append(changes, fmt.Sprintf("%s → vms.%s.%s (%s)", m.from, name, m.to, m.value))
+		}
+	}
+	changes = append(changes, fmt.Sprintf("set schema_version to %d", currentSchemaVersion))
+
+	return Config{
+		SchemaVersion: currentSchemaVersion,
+		DefaultVM:     name,
+		VMs:           map[string]VMConfig{name: vm},
+	}, changes, nil
+}
+
+// shellDefault matches the "${VM_RAM:-2048}" defaults alpine-vm.sh writes.
+var shellDefault = regexp.MustCompile(`^\$\{\w+:-(.*)\}$`)
+
+// migrateShellConfig converts the KEY=VALUE file sourced by alpine-vm.sh.
+// Settings the script never saved take the script's defaults.
+func migrateShellConfig(data []byte) (Config, []string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return Config{}, nil, fmt.Errorf("not a config file: line %d is neither JSON nor KEY=VALUE", line)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		if m := shellDefault.FindStringSubmatch(value); m != nil {
+			value = m[1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return Config{}, nil, err
+	}
+
+	get := func(key, fallback string) string {
+		if v, ok := values[key]; ok && v != "" {
+			return v
+		}
+		return fallback
+	}
+	vmDir := get("VM_DIR", "~/qemu-vm")
+	vm := VMConfig{
+		Name:    "default",
+		RAM:     MemSize(get("VM_RAM", "2048")),
+		CPU:     get("VM_CPU", "2"),
+		SSHPort: Port(get("SSH_PORT", "2222")),
+		VNCPort: Port(get("VNC_PORT", "5901")),
+		Image:   filepath.Join(vmDir, get("VM_IMG", "alpine-docker.img")),
+		Status:  StateStopped,
+		Created: time.Now(),
+	}
+
+	changes := []string{"converted alpine-vm.sh shell config into VM 'default'"}
+	for _, m := range []struct{ from, to, value string }{
+		{"VM_RAM", "ram", string(vm.RAM)},
+		{"VM_CPU", "cpu", vm.CPU},
+		{"SSH_PORT", "ssh_port", string(vm.SSHPort)},
+		{"VNC_PORT", "vnc_port", string(vm.VNCPort)},
+	} {
+		source := m.from
+		if _, ok := values[m.from]; !ok {
+			source = "default"
+		}
+		changes = append(changes, fmt.Sprintf("%s → vms.default.%s (%s)", source, m.to, m.value))
+	}
+	changes = append(changes, fmt.Sprintf("image set to %s", vm.Image))
+	changes = append(changes, fmt.Sprintf("set schema_version to %d", currentSchemaVersion))
+
+	return Config{
+		SchemaVersion: currentSchemaVersion,
+		DefaultVM:     "default",
+		VMs:           map[string]VMConfig{"default": vm},
+	}, changes, nil
+}
+
+// migrateConfig is the `avm-go config migrate` action.
+func migrateConfig(c *cli.Context) error {
+	configPath := configPathFlag(c)
+
+	source := configPath
+	if from := c.String("from"); from != "" {
+		source = expandPath(from)
+	} else if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		source = expandPath(legacyShellConfig)
+	}
+
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", source, err)
+	}
+
+	jsonData, err := configToJSON(configFormat(source), data)
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %v", source, err)
+	}
+	config, changes, err := migrateConfigData(jsonData)
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %v", source, err)
+	}
+	if len(changes) == 0 && source == configPath {
+		color.Green("✅ %s is already at schema version %d", configPath, currentSchemaVersion)
+		return nil
+	}
+	if err := validate.Struct(config); err != nil {
+		return fmt.Errorf("migrated config is invalid: %v", err)
+	}
+
+	color.Cyan("🔄 Migrating %s → %s", source, configPath)
+	for _, change := range changes {
+		color.Cyan("  • %s", change)
+	}
+
+	if c.Bool("dry-run") {
+		color.Yellow("⚠️  Dry run, nothing written")
+		return nil
+	}
+
+	if _, err := os.Stat(configPath); err == nil && source != configPath {
+		return fmt.Errorf("%s already exists; move it away or pass it as --from", configPath)
+	}
+
+	backup, err := backupConfigFile(source, data)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceConfig(configPath, &config); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+
+	color.Green("✅ Migrated to schema version %d. Original saved as %s", currentSchemaVersion, backup)
+	return nil
+}
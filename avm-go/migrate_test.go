@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateShellConfig(t *testing.T) {
+	data := []byte("VM_RAM=4096\nVM_CPU=4\nSSH_PORT=2022\nVNC_PORT=5902\n")
+
+	config, changes, err := migrateConfigData(data)
+	if err != nil {
+		t.Fatalf("migrateConfigData failed: %v", err)
+	}
+	vm := config.VMs["default"]
+	if vm.RAM != "4096" || vm.CPU != "4" || vm.SSHPort != "2022" || vm.VNCPort != "5902" {
+		t.Errorf("Unexpected migrated VM %+v", vm)
+	}
+	if vm.Image != filepath.Join("~/qemu-vm", "alpine-docker.img") {
+		t.Errorf("Expected the script's default image, got %s", vm.Image)
+	}
+	if config.SchemaVersion != currentSchemaVersion || len(changes) == 0 {
+		t.Errorf("Expected schema %d with reported changes, got %d and %v", currentSchemaVersion, config.SchemaVersion, changes)
+	}
+}
+
+func TestMigrateShellConfigDefaults(t *testing.T) {
+	config, _, err := migrateConfigData([]byte("# saved by alpine-vm.sh\nVM_RAM=\"${VM_RAM:-1024}\"\n"))
+	if err != nil {
+		t.Fatalf("migrateConfigData failed: %v", err)
+	}
+	if vm := config.VMs["default"]; vm.RAM != "1024" || vm.CPU != "2" {
+		t.Errorf("Expected RAM from the shell default and CPU from the script default, got %+v", vm)
+	}
+}
+
+func TestMigrateCurrentConfig(t *testing.T) {
+	data := []byte(`{"default_vm": "dev", "vms": {"dev": {"name": "dev", "ram": "2048", "cpu": "2", "ssh_port": "2222", "image": "a.qcow2"}}}`)
+
+	config, changes, err := migrateConfigData(data)
+	if err != nil {
+		t.Fatalf("migrateConfigData failed: %v", err)
+	}
+	if len(changes) != 1 || config.SchemaVersion != currentSchemaVersion {
+		t.Errorf("Expected only the schema version to change, got %v", changes)
+	}
+
+	data = []byte(fmt.Sprintf(`{"schema_version": %d, "vms": {}}`, currentSchemaVersion))
+	if _, changes, _ := migrateConfigData(data); len(changes) != 0 {
+		t.Errorf("Expected no changes for a current config, got %v", changes)
+	}
+
+	if _, _, err := migrateConfigData([]byte(`{"schema_version": 99, "vms": {}}`)); err == nil {
+		t.Error("Expected a config from a newer avm-go to be rejected")
+	}
+}
+
+func TestMigrateUnsetsZeroLimits(t *testing.T) {
+	data := []byte(`{"schema_version": 2, "vms": {"dev": {"name": "dev", "resources": {"max_ram": 0, "max_cpu": 8}}}}`)
+	config, changes, err := migrateConfigData(data)
+	if err != nil {
+		t.Fatalf("migrateConfigData failed: %v", err)
+	}
+	if r := config.VMs["dev"].Resources; r.MaxRAM != nil || orZero(r.MaxCPU) != 8 || len(changes) != 2 {
+		t.Errorf("Expected only the zero max_ram to be unset, got %+v, %v", r, changes)
+	}
+
+	data = []byte(fmt.Sprintf(`{"schema_version": %d, "vms": {"dev": {"name": "dev", "resources": {"max_ram": 0}}}}`, currentSchemaVersion))
+	if config, _, _ := migrateConfigData(data); config.VMs["dev"].Resources.MaxRAM == nil {
+		t.Error("Expected a current config's max_ram of 0 to stay an explicit no-limit")
+	}
+}
+
+func TestSaveRefusesLegacyConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"vm_name": "old", "vm_ram": "512", "vm_cpu": "1", "ssh_port": "2222", "vm_image": "old.img"}`), 0644)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed on flat config: %v", err)
+	}
+	if err := saveConfig(configPath, &config); !errors.Is(err, errLegacyConfig) {
+		t.Errorf("Expected errLegacyConfig, got %v", err)
+	}
+
+	data, _ := os.ReadFile(configPath)
+	if !strings.Contains(string(data), "vm_name") {
+		t.Error("Legacy config was overwritten")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// avmPaths is where avm-go keeps its files. Every subsystem resolves paths
+// through it rather than hardcoding ~/.avm or /tmp.
+//
+// With AVM_HOME set everything lives under it. Otherwise each XDG base
+// directory that is set is honoured, and the rest fall back to ~/.avm
+// (and /tmp for runtime files), the layout avm-go has always used.
+type avmPaths struct {
+	Config  string // config file; config.json, or .yaml, .toml or .hcl
+	Images  string // default location of VM disk images
+	Logs    string // avm and per-VM console logs
+	Backups string // VM backups
+	Run     string // PID files and QMP/console sockets
+	Metrics string // metrics history, see metricstore.go
+	State   string // hibernated machine state
+}
+
+// resolvePaths computes the layout from the environment.
+func resolvePaths() avmPaths {
+	if home := os.Getenv("AVM_HOME"); home != "" {
+		home = expandPath(home)
+		return avmPaths{
+			Config:  findConfigFile(home),
+			Images:  filepath.Join(home, "images"),
+			Logs:    filepath.Join(home, "logs"),
+			Backups: filepath.Join(home, "backups"),
+			Run:     filepath.Join(home, "run"),
+			Metrics: filepath.Join(home, "metrics"),
+			State:   filepath.Join(home, "state"),
+		}
+	}
+
+	legacy := expandPath("~/.avm")
+	xdg := func(env, sub string) string {
+		if dir := os.Getenv(env); dir != "" && filepath.IsAbs(dir) {
+			return filepath.Join(dir, "avm", sub)
+		}
+		return ""
+	}
+	or := func(path, fallback string) string {
+		if path != "" {
+			return path
+		}
+		return fallback
+	}
+
+	return avmPaths{
+		Config:  findConfigFile(or(xdg("XDG_CONFIG_HOME", ""), legacy)),
+		Images:  or(xdg("XDG_DATA_HOME", "images"), filepath.Join(legacy, "images")),
+		Logs:    or(xdg("XDG_STATE_HOME", "logs"), filepath.Join(legacy, "logs")),
+		Backups: or(xdg("XDG_DATA_HOME", "backups"), filepath.Join(legacy, "backups")),
+		Run:     or(xdg("XDG_RUNTIME_DIR", ""), "/tmp"),
+		Metrics: or(xdg("XDG_STATE_HOME", "metrics"), filepath.Join(legacy, "metrics")),
+		State:   or(xdg("XDG_STATE_HOME", "state"), filepath.Join(legacy, "state")),
+	}
+}
+
+// paths is resolved once at startup; tests may replace it.
+var paths = resolvePaths()
+
+// expandPath expands environment variables and a leading ~ in a path from
+// a flag or the config file.
+func expandPath(path string) string {
+	path = os.ExpandEnv(path)
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// configPathFlag returns the --config flag of a command, resolved.
+func configPathFlag(c *cli.Context) string {
+	if path := c.String("config"); path != "" {
+		return expandPath(path)
+	}
+	return paths.Config
+}
+
+// vmImagePath resolves a VM's image; relative paths are under the images
+// directory.
+func vmImagePath(vm VMConfig) string {
+	image := expandPath(vm.Image)
+	if image != "" && !filepath.IsAbs(image) {
+		return filepath.Join(paths.Images, image)
+	}
+	return image
+}
+
+// vmPIDFile resolves a VM's PID file, defaulting to the runtime directory.
+func vmPIDFile(vm VMConfig) string {
+	if vm.PIDFile != "" {
+		return expandPath(vm.PIDFile)
+	}
+	return filepath.Join(paths.Run, fmt.Sprintf("avm-%s.pid", vm.Name))
+}
+
+// vmLogPath resolves a VM's console log, defaulting to the logs directory.
+func vmLogPath(vm VMConfig) string {
+	if vm.LogFile != "" {
+		return expandPath(vm.LogFile)
+	}
+	return filepath.Join(paths.Logs, vm.Name+".log")
+}
+
+// runtimeSocketPath is a per-VM socket in the runtime directory.
+func runtimeSocketPath(vm VMConfig, kind string) string {
+	return filepath.Join(paths.Run, fmt.Sprintf("avm-%s-%s.sock", vm.Name, kind))
+}
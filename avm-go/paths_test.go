@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePathsAVMHome(t *testing.T) {
+	t.Setenv("AVM_HOME", "~/vms")
+	t.Setenv("HOME", "/home/tester")
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+
+	p := resolvePaths()
+	if p.Config != "/home/tester/vms/config.json" {
+		t.Errorf("Unexpected config path %s", p.Config)
+	}
+	if p.Run != "/home/tester/vms/run" || p.Images != "/home/tester/vms/images" {
+		t.Errorf("Expected everything under AVM_HOME, got %+v", p)
+	}
+}
+
+func TestResolvePathsXDG(t *testing.T) {
+	t.Setenv("AVM_HOME", "")
+	t.Setenv("HOME", "/home/tester")
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_STATE_HOME", "/xdg/state")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+
+	p := resolvePaths()
+	expected := avmPaths{
+		Config:  "/xdg/config/avm/config.json",
+		Images:  "/home/tester/.avm/images",
+		Logs:    "/xdg/state/avm/logs",
+		Backups: "/home/tester/.avm/backups",
+		Run:     "/tmp",
+		Metrics: "/xdg/state/avm/metrics",
+		State:   "/xdg/state/avm/state",
+	}
+	if p != expected {
+		t.Errorf("Unexpected paths:\n got: %+v\nwant: %+v", p, expected)
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Setenv("HOME", "/home/tester")
+	t.Setenv("VM_DIR", "/sdcard/vms")
+
+	cases := map[string]string{
+		"~":               "/home/tester",
+		"~/alpine.qcow2":  "/home/tester/alpine.qcow2",
+		"$VM_DIR/a.qcow2": "/sdcard/vms/a.qcow2",
+		"/abs/~/kept":     "/abs/~/kept",
+		"relative.qcow2":  "relative.qcow2",
+	}
+	for in, expected := range cases {
+		if got := expandPath(in); got != expected {
+			t.Errorf("expandPath(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
+
+// withPaths pins the resolved layout for a test.
+func withPaths(t *testing.T, p avmPaths) {
+	orig := paths
+	paths = p
+	t.Cleanup(func() { paths = orig })
+}
+
+func TestVMPathsDefaults(t *testing.T) {
+	withPaths(t, avmPaths{Images: "/avm/images", Logs: "/avm/logs", Run: "/avm/run"})
+
+	vm := VMConfig{Name: "dev", Image: "alpine.qcow2"}
+	if got := vmImagePath(vm); got != filepath.Join("/avm/images", "alpine.qcow2") {
+		t.Errorf("Unexpected image path %s", got)
+	}
+	if got := vmPIDFile(vm); got != "/avm/run/avm-dev.pid" {
+		t.Errorf("Unexpected PID file %s", got)
+	}
+	if got := vmLogPath(vm); got != "/avm/logs/dev.log" {
+		t.Errorf("Unexpected log path %s", got)
+	}
+	if got := qmpSocketPath(vm); got != "/avm/run/avm-dev-qmp.sock" {
+		t.Errorf("Unexpected QMP socket %s", got)
+	}
+}
+
+func TestRuntimeStatePaths(t *testing.T) {
+	withPaths(t, avmPaths{Config: "/cfg/avm/config.json", Logs: "/state/logs", Run: "/run/avm", State: "/state/vms"})
+
+	if got := daemonSocketPath(paths.Config); got != "/run/avm/avmd.sock" {
+		t.Errorf("Unexpected daemon socket %s", got)
+	}
+	if other := daemonSocketPath("/elsewhere/config.json"); filepath.Dir(other) != "/run/avm" || other == daemonSocketPath(paths.Config) {
+		t.Errorf("Expected another config's daemon to get its own socket, got %s", other)
+	}
+	if got := crashLogPath("dev"); got != "/state/logs/crashes/dev.jsonl" {
+		t.Errorf("Unexpected crash log %s", got)
+	}
+	if got := hibernateStatePath("dev"); got != "/state/vms/dev.vmstate" {
+		t.Errorf("Unexpected state file %s", got)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultPortRange is where ports are allocated from when the config has
+// no port_range.
+const defaultPortRange = "2222-2999"
+
+// portRange is an inclusive range of host ports.
+type portRange struct {
+	First, Last int
+}
+
+// parsePortRange parses "first-last".
+func parsePortRange(s string) (portRange, error) {
+	first, last, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return portRange{}, fmt.Errorf("invalid port range %q, expected e.g. 2222-2999", s)
+	}
+	a, errA := Port(first).Number()
+	b, errB := Port(last).Number()
+	if errA != nil || errB != nil || a > b {
+		return portRange{}, fmt.Errorf("invalid port range %q, expected e.g. 2222-2999", s)
+	}
+	return portRange{First: a, Last: b}, nil
+}
+
+// portRangeOf returns the config's allocation range.
+func portRangeOf(config Config) (portRange, error) {
+	if config.PortRange == "" {
+		return parsePortRange(defaultPortRange)
+	}
+	return parsePortRange(config.PortRange)
+}
+
+// parseForward parses an extra port forward, "[tcp:|udp:]host:guest".
+func parseForward(s string) (proto string, host, guest int, err error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	proto = "tcp"
+	if len(parts) == 3 {
+		proto, parts = strings.ToLower(parts[0]), parts[1:]
+	}
+	if len(parts) != 2 || (proto != "tcp" && proto != "udp") {
+		return "", 0, 0, fmt.Errorf("invalid forward %q, expected [tcp:|udp:]host:guest", s)
+	}
+	if host, err = Port(parts[0]).Number(); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid forward %q: %v", s, err)
+	}
+	if guest, err = Port(parts[1]).Number(); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid forward %q: %v", s, err)
+	}
+	return proto, host, guest, nil
+}
+
+// hostPort is a host port a VM binds.
+type hostPort struct {
+	Proto string
+	Port  int
+	Use   string // ssh, vnc, or the forward as written
+}
+
+// vmPorts lists the host ports vm binds. Unparseable ports are left out;
+// validation reports them.
+func vmPorts(vm VMConfig) []hostPort {
+	var ports []hostPort
+	if n, err := vm.SSHPort.Number(); err == nil {
+		ports = append(ports, hostPort{Proto: "tcp", Port: n, Use: "ssh"})
+	}
+	if vm.VNCPort != "" {
+		if n, err := vm.VNCPort.Number(); err == nil {
+			ports = append(ports, hostPort{Proto: "tcp", Port: n, Use: "vnc"})
+		}
+	}
+	for _, f := range vm.Forwards {
+		if proto, host, _, err := parseForward(f); err == nil {
+			ports = append(ports, hostPort{Proto: proto, Port: host, Use: "forward " + f})
+		}
+	}
+	return ports
+}
+
+// resolvedVMs resolves every VM in config for port bookkeeping.
+func resolvedVMs(config Config) map[string]VMConfig {
+	vms := make(map[string]VMConfig, len(config.VMs))
+	for name := range config.VMs {
+		vms[name] = config.displayVM(name)
+	}
+	return vms
+}
+
+// portOwners maps "proto/port" to the VMs using it, from resolved VMs.
+func portOwners(vms map[string]VMConfig) map[string][]string {
+	owners := map[string][]string{}
+	for name, vm := range vms {
+		for _, p := range vmPorts(vm) {
+			key := fmt.Sprintf("%s/%d", p.Proto, p.Port)
+			owners[key] = append(owners[key], fmt.Sprintf("%s (%s)", name, p.Use))
+		}
+	}
+	for _, users := range owners {
+		sort.Strings(users)
+	}
+	return owners
+}
+
+// portViolations reports ports claimed more than once across the VMs.
+func portViolations(vms map[string]VMConfig) []configViolation {
+	var violations []configViolation
+	for key, users := range portOwners(vms) {
+		if len(users) > 1 {
+			violations = append(violations, configViolation{
+				Path:    "vms",
+				Message: fmt.Sprintf("port %s is used by %s", key, strings.Join(users, ", ")),
+			})
+		}
+	}
+	return violations
+}
+
+// newPortClashes reports the port clashes in after that before did not
+// have, so changing one VM isn't refused over clashes between others;
+// `config validate` and `start` report those.
+func newPortClashes(before, after Config) []configViolation {
+	_, vms := settingViolations(before)
+	existing := map[string]bool{}
+	for _, v := range portViolations(vms) {
+		existing[v.Message] = true
+	}
+	_, vms = settingViolations(after)
+	var added []configViolation
+	for _, v := range portViolations(vms) {
+		if !existing[v.Message] {
+			added = append(added, v)
+		}
+	}
+	return added
+}
+
+// portFree reports whether a host port can be bound. QEMU's user-mode
+// forwards listen on all interfaces, so that is what is tried. Tests
+// replace it.
+var portFree = func(proto string, port int) bool {
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// allocatePort picks the first port in the config's range that no VM in
+// vms uses, that isn't in reserved, and that is free on the host.
+func allocatePort(config Config, vms map[string]VMConfig, reserved map[int]bool) (int, error) {
+	r, err := portRangeOf(config)
+	if err != nil {
+		return 0, err
+	}
+	owners := portOwners(vms)
+	for port := r.First; port <= r.Last; port++ {
+		if reserved[port] || len(owners[fmt.Sprintf("tcp/%d", port)]) > 0 {
+			continue
+		}
+		if portFree("tcp", port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in %d-%d; widen port_range with 'avm-go config set port_range <first-last>'", r.First, r.Last)
+}
+
+// checkPortsFree is run before a VM starts: every port it forwards must be
+// bindable. Ports held by another active VM name that VM.
+func checkPortsFree(config Config, vmName string, vm VMConfig) error {
+	active := map[string]VMConfig{}
+	for name, other := range resolvedVMs(config) {
+		if name != vmName && other.Status.Active() {
+			active[name] = other
+		}
+	}
+	owners := portOwners(active)
+
+	var problems []string
+	seen := map[string]string{}
+	for _, p := range vmPorts(vm) {
+		key := fmt.Sprintf("%s/%d", p.Proto, p.Port)
+		switch {
+		case seen[key] != "":
+			problems = append(problems, fmt.Sprintf("%s port %d is used for both %s and %s", p.Proto, p.Port, seen[key], p.Use))
+		case len(owners[key]) > 0:
+			problems = append(problems, fmt.Sprintf("%s port %d (%s) is taken by VM %s", p.Proto, p.Port, p.Use, strings.Join(owners[key], ", ")))
+		case !portFree(p.Proto, p.Port):
+			problems = append(problems, fmt.Sprintf("%s port %d (%s) is already in use on the host", p.Proto, p.Port, p.Use))
+		}
+		seen[key] = p.Use
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// withBusyPorts makes portFree report the given TCP ports as taken.
+func withBusyPorts(t *testing.T, busy ...int) {
+	saved := portFree
+	t.Cleanup(func() { portFree = saved })
+	portFree = func(proto string, port int) bool {
+		for _, b := range busy {
+			if proto == "tcp" && port == b {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	proto, host, guest, err := parseForward("udp:5353:53")
+	if err != nil || proto != "udp" || host != 5353 || guest != 53 {
+		t.Errorf("parseForward = %s %d %d %v", proto, host, guest, err)
+	}
+	if proto, _, _, err := parseForward("8080:80"); err != nil || proto != "tcp" {
+		t.Errorf("Expected tcp default, got %s %v", proto, err)
+	}
+	for _, bad := range []string{"8080", "sctp:1:2", "1:70000", "a:b"} {
+		if _, _, _, err := parseForward(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestAllocatePort(t *testing.T) {
+	withBusyPorts(t, 2223)
+	config := Config{PortRange: "2222-2226"}
+	vms := map[string]VMConfig{
+		"a": {Name: "a", SSHPort: "2222"},
+		"b": {Name: "b", SSHPort: "2300", Forwards: []string{"2224:80"}},
+	}
+
+	port, err := allocatePort(config, vms, nil)
+	if err != nil || port != 2225 {
+		t.Errorf("allocatePort = %d, %v; expected 2225", port, err)
+	}
+	port, err = allocatePort(config, vms, map[int]bool{2225: true})
+	if err != nil || port != 2226 {
+		t.Errorf("allocatePort = %d, %v; expected 2226", port, err)
+	}
+	if _, err := allocatePort(config, vms, map[int]bool{2225: true, 2226: true}); err == nil {
+		t.Error("Expected an exhausted range to fail")
+	}
+}
+
+func TestCheckPortsFree(t *testing.T) {
+	withBusyPorts(t, 5901)
+	config := Config{VMs: map[string]VMConfig{
+		"web": {Name: "web", SSHPort: "2222", Status: StateRunning},
+		"old": {Name: "old", SSHPort: "2223", Status: StateStopped},
+	}}
+
+	vm := VMConfig{Name: "dev", SSHPort: "2222", VNCPort: "5901", Forwards: []string{"2223:80"}}
+	err := checkPortsFree(config, "dev", vm)
+	if err == nil {
+		t.Fatal("Expected taken ports to be reported")
+	}
+	for _, want := range []string{"taken by VM web (ssh)", "port 5901 (vnc) is already in use on the host"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %q", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "2223") {
+		t.Errorf("A stopped VM's port should not block start: %v", err)
+	}
+}
+
+func TestPortFreeDetectsListener(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	if portFree("tcp", l.Addr().(*net.TCPAddr).Port) {
+		t.Error("Expected a listening port to be reported as taken")
+	}
+}
+
+func TestConfigViolationsReportsDuplicatePorts(t *testing.T) {
+	config := Config{VMs: map[string]VMConfig{
+		"a": {Name: "a", SSHPort: "2222"},
+		"b": {Name: "b", SSHPort: "2222"},
+	}}
+	found := false
+	for _, v := range configViolations(config) {
+		found = found || strings.Contains(v.Message, "a (ssh), b (ssh)")
+	}
+	if !found {
+		t.Errorf("Expected config validate to report the clash, got %+v", configViolations(config))
+	}
+}
+
+func TestSetConfigKeyOnlyRefusesNewPortClashes(t *testing.T) {
+	config := Config{VMs: map[string]VMConfig{
+		"a": {Name: "a", SSHPort: "2222"},
+		"b": {Name: "b", SSHPort: "2222"},
+		"c": {Name: "c", SSHPort: "2300"},
+	}}
+	if err := setConfigKey(&config, "vms.a.cpu", "3"); err != nil {
+		t.Errorf("Expected an unrelated change to be allowed despite the old clash, got %v", err)
+	}
+	if err := setConfigKey(&config, "vms.c.ssh_port", "2222"); err == nil || !strings.Contains(err.Error(), "c (ssh)") {
+		t.Errorf("Expected a new clash to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Process groups do not exist on Windows; VMs are only supported on
+// Termux/Linux hosts, these keep the CLI building everywhere.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func detachProcess(cmd *exec.Cmd) {}
+
+func signalGroup(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+func lockFile(f *os.File, exclusive bool) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
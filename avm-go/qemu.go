@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	AccelAuto = "auto"
+	AccelKVM  = "kvm"
+	AccelTCG  = "tcg"
+)
+
+// kvmAvailable reports whether /dev/kvm can be used. It is a variable so
+// tests can pin the result.
+var kvmAvailable = func() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// qemuOptions are per-launch settings that are not part of VMConfig.
+type qemuOptions struct {
+	Headless bool
+}
+
+// qemuCommand is a QEMU invocation as a binary plus argv, before it is
+// wrapped for proot.
+type qemuCommand struct {
+	Binary string
+	Accel  string
+	Args   []string
+}
+
+// resolveAccel picks the accelerator for a VM, falling back to TCG when KVM
+// was requested or auto-detected but is not usable for the guest.
+func resolveAccel(vm VMConfig) string {
+	usable := hostCanAccelerate(vmArch(vm)) && kvmAvailable()
+	switch vm.Accel {
+	case AccelTCG:
+		return AccelTCG
+	case AccelKVM:
+		if !usable {
+			log.Warnf("VM '%s' requests KVM but it is not usable for %s guests here, falling back to TCG", vm.Name, vmArch(vm))
+			return AccelTCG
+		}
+		return AccelKVM
+	}
+	if usable {
+		return AccelKVM
+	}
+	return AccelTCG
+}
+
+// buildQEMUCommand turns a VMConfig into a QEMU command line.
+func buildQEMUCommand(vm VMConfig, opts qemuOptions) qemuCommand {
+	profile := archProfiles[vmArch(vm)]
+	q := qemuCommand{
+		Binary: profile.Binary,
+		Accel:  resolveAccel(vm),
+	}
+
+	q.add("-name", vm.Name)
+	q.add("-machine", profile.Machine)
+	ram, smp := machineSize(vm)
+	q.add("-m", ram)
+	q.add("-smp", smp)
+
+	switch q.Accel {
+	case AccelKVM:
+		q.add("-accel", "kvm", "-cpu", "host")
+	default:
+		q.add("-accel", "tcg,thread=multi", "-cpu", "max")
+	}
+
+	q.add(profile.Firmware[vmFirmware(vm)]...)
+	q.add("-hda", vmImagePath(vm))
+	netdev := "user,id=net0,hostfwd=tcp::" + string(vm.SSHPort) + "-:22"
+	for _, f := range vm.Forwards {
+		if proto, host, guest, err := parseForward(f); err == nil {
+			netdev += fmt.Sprintf(",hostfwd=%s::%d-:%d", proto, host, guest)
+		}
+	}
+	q.add("-netdev", netdev)
+	q.add("-device", "virtio-net-pci,netdev=net0")
+	q.add("-device", "virtio-rng-pci")
+	// The balloon lets RAM be changed live; see scale.go.
+	q.add("-device", "virtio-balloon-pci,id="+balloonDeviceID)
+	// qemu-guest-agent in the guest reports metrics over this channel.
+	q.add("-chardev", "socket,id=qga0,path="+escapeOptionValue(agentSocketPath(vm))+",server=on,wait=off")
+	q.add("-device", "virtio-serial-pci")
+	q.add("-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+	q.add("-qmp", "unix:"+escapeOptionValue(qmpSocketPath(vm))+",server=on,wait=off")
+
+	// The serial console lives on a socket so it can be attached after the
+	// detached launch, and is logged even while nobody is attached.
+	q.add("-chardev", "socket,id=console0,path="+escapeOptionValue(consoleSocketPath(vm))+",server=on,wait=off"+
+		",logfile="+escapeOptionValue(vmLogPath(vm))+",logappend=on")
+	q.add("-serial", "chardev:console0")
+
+	if opts.Headless {
+		q.add("-display", "none")
+	} else {
+		q.add("-nographic")
+	}
+
+	if vm.SavedState != "" {
+		// QEMU hands exec: migration URIs to /bin/sh.
+		q.add("-incoming", "exec:cat "+shellQuote(vm.SavedState))
+	}
+
+	return q
+}
+
+func (q *qemuCommand) add(args ...string) {
+	q.Args = append(q.Args, args...)
+}
+
+// Argv returns the full argument vector including the binary.
+func (q qemuCommand) Argv() []string {
+	return append([]string{q.Binary}, q.Args...)
+}
+
+// ShellLine renders the command for `bash -c`, exec'ing QEMU so it replaces
+// the shell and receives signals directly.
+func (q qemuCommand) ShellLine() string {
+	quoted := make([]string, 0, len(q.Args)+2)
+	quoted = append(quoted, "exec")
+	for _, arg := range q.Argv() {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Command wraps the QEMU invocation in the proot distro that provides QEMU.
+func (q qemuCommand) Command() *exec.Cmd {
+	return exec.Command("proot-distro", "login", "alpine", "--termux-home", "--", "bash", "-c", q.ShellLine())
+}
+
+// machineSize is the -m and -smp a VM boots with. Hibernated state can only
+// be restored into a machine of the same size.
+func machineSize(vm VMConfig) (ram, smp string) {
+	ram = string(vm.RAM)
+	if mb, err := vm.RAM.MB(); err == nil {
+		ram = strconv.Itoa(bootMemoryMB(vm, mb))
+	}
+	smp = vm.CPU
+	maxCPU := orZero(vm.Resources.MaxCPU)
+	if n, err := strconv.Atoi(vm.CPU); err == nil && archProfiles[vmArch(vm)].CPUHotplug && maxCPU > n {
+		smp = fmt.Sprintf("%d,maxcpus=%d", n, maxCPU)
+	}
+	return ram, smp
+}
+
+// shellQuote quotes s for a POSIX shell, leaving plain words untouched.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// escapeOptionValue escapes commas in a QEMU option value such as a
+// -qmp/-chardev path, where a literal comma is written as two.
+func escapeOptionValue(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func withKVM(t *testing.T, available bool) {
+	origKVM, origArch := kvmAvailable, hostArch
+	kvmAvailable = func() bool { return available }
+	hostArch = "amd64"
+	t.Cleanup(func() {
+		kvmAvailable = origKVM
+		hostArch = origArch
+	})
+}
+
+func testVM() VMConfig {
+	return VMConfig{
+		Name:    "dev",
+		RAM:     "2048",
+		CPU:     "2",
+		SSHPort: "2222",
+		Image:   "/data/alpine.qcow2",
+		LogFile: "/data/logs/dev.log",
+	}
+}
+
+func TestBuildQEMUCommandKVM(t *testing.T) {
+	withKVM(t, true)
+	withPaths(t, avmPaths{Run: "/tmp"})
+
+	q := buildQEMUCommand(testVM(), qemuOptions{})
+	expected := []string{
+		"qemu-system-x86_64",
+		"-name", "dev",
+		"-machine", "pc",
+		"-m", "2048",
+		"-smp", "2",
+		"-accel", "kvm", "-cpu", "host",
+		"-hda", "/data/alpine.qcow2",
+		"-netdev", "user,id=net0,hostfwd=tcp::2222-:22",
+		"-device", "virtio-net-pci,netdev=net0",
+		"-device", "virtio-rng-pci",
+		"-device", "virtio-balloon-pci,id=balloon0",
+		"-chardev", "socket,id=qga0,path=/tmp/avm-dev-qga.sock,server=on,wait=off",
+		"-device", "virtio-serial-pci",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		"-qmp", "unix:/tmp/avm-dev-qmp.sock,server=on,wait=off",
+		"-chardev", "socket,id=console0,path=/tmp/avm-dev-console.sock,server=on,wait=off,logfile=/data/logs/dev.log,logappend=on",
+		"-serial", "chardev:console0",
+		"-nographic",
+	}
+
+	if !reflect.DeepEqual(q.Argv(), expected) {
+		t.Errorf("Unexpected argv:\n got: %q\nwant: %q", q.Argv(), expected)
+	}
+}
+
+func TestBuildQEMUCommandFallsBackToTCG(t *testing.T) {
+	withKVM(t, false)
+
+	vm := testVM()
+	vm.Accel = AccelKVM
+	q := buildQEMUCommand(vm, qemuOptions{Headless: true})
+
+	if q.Accel != AccelTCG {
+		t.Errorf("Expected TCG fallback, got %s", q.Accel)
+	}
+	if !containsSeq(q.Args, "-accel", "tcg,thread=multi", "-cpu", "max") {
+		t.Errorf("Expected TCG accelerator args, got %q", q.Args)
+	}
+	if !containsSeq(q.Args, "-display", "none") || containsSeq(q.Args, "-nographic") {
+		t.Errorf("Expected headless display args in the QEMU argv, got %q", q.Args)
+	}
+}
+
+func TestBuildQEMUCommandIncoming(t *testing.T) {
+	withKVM(t, false)
+
+	vm := testVM()
+	vm.SavedState = "/data/my vm's.vmstate"
+	q := buildQEMUCommand(vm, qemuOptions{})
+
+	if !containsSeq(q.Args, "-incoming", `exec:cat '/data/my vm'"'"'s.vmstate'`) {
+		t.Errorf("Expected shell-quoted incoming URI, got %q", q.Args)
+	}
+}
+
+func TestBuildQEMUCommandAarch64(t *testing.T) {
+	withKVM(t, true)
+
+	vm := testVM()
+	vm.Arch = ArchAarch64
+	q := buildQEMUCommand(vm, qemuOptions{})
+
+	if q.Binary != "qemu-system-aarch64" {
+		t.Errorf("Expected aarch64 binary, got %s", q.Binary)
+	}
+	if q.Accel != AccelTCG {
+		t.Errorf("Expected TCG for an aarch64 guest on an amd64 host, got %s", q.Accel)
+	}
+	if !containsSeq(q.Args, "-machine", "virt") || !containsSeq(q.Args, "-bios", "/usr/share/qemu/edk2-aarch64-code.fd") {
+		t.Errorf("Expected virt machine with UEFI firmware, got %q", q.Args)
+	}
+}
+
+func TestBuildQEMUCommandScalingHeadroom(t *testing.T) {
+	withKVM(t, true)
+
+	vm := testVM()
+	vm.Resources = VMResources{MaxRAM: ptrTo(4096), MaxCPU: ptrTo(4)}
+	q := buildQEMUCommand(vm, qemuOptions{})
+	if !containsSeq(q.Args, "-m", "4096", "-smp", "2,maxcpus=4") {
+		t.Errorf("Expected boot memory and vCPU slots up to the maximums, got %q", q.Args)
+	}
+
+	vm.Arch = ArchAarch64
+	q = buildQEMUCommand(vm, qemuOptions{})
+	if !containsSeq(q.Args, "-m", "4096", "-smp", "2") {
+		t.Errorf("Expected no vCPU hotplug slots for aarch64, got %q", q.Args)
+	}
+}
+
+func TestBuildQEMUCommandBootsWithRAM(t *testing.T) {
+	withKVM(t, true)
+
+	// Only max_cpu has a built-in; without a max_ram the VM boots with its
+	// RAM, not with headroom it may never balloon down from.
+	vm, _, err := resolveVM(nil, VMConfig{Name: "dev", RAM: "2G"}, settingOverrides{})
+	if err != nil {
+		t.Fatalf("resolveVM failed: %v", err)
+	}
+	if q := buildQEMUCommand(vm, qemuOptions{}); !containsSeq(q.Args, "-m", "2048") {
+		t.Errorf("Expected -m 2048 without max_ram, got %q", q.Args)
+	}
+
+	vm, _, _ = resolveVM(map[string]string{"resources.max_ram": "8192"}, VMConfig{Name: "dev", RAM: "2G"}, settingOverrides{})
+	if q := buildQEMUCommand(vm, qemuOptions{}); !containsSeq(q.Args, "-m", "8192") {
+		t.Errorf("Expected -m 8192 with max_ram from defaults, got %q", q.Args)
+	}
+}
+
+func TestShellLineQuoting(t *testing.T) {
+	q := qemuCommand{
+		Binary: "qemu-system-x86_64",
+		Args:   []string{"-hda", "/sdcard/My Images/alpine.img", "-name", "dev"},
+	}
+
+	expected := `exec qemu-system-x86_64 -hda '/sdcard/My Images/alpine.img' -name dev`
+	if got := q.ShellLine(); got != expected {
+		t.Errorf("Unexpected shell line:\n got: %s\nwant: %s", got, expected)
+	}
+}
+
+func containsSeq(args []string, seq ...string) bool {
+	for i := 0; i+len(seq) <= len(args); i++ {
+		if reflect.DeepEqual(args[i:i+len(seq)], seq) {
+			return true
+		}
+	}
+	return false
+}
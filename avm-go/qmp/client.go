@@ -0,0 +1,260 @@
+// Package qmp is a client for the QEMU Machine Protocol, the JSON control
+// channel QEMU exposes with -qmp.
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned for commands issued on, or interrupted by, a closed
+// connection.
+var ErrClosed = errors.New("qmp: connection closed")
+
+// Greeting is the banner QEMU sends when a client connects.
+type Greeting struct {
+	QMP struct {
+		Version struct {
+			QEMU struct {
+				Major int `json:"major"`
+				Minor int `json:"minor"`
+				Micro int `json:"micro"`
+			} `json:"qemu"`
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Event is an asynchronous notification such as SHUTDOWN or STOP.
+type Event struct {
+	Name      string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"-"`
+}
+
+// Error is an error reply from QEMU.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+type command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        string      `json:"id"`
+}
+
+// message is any line QEMU sends after the greeting.
+type message struct {
+	Return    json.RawMessage `json:"return"`
+	Error     *Error          `json:"error"`
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Client is a QMP connection. It is safe for concurrent use; replies are
+// matched to commands by id and events are delivered on Events.
+type Client struct {
+	conn     net.Conn
+	greeting Greeting
+
+	writeMu sync.Mutex
+	enc     *json.Encoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan message
+	err     error
+
+	events chan Event
+	closed chan struct{}
+}
+
+// Dial connects to a QMP unix socket and negotiates capabilities.
+func Dial(socketPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	client, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// NewClient performs the QMP handshake on an established connection.
+func NewClient(conn net.Conn) (*Client, error) {
+	dec := json.NewDecoder(conn)
+
+	var greeting Greeting
+	if err := dec.Decode(&greeting); err != nil {
+		return nil, fmt.Errorf("qmp: reading greeting: %v", err)
+	}
+
+	c := newClient(conn, dec)
+	c.greeting = greeting
+	if err := c.Execute(context.Background(), "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialGuestAgent connects to a qemu-guest-agent socket. The agent speaks
+// the same protocol as QMP but has no greeting or capabilities handshake,
+// and sends no events. Commands time out through their context when no
+// agent runs in the guest.
+func DialGuestAgent(socketPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, json.NewDecoder(conn)), nil
+}
+
+func newClient(conn net.Conn, dec *json.Decoder) *Client {
+	c := &Client{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		pending: make(map[string]chan message),
+		events:  make(chan Event, 64),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop(dec)
+	return c
+}
+
+// Version returns the QEMU version from the greeting, e.g. "8.0.2".
+func (c *Client) Version() string {
+	v := c.greeting.QMP.Version.QEMU
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+}
+
+// Events returns the channel asynchronous events are delivered on. Events
+// are dropped if nobody reads them; the channel is closed with the client.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Execute runs a command and decodes its return value into result, which
+// may be nil.
+func (c *Client) Execute(ctx context.Context, name string, args interface{}, result interface{}) error {
+	reply := make(chan message, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := c.enc.Encode(command{Execute: name, Arguments: args, ID: id})
+	c.writeMu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return fmt.Errorf("qmp: sending %s: %v", name, err)
+	}
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return c.closeErr()
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil && len(msg.Return) > 0 {
+			if err := json.Unmarshal(msg.Return, result); err != nil {
+				return fmt.Errorf("qmp: decoding %s reply: %v", name, err)
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	}
+}
+
+// Close shuts the connection down, failing any in-flight commands.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.closed
+	return err
+}
+
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) readLoop(dec *json.Decoder) {
+	defer close(c.closed)
+
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			c.mu.Lock()
+			c.err = ErrClosed
+			for id, reply := range c.pending {
+				close(reply)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			close(c.events)
+			return
+		}
+
+		if msg.Event != "" {
+			event := Event{
+				Name:      msg.Event,
+				Data:      msg.Data,
+				Timestamp: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000),
+			}
+			select {
+			case c.events <- event:
+			default:
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		reply, ok := c.pending[msg.ID]
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		if ok {
+			reply <- msg
+		}
+	}
+}
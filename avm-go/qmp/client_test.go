@@ -0,0 +1,127 @@
+package qmp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp/qmptest"
+)
+
+func newTestClient(t *testing.T) (*qmp.Client, *qmptest.Server) {
+	t.Helper()
+
+	server, err := qmptest.NewServer(filepath.Join(t.TempDir(), "qmp.sock"))
+	if err != nil {
+		t.Fatalf("Failed to start fake QMP server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	client, err := qmp.Dial(server.Path, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial fake QMP server: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client, server
+}
+
+func TestDialNegotiatesCapabilities(t *testing.T) {
+	client, server := newTestClient(t)
+
+	if client.Version() != "8.2.0" {
+		t.Errorf("Expected version 8.2.0, got %s", client.Version())
+	}
+
+	commands := server.Commands()
+	if len(commands) == 0 || commands[0] != "qmp_capabilities" {
+		t.Errorf("Expected qmp_capabilities to be sent first, got %v", commands)
+	}
+}
+
+func TestQueryStatus(t *testing.T) {
+	client, server := newTestClient(t)
+	server.Handle("query-status", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return qmp.Status{Running: false, Status: "paused"}, nil
+	})
+
+	status, err := client.QueryStatus(context.Background())
+	if err != nil {
+		t.Fatalf("query-status failed: %v", err)
+	}
+	if status.Running || status.Status != "paused" {
+		t.Errorf("Expected paused status, got %+v", status)
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	err := client.Execute(context.Background(), "no-such-command", nil, nil)
+	var qerr *qmp.Error
+	if !errors.As(err, &qerr) || qerr.Class != "CommandNotFound" {
+		t.Errorf("Expected CommandNotFound error, got %v", err)
+	}
+}
+
+func TestConcurrentCommandsAreCorrelated(t *testing.T) {
+	client, server := newTestClient(t)
+	server.Handle("echo", func(args json.RawMessage) (interface{}, *qmp.Error) {
+		var in struct{ N int }
+		json.Unmarshal(args, &in)
+		return in, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var out struct{ N int }
+			if err := client.Execute(context.Background(), "echo", map[string]int{"N": n}, &out); err != nil {
+				t.Errorf("echo %d failed: %v", n, err)
+				return
+			}
+			if out.N != n {
+				t.Errorf("Expected reply %d, got %d", n, out.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEvents(t *testing.T) {
+	client, server := newTestClient(t)
+
+	server.SendEvent("SHUTDOWN", map[string]interface{}{"guest": true, "reason": "guest-shutdown"})
+
+	select {
+	case event := <-client.Events():
+		if event.Name != "SHUTDOWN" {
+			t.Errorf("Expected SHUTDOWN event, got %s", event.Name)
+		}
+		if event.Timestamp.IsZero() {
+			t.Error("Expected event timestamp to be set")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}
+
+func TestCommandsFailAfterDisconnect(t *testing.T) {
+	client, server := newTestClient(t)
+	server.Close()
+
+	// Wait for the reader to notice the hangup.
+	for range client.Events() {
+	}
+
+	if err := client.Stop(context.Background()); !errors.Is(err, qmp.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
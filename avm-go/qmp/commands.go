@@ -0,0 +1,132 @@
+package qmp
+
+import "context"
+
+// Status is the reply to query-status.
+type Status struct {
+	Running    bool   `json:"running"`
+	Singlestep bool   `json:"singlestep"`
+	Status     string `json:"status"` // running, paused, shutdown, inmigrate, ...
+}
+
+// QueryStatus reports whether the guest's vCPUs are running.
+func (c *Client) QueryStatus(ctx context.Context) (Status, error) {
+	var status Status
+	err := c.Execute(ctx, "query-status", nil, &status)
+	return status, err
+}
+
+// SystemPowerdown sends an ACPI power button press to the guest.
+func (c *Client) SystemPowerdown(ctx context.Context) error {
+	return c.Execute(ctx, "system_powerdown", nil, nil)
+}
+
+// Stop pauses all vCPUs.
+func (c *Client) Stop(ctx context.Context) error {
+	return c.Execute(ctx, "stop", nil, nil)
+}
+
+// Cont resumes vCPUs paused by Stop.
+func (c *Client) Cont(ctx context.Context) error {
+	return c.Execute(ctx, "cont", nil, nil)
+}
+
+// Quit terminates QEMU immediately.
+func (c *Client) Quit(ctx context.Context) error {
+	return c.Execute(ctx, "quit", nil, nil)
+}
+
+// MigrationInfo is the reply to query-migrate.
+type MigrationInfo struct {
+	Status    string `json:"status"` // none, setup, active, completed, failed, cancelled, ...
+	ErrorDesc string `json:"error-desc,omitempty"`
+}
+
+// Migrate starts migrating the machine state to uri, e.g. "exec:cat > file".
+// Progress is reported by QueryMigrate.
+func (c *Client) Migrate(ctx context.Context, uri string) error {
+	return c.Execute(ctx, "migrate", map[string]string{"uri": uri}, nil)
+}
+
+// QueryMigrate reports the progress of the current migration.
+func (c *Client) QueryMigrate(ctx context.Context) (MigrationInfo, error) {
+	var info MigrationInfo
+	err := c.Execute(ctx, "query-migrate", nil, &info)
+	return info, err
+}
+
+// Balloon asks the guest's virtio-balloon driver to bring the guest's
+// memory to bytes.
+func (c *Client) Balloon(ctx context.Context, bytes int64) error {
+	return c.Execute(ctx, "balloon", map[string]int64{"value": bytes}, nil)
+}
+
+// BalloonInfo is the reply to query-balloon.
+type BalloonInfo struct {
+	Actual int64 `json:"actual"` // bytes currently available to the guest
+}
+
+// QueryBalloon reports the guest's current memory as seen by the balloon.
+// It fails with DeviceNotActive when the VM has no balloon device.
+func (c *Client) QueryBalloon(ctx context.Context) (BalloonInfo, error) {
+	var info BalloonInfo
+	err := c.Execute(ctx, "query-balloon", nil, &info)
+	return info, err
+}
+
+// MemorySizeSummary is the reply to query-memory-size-summary.
+type MemorySizeSummary struct {
+	BaseMemory    int64 `json:"base-memory"` // boot memory (-m), in bytes
+	PluggedMemory int64 `json:"plugged-memory,omitempty"`
+}
+
+// QueryMemorySizeSummary reports the memory the VM was started with.
+func (c *Client) QueryMemorySizeSummary(ctx context.Context) (MemorySizeSummary, error) {
+	var summary MemorySizeSummary
+	err := c.Execute(ctx, "query-memory-size-summary", nil, &summary)
+	return summary, err
+}
+
+// CPUInfo is one online vCPU in the reply to query-cpus-fast.
+type CPUInfo struct {
+	CPUIndex int    `json:"cpu-index"`
+	QOMPath  string `json:"qom-path"`
+}
+
+// QueryCPUsFast lists the online vCPUs.
+func (c *Client) QueryCPUsFast(ctx context.Context) ([]CPUInfo, error) {
+	var cpus []CPUInfo
+	err := c.Execute(ctx, "query-cpus-fast", nil, &cpus)
+	return cpus, err
+}
+
+// HotpluggableCPU is a vCPU slot in the reply to query-hotpluggable-cpus.
+// QOMPath is empty for slots that have no vCPU plugged.
+type HotpluggableCPU struct {
+	Type       string         `json:"type"`
+	VCPUsCount int            `json:"vcpus-count"`
+	Props      map[string]int `json:"props"`
+	QOMPath    string         `json:"qom-path,omitempty"`
+}
+
+// QueryHotpluggableCPUs lists every vCPU slot up to -smp maxcpus.
+func (c *Client) QueryHotpluggableCPUs(ctx context.Context) ([]HotpluggableCPU, error) {
+	var slots []HotpluggableCPU
+	err := c.Execute(ctx, "query-hotpluggable-cpus", nil, &slots)
+	return slots, err
+}
+
+// DeviceAdd hot-plugs a device. props are the driver's properties.
+func (c *Client) DeviceAdd(ctx context.Context, driver, id string, props map[string]interface{}) error {
+	args := map[string]interface{}{"driver": driver, "id": id}
+	for k, v := range props {
+		args[k] = v
+	}
+	return c.Execute(ctx, "device_add", args, nil)
+}
+
+// DeviceDel asks the guest to release a hot-plugged device. Removal
+// completes asynchronously with a DEVICE_DELETED event.
+func (c *Client) DeviceDel(ctx context.Context, id string) error {
+	return c.Execute(ctx, "device_del", map[string]string{"id": id}, nil)
+}
@@ -0,0 +1,64 @@
+package qmp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+)
+
+// Guest agent commands, for a Client from DialGuestAgent.
+
+// GuestPing succeeds once the agent in the guest answers.
+func (c *Client) GuestPing(ctx context.Context) error {
+	return c.Execute(ctx, "guest-ping", nil, nil)
+}
+
+// GuestFilesystem is one entry in the reply to guest-get-fsinfo. The byte
+// counts are missing for filesystems the agent can't stat.
+type GuestFilesystem struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	UsedBytes  *int64 `json:"used-bytes,omitempty"`
+	TotalBytes *int64 `json:"total-bytes,omitempty"`
+}
+
+// GuestGetFsinfo lists the guest's mounted filesystems.
+func (c *Client) GuestGetFsinfo(ctx context.Context) ([]GuestFilesystem, error) {
+	var fs []GuestFilesystem
+	err := c.Execute(ctx, "guest-get-fsinfo", nil, &fs)
+	return fs, err
+}
+
+// guestFileRead is the reply to guest-file-read.
+type guestFileRead struct {
+	Count  int    `json:"count"`
+	BufB64 string `json:"buf-b64"`
+	EOF    bool   `json:"eof"`
+}
+
+// GuestReadFile reads a whole, small file in the guest, such as one under
+// /proc, through guest-file-open, guest-file-read and guest-file-close.
+func (c *Client) GuestReadFile(ctx context.Context, path string) ([]byte, error) {
+	var handle int64
+	if err := c.Execute(ctx, "guest-file-open", map[string]string{"path": path, "mode": "r"}, &handle); err != nil {
+		return nil, err
+	}
+	defer c.Execute(ctx, "guest-file-close", map[string]int64{"handle": handle}, nil)
+
+	var data []byte
+	for {
+		var chunk guestFileRead
+		if err := c.Execute(ctx, "guest-file-read", map[string]int64{"handle": handle, "count": 65536}, &chunk); err != nil {
+			return nil, err
+		}
+		buf, err := base64.StdEncoding.DecodeString(chunk.BufB64)
+		if err != nil {
+			return nil, fmt.Errorf("qmp: decoding guest-file-read reply: %v", err)
+		}
+		data = append(data, buf...)
+		if chunk.EOF || chunk.Count == 0 {
+			return data, nil
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package qmptest provides in-process fake QMP and guest agent servers for
+// tests.
+package qmptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+)
+
+// Handler answers one command. A non-nil error is sent as a QMP error reply.
+type Handler func(args json.RawMessage) (interface{}, *qmp.Error)
+
+// Server speaks enough QMP to drive a qmp.Client: it sends a greeting,
+// dispatches commands to handlers and can push events.
+type Server struct {
+	Path string
+
+	listener net.Listener
+	agent    bool // no greeting, as qemu-guest-agent
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	commands []string
+	conns    []net.Conn
+}
+
+// NewServer listens on a unix socket at path. qmp_capabilities and
+// query-status are answered out of the box.
+func NewServer(path string) (*Server, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Path:     path,
+		listener: listener,
+		handlers: make(map[string]Handler),
+	}
+	s.Handle("qmp_capabilities", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return struct{}{}, nil
+	})
+	s.Handle("query-status", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return qmp.Status{Running: true, Status: "running"}, nil
+	})
+
+	go s.acceptLoop()
+	return s, nil
+}
+
+// NewGuestAgentServer listens on a unix socket at path and speaks like
+// qemu-guest-agent: no greeting, and guest-ping answered out of the box.
+func NewGuestAgentServer(path string) (*Server, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Path:     path,
+		listener: listener,
+		agent:    true,
+		handlers: make(map[string]Handler),
+	}
+	s.Handle("guest-ping", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return struct{}{}, nil
+	})
+
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Handle registers or replaces the handler for a command.
+func (s *Server) Handle(name string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[name] = h
+}
+
+// Commands returns the names of all commands received so far, in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// SendEvent pushes an asynchronous event to every connected client.
+func (s *Server) SendEvent(name string, data interface{}) {
+	now := time.Now()
+	event := map[string]interface{}{
+		"event": name,
+		"timestamp": map[string]int64{
+			"seconds":      now.Unix(),
+			"microseconds": int64(now.Nanosecond() / 1000),
+		},
+	}
+	if data != nil {
+		event["data"] = data
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		json.NewEncoder(conn).Encode(event)
+	}
+}
+
+// Close stops the server and drops all connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	os.Remove(s.Path)
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	if !s.agent {
+		fmt.Fprint(conn, `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}, "package": "qmptest"}, "capabilities": []}}`+"\n")
+	}
+	s.mu.Unlock()
+
+	dec := json.NewDecoder(conn)
+	for {
+		var req struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+			ID        interface{}     `json:"id"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, req.Execute)
+		handler, ok := s.handlers[req.Execute]
+		s.mu.Unlock()
+
+		reply := map[string]interface{}{}
+		if req.ID != nil {
+			reply["id"] = req.ID
+		}
+		if !ok {
+			reply["error"] = qmp.Error{Class: "CommandNotFound", Desc: fmt.Sprintf("The command %s has not been found", req.Execute)}
+		} else if result, qerr := handler(req.Arguments); qerr != nil {
+			reply["error"] = qerr
+		} else {
+			reply["return"] = result
+		}
+
+		s.mu.Lock()
+		err := json.NewEncoder(conn).Encode(reply)
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
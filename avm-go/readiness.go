@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReadyTimeout = 5 * time.Minute
+	readyPollEvery      = time.Second
+	sshProbeTimeout     = 3 * time.Second
+
+	// exitStartTimeout is the exit status of `start --wait` when the guest
+	// does not become ready in time, so scripts can tell it from a failed
+	// launch (exit status 1).
+	exitStartTimeout = 3
+)
+
+// errNotReady is returned by waitReady when the deadline passes.
+var errNotReady = errors.New("guest did not become ready")
+
+// probeSSHBanner connects to addr and reads the SSH identification line.
+// QEMU's user-mode forwarding accepts connections before the guest listens,
+// so only a banner proves sshd is up.
+func probeSSHBanner(addr string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "SSH-") {
+		return "", fmt.Errorf("unexpected banner %q", line)
+	}
+	return line, nil
+}
+
+// readinessPhase is one step of waiting for a guest to boot. check returns
+// nil once the phase is complete.
+type readinessPhase struct {
+	Name  string
+	check func(ctx context.Context) error
+}
+
+// readinessPhases lists what `start --wait` waits for, in order.
+func readinessPhases(vm VMConfig) []readinessPhase {
+	return []readinessPhase{
+		{
+			Name: "Waiting for QEMU",
+			check: func(ctx context.Context) error {
+				client, err := dialQMP(vm)
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+				status, err := client.QueryStatus(ctx)
+				if err != nil {
+					return err
+				}
+				if !status.Running {
+					return fmt.Errorf("VM is %s", status.Status)
+				}
+				return nil
+			},
+		},
+		{
+			Name: fmt.Sprintf("Booting guest, waiting for SSH on port %s", vm.SSHPort),
+			check: func(ctx context.Context) error {
+				_, err := probeSSHBanner(net.JoinHostPort("127.0.0.1", string(vm.SSHPort)), sshProbeTimeout)
+				return err
+			},
+		},
+	}
+}
+
+// waitReady runs phases in order, polling each until it passes. progress is
+// called as each phase begins. alive is polled between attempts so a guest
+// that dies while booting is reported at once.
+func waitReady(ctx context.Context, phases []readinessPhase, alive func() bool, progress func(phase string)) error {
+	for _, phase := range phases {
+		progress(phase.Name)
+		for {
+			err := phase.check(ctx)
+			if err == nil {
+				break
+			}
+			if !alive() {
+				return fmt.Errorf("VM exited while booting")
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w (%s: %v)", errNotReady, strings.ToLower(phase.Name), err)
+			case <-time.After(readyPollEvery):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveOnce accepts connections on a local port and hands each to handle.
+func serveOnce(t *testing.T, handle func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handle(conn)
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProbeSSHBanner(t *testing.T) {
+	addr := serveOnce(t, func(conn net.Conn) {
+		conn.Write([]byte("SSH-2.0-OpenSSH_9.3\r\n"))
+	})
+
+	banner, err := probeSSHBanner(addr, time.Second)
+	if err != nil {
+		t.Fatalf("Expected banner, got error: %v", err)
+	}
+	if banner != "SSH-2.0-OpenSSH_9.3" {
+		t.Errorf("Unexpected banner %q", banner)
+	}
+}
+
+func TestProbeSSHBannerForwardWithoutGuest(t *testing.T) {
+	// QEMU's hostfwd accepts and immediately closes while sshd is down.
+	addr := serveOnce(t, func(net.Conn) {})
+
+	if _, err := probeSSHBanner(addr, time.Second); err == nil {
+		t.Error("Expected an error when the connection closes without a banner")
+	}
+}
+
+func TestWaitReadyPhases(t *testing.T) {
+	var seen []string
+	attempts := 0
+	phases := []readinessPhase{
+		{Name: "one", check: func(context.Context) error { return nil }},
+		{Name: "two", check: func(context.Context) error {
+			attempts++
+			if attempts < 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		}},
+	}
+
+	err := waitReady(context.Background(), phases, func() bool { return true }, func(p string) { seen = append(seen, p) })
+	if err != nil {
+		t.Fatalf("waitReady failed: %v", err)
+	}
+	if strings.Join(seen, ",") != "one,two" {
+		t.Errorf("Unexpected progress %v", seen)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	phases := []readinessPhase{{Name: "Waiting for SSH", check: func(context.Context) error { return errors.New("refused") }}}
+	err := waitReady(ctx, phases, func() bool { return true }, func(string) {})
+	if !errors.Is(err, errNotReady) {
+		t.Errorf("Expected errNotReady, got %v", err)
+	}
+}
+
+func TestWaitReadyProcessExit(t *testing.T) {
+	phases := []readinessPhase{{Name: "Waiting for SSH", check: func(context.Context) error { return errors.New("refused") }}}
+	err := waitReady(context.Background(), phases, func() bool { return false }, func(string) {})
+	if err == nil || errors.Is(err, errNotReady) {
+		t.Errorf("Expected an exit error distinct from a timeout, got %v", err)
+	}
+}
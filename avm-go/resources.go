@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// MemSize is a memory size as written in the config: a plain number of
+// MiB ("2048") or a number with a unit ("512M", "2G", "1.5GiB").
+type MemSize string
+
+// Port is a TCP port as written in the config.
+type Port string
+
+// memSizePattern takes an optional unit letter, and B or iB only after
+// one: a bare "2048B" would otherwise read as 2048 MiB.
+var memSizePattern = regexp.MustCompile(`(?i)^\s*([0-9]+(?:\.[0-9]+)?)\s*(?:([KMGT])(?:I?B)?)?\s*$`)
+
+// MB returns the size in MiB.
+func (m MemSize) MB() (int, error) {
+	match := memSizePattern.FindStringSubmatch(string(m))
+	if match == nil {
+		return 0, fmt.Errorf("invalid memory size %q, expected e.g. 2048, 512M or 2G", string(m))
+	}
+	n, _ := strconv.ParseFloat(match[1], 64)
+
+	switch strings.ToUpper(match[2]) {
+	case "K":
+		n /= 1024
+	case "G":
+		n *= 1024
+	case "T":
+		n *= 1024 * 1024
+	}
+	if n < 1 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("invalid memory size %q, must be a whole number of MiB", string(m))
+	}
+	return int(n), nil
+}
+
+// String renders the size in MiB when it parses, as written otherwise.
+func (m MemSize) String() string {
+	if mb, err := m.MB(); err == nil {
+		return fmt.Sprintf("%d MB", mb)
+	}
+	return string(m)
+}
+
+// Number returns the port number.
+func (p Port) Number() (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(string(p)))
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %q, expected 1-65535", string(p))
+	}
+	return n, nil
+}
+
+// newValidator builds the validator used for configs, with avm-go's
+// custom tags and JSON field names in error paths.
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterValidation("memsize", func(fl validator.FieldLevel) bool {
+		_, err := MemSize(fl.Field().String()).MB()
+		return err == nil
+	})
+	v.RegisterValidation("port", func(fl validator.FieldLevel) bool {
+		_, err := Port(fl.Field().String()).Number()
+		return err == nil
+	})
+	v.RegisterValidation("portrange", func(fl validator.FieldLevel) bool {
+		_, err := parsePortRange(fl.Field().String())
+		return err == nil
+	})
+	v.RegisterValidation("forward", func(fl validator.FieldLevel) bool {
+		_, _, _, err := parseForward(fl.Field().String())
+		return err == nil
+	})
+	v.RegisterValidation("ratio", func(fl validator.FieldLevel) bool {
+		_, err := parseRatio(fl.Field().String(), "")
+		return err == nil
+	})
+	v.RegisterValidation("span", func(fl validator.FieldLevel) bool {
+		d, err := parseSpan(fl.Field().String())
+		return err == nil && d > 0
+	})
+	v.RegisterValidation("labelname", func(fl validator.FieldLevel) bool {
+		name := fl.Field().String()
+		return promLabelName.MatchString(name) && !strings.HasPrefix(name, "__") && !reservedLabels[name]
+	})
+	v.RegisterValidation("cpus", func(fl validator.FieldLevel) bool {
+		n, err := strconv.Atoi(strings.TrimSpace(fl.Field().String()))
+		return err == nil && n >= 1
+	})
+	v.RegisterStructValidation(func(sl validator.StructLevel) {
+		vm := sl.Current().Interface().(VMConfig)
+		mb, err := vm.RAM.MB()
+		if maxRAM := orZero(vm.Resources.MaxRAM); err == nil && maxRAM > 0 && mb > maxRAM {
+			sl.ReportError(vm.RAM, "ram", "RAM", "maxram", strconv.Itoa(maxRAM))
+		}
+		cpus, err := strconv.Atoi(strings.TrimSpace(vm.CPU))
+		if maxCPU := orZero(vm.Resources.MaxCPU); err == nil && maxCPU > 0 && cpus > maxCPU {
+			sl.ReportError(vm.CPU, "cpu", "CPU", "maxcpu", strconv.Itoa(maxCPU))
+		}
+	}, VMConfig{})
+
+	return v
+}
+
+// configViolation is one problem found by `config validate`.
+type configViolation struct {
+	Path    string // JSON path, e.g. vms.dev.ram
+	Message string
+}
+
+// violationMessages explain each validator tag.
+var violationMessages = map[string]string{
+	"required":  "is required",
+	"memsize":   "must be a memory size like 2048, 512M or 2G, got %q",
+	"port":      "must be a port between 1 and 65535, got %q",
+	"cpus":      "must be a positive number of CPUs, got %q",
+	"maxram":    "%q exceeds resources.max_ram (%s MB)",
+	"maxcpu":    "%q exceeds resources.max_cpu (%s)",
+	"oneof":     "must be one of %[2]s, got %[1]q",
+	"portrange": "must be a port range like 2222-2999, got %q",
+	"forward":   "must be a forward like 8080:80 or udp:5353:53, got %q",
+	"ratio":     "must be a positive ratio like 1.5, got %q",
+	"span":      "must be a duration like 30s, 24h or 7d, got %q",
+	"labelname": "must be a label name like team or env_2, and not one the exporter uses, got %q",
+}
+
+// jsonPath turns a validator namespace such as Config.vms[dev].ram into
+// vms.dev.ram.
+func jsonPath(namespace string) string {
+	_, path, found := strings.Cut(namespace, ".")
+	if !found {
+		path = namespace
+	}
+	path = strings.ReplaceAll(path, "[", ".")
+	return strings.ReplaceAll(path, "]", "")
+}
+
+// fieldViolations explains the errors returned by validate.Struct.
+func fieldViolations(err error) []configViolation {
+	if err == nil {
+		return nil
+	}
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return []configViolation{{Message: err.Error()}}
+	}
+
+	var violations []configViolation
+	for _, fe := range fieldErrs {
+		msg, ok := violationMessages[fe.Tag()]
+		if !ok {
+			msg = "failed " + fe.Tag() + " check"
+		}
+		switch strings.Count(msg, "%") {
+		case 1:
+			msg = fmt.Sprintf(msg, fmt.Sprint(fe.Value()))
+		case 2:
+			msg = fmt.Sprintf(msg, fmt.Sprint(fe.Value()), fe.Param())
+		}
+		violations = append(violations, configViolation{Path: jsonPath(fe.Namespace()), Message: msg})
+	}
+	return violations
+}
+
+// validateVM checks one VM's fields, reporting every violation.
+func validateVM(vm VMConfig) error {
+	violations := fieldViolations(validate.Struct(vm))
+	if len(violations) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.Path + " " + v.Message
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// configViolations checks everything `config validate` reports: field
+// rules, images, architecture and dependencies, on VMs as resolved from
+// the config file. Unlike validate.Struct it does not stop at the first
+// error.
+func configViolations(config Config) []configViolation {
+	violations, resolved := settingViolations(config)
+
+	for name, vm := range resolved {
+		prefix := "vms." + name
+		if vm.Image != "" {
+			if _, err := os.Stat(vmImagePath(vm)); err != nil {
+				violations = append(violations, configViolation{Path: prefix + ".image", Message: fmt.Sprintf("image %s does not exist", vmImagePath(vm))})
+			}
+		}
+		if err := validateArch(vm); err != nil {
+			violations = append(violations, configViolation{Path: prefix + ".arch", Message: err.Error()})
+		}
+	}
+
+	if err := validateDependencies(resolved); err != nil {
+		violations = append(violations, configViolation{Path: "vms", Message: err.Error()})
+	}
+	violations = append(violations, portViolations(resolved)...)
+
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Path != violations[j].Path {
+			return violations[i].Path < violations[j].Path
+		}
+		return violations[i].Message < violations[j].Message
+	})
+	return violations
+}
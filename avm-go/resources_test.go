@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemSizeMB(t *testing.T) {
+	valid := map[MemSize]int{
+		"2048":    2048,
+		"512M":    512,
+		"2G":      2048,
+		"1.5GiB":  1536,
+		"2gb":     2048,
+		"524288K": 512,
+	}
+	for in, expected := range valid {
+		got, err := in.MB()
+		if err != nil || got != expected {
+			t.Errorf("MemSize(%q).MB() = %d, %v; expected %d", in, got, err, expected)
+		}
+	}
+
+	for _, in := range []MemSize{"lots", "", "0", "2X", "1.3M", "-1G", "2048B", "2048iB"} {
+		if _, err := in.MB(); err == nil {
+			t.Errorf("Expected MemSize(%q) to be rejected", in)
+		}
+	}
+}
+
+func TestConfigViolationsReportsEveryError(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "missing.qcow2")
+	config := Config{
+		VMs: map[string]VMConfig{
+			"dev": {
+				Name:      "dev",
+				RAM:       "lots",
+				CPU:       "0",
+				SSHPort:   "70000",
+				VNCPort:   "5901",
+				Image:     image,
+				Resources: VMResources{MaxRAM: ptrTo(4096)},
+			},
+			"big": {
+				Name:      "big",
+				RAM:       "8G",
+				CPU:       "2",
+				SSHPort:   "2223",
+				Image:     image,
+				Resources: VMResources{MaxRAM: ptrTo(4096)},
+			},
+		},
+	}
+
+	got := map[string]bool{}
+	for _, v := range configViolations(config) {
+		got[v.Path] = true
+	}
+	expected := map[string]bool{
+		"vms.dev.ram":      true,
+		"vms.dev.cpu":      true,
+		"vms.dev.ssh_port": true,
+		"vms.dev.image":    true,
+		"vms.big.ram":      true,
+		"vms.big.image":    true,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected violation paths:\n got: %v\nwant: %v", got, expected)
+	}
+}
+
+func TestValidateVM(t *testing.T) {
+	vm := VMConfig{Name: "dev", RAM: "2G", CPU: "2", SSHPort: "2222", Image: "a.qcow2", Resources: VMResources{MaxRAM: ptrTo(4096)}}
+	if err := validateVM(vm); err != nil {
+		t.Errorf("Expected a valid VM, got %v", err)
+	}
+
+	vm.RAM = "6G"
+	if err := validateVM(vm); err == nil {
+		t.Error("Expected RAM above max_ram to be rejected")
+	}
+}
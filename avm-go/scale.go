@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Live scaling. A VM boots with resources.max_ram of memory, when set, and
+// resources.max_cpu vCPU slots, and its balloon is inflated down to ram
+// while only cpu vCPUs are plugged. Scaling then moves the balloon and
+// plugs or unplugs vCPUs without a restart.
+
+const (
+	balloonDeviceID = "balloon0"
+	// hotplugCPUPrefix names the vCPUs avm-go plugs. Only those can be
+	// unplugged again; the boot vCPUs stay.
+	hotplugCPUPrefix = "avm-cpu-"
+	// balloonTimeout bounds how long the daemon waits for a new VM's QMP
+	// socket to set its initial balloon target.
+	balloonTimeout = 30 * time.Second
+)
+
+const mib = 1 << 20
+
+// bootMemoryMB is the memory QEMU is started with for a VM whose RAM is
+// ramMB: resources.max_ram when set and larger, so the balloon has room to
+// grow. Without it the VM boots with just its RAM, as it always has.
+func bootMemoryMB(vm VMConfig, ramMB int) int {
+	if maxRAM := orZero(vm.Resources.MaxRAM); maxRAM > ramMB {
+		return maxRAM
+	}
+	return ramMB
+}
+
+// scaleResult is the outcome of scaling one resource of a running VM.
+type scaleResult struct {
+	Resource string // ram or cpu
+	Target   int    // MB or vCPUs
+	Current  int    // what the VM has now
+	Live     bool   // the change was applied without a restart
+	Reason   string // why a restart is required
+}
+
+// scaleLive applies new RAM (MB) and vCPU targets to a running VM. A zero
+// target leaves that resource alone.
+func scaleLive(ctx context.Context, client *qmp.Client, ramMB, cpus int) []scaleResult {
+	var results []scaleResult
+	if ramMB > 0 {
+		r := scaleResult{Resource: "ram", Target: ramMB}
+		current, err := scaleMemory(ctx, client, ramMB)
+		r.Current, r.Live = current, err == nil
+		if err != nil {
+			r.Reason = err.Error()
+		}
+		results = append(results, r)
+	}
+	if cpus > 0 {
+		r := scaleResult{Resource: "cpu", Target: cpus}
+		current, err := scaleCPUs(ctx, client, cpus)
+		r.Current, r.Live = current, err == nil
+		if err != nil {
+			r.Reason = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// scaleMemory sets the balloon target and returns the guest's memory in
+// MB: the new target on success, what the balloon reports otherwise. The
+// guest driver reaches the target over the next moments.
+func scaleMemory(ctx context.Context, client *qmp.Client, mb int) (int, error) {
+	info, err := client.QueryBalloon(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("the VM has no balloon device")
+	}
+	current := int(info.Actual / mib)
+
+	summary, err := client.QueryMemorySizeSummary(ctx)
+	if err != nil {
+		return current, fmt.Errorf("could not read boot memory: %v", err)
+	}
+	if boot := int(summary.BaseMemory / mib); mb > boot {
+		return current, fmt.Errorf("%d MB exceeds the %d MB the VM was started with", mb, boot)
+	}
+
+	if err := client.Balloon(ctx, int64(mb)*mib); err != nil {
+		return current, fmt.Errorf("balloon failed: %v", err)
+	}
+	return mb, nil
+}
+
+// scaleCPUs plugs or unplugs vCPUs until n are online and returns how
+// many are online, or requested, afterwards. Unplugging is asynchronous
+// and needs the guest to release the vCPU.
+func scaleCPUs(ctx context.Context, client *qmp.Client, n int) (int, error) {
+	slots, err := client.QueryHotpluggableCPUs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("the VM does not support vCPU hotplug")
+	}
+
+	online := 0
+	var empty, plugged []int
+	for i, slot := range slots {
+		switch {
+		case slot.QOMPath == "":
+			empty = append(empty, i)
+		case strings.HasSuffix(slot.QOMPath, "/"+hotplugCPUPrefix+strconv.Itoa(i)):
+			plugged = append(plugged, i)
+			online++
+		default:
+			online++
+		}
+	}
+
+	if n > len(slots) {
+		return online, fmt.Errorf("%d vCPUs exceeds the %d slots the VM was started with", n, len(slots))
+	}
+
+	for online < n {
+		i := empty[0]
+		empty = empty[1:]
+		props := map[string]interface{}{}
+		for k, v := range slots[i].Props {
+			props[k] = v
+		}
+		if err := client.DeviceAdd(ctx, slots[i].Type, hotplugCPUPrefix+strconv.Itoa(i), props); err != nil {
+			return online, fmt.Errorf("vCPU hot-add failed: %v", err)
+		}
+		online++
+	}
+
+	if online-n > len(plugged) {
+		return online, fmt.Errorf("only %d of the %d vCPUs were hot-added and can be removed live", len(plugged), online)
+	}
+	for online > n {
+		i := plugged[len(plugged)-1]
+		plugged = plugged[:len(plugged)-1]
+		if err := client.DeviceDel(ctx, hotplugCPUPrefix+strconv.Itoa(i)); err != nil {
+			return online, fmt.Errorf("vCPU unplug failed: %v", err)
+		}
+		online--
+	}
+	return online, nil
+}
+
+// setInitialBalloon inflates a freshly started VM's balloon from its boot
+// memory down to its RAM, and returns the guest's memory in MB as the
+// balloon last reported it, 0 if it never did. done is closed if QEMU
+// exits meanwhile.
+func setInitialBalloon(vm VMConfig, ramMB int, done <-chan struct{}) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), balloonTimeout)
+	defer cancel()
+
+	client, err := dialQMPWhenReady(ctx, vm, done)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	if err := client.Balloon(ctx, int64(ramMB)*mib); err != nil {
+		return 0, err
+	}
+	return waitBalloon(ctx, client, ramMB)
+}
+
+// waitBalloon polls the balloon until the guest is down to mb, and returns
+// the guest's memory in MB as last reported. A guest without a balloon
+// driver never gets there; it keeps its boot memory until ctx expires.
+func waitBalloon(ctx context.Context, client *qmp.Client, mb int) (int, error) {
+	current := 0
+	for {
+		info, err := client.QueryBalloon(ctx)
+		if err == nil {
+			current = int(info.Actual / mib)
+			if current <= mb {
+				return current, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return current, fmt.Errorf("balloon still at %d MB of %d MB: %v", current, mb, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// scaleVMResources is the `avm-go vm resources scale` action. The new
+// values are saved, and a running VM is changed live where QEMU can.
+func scaleVMResources(c *cli.Context) error {
+	vmName := c.String("name")
+	if vmName == "" {
+		return fmt.Errorf("VM name is required")
+	}
+
+	newRAM := c.String("ram")
+	newCPU := c.String("cpu")
+	if newRAM == "" && newCPU == "" {
+		return fmt.Errorf("at least one resource (ram or cpu) must be specified")
+	}
+
+	configPath := configPathFlag(c)
+	if _, err := loadReconciledConfig(configPath); err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	var resolved VMConfig
+	_, err := updateConfig(configPath, func(config *Config) error {
+		vm, exists := config.VMs[vmName]
+		if !exists {
+			return fmt.Errorf("VM '%s' not found", vmName)
+		}
+		held := vmUseOf(config.displayVM(vmName))
+		before := cloneConfig(*config)
+		if newRAM != "" {
+			vm.RAM = MemSize(newRAM)
+		}
+		if newCPU != "" {
+			vm.CPU = newCPU
+		}
+		config.VMs[vmName] = vm
+
+		r, err := config.resolvedVM(vmName)
+		if err == nil {
+			err = validateVM(r)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid resources for VM '%s': %v", vmName, err)
+		}
+		if err := checkHibernatedSize(before, *config); err != nil {
+			return err
+		}
+		// Only growing a running VM needs room on the host.
+		if want := requestOf(r); (r.Status == StateRunning || r.Status == StatePaused) && (want.RAM > held.RAM || want.CPUs > held.CPUs) {
+			if err := admit(*config, r, c.Bool("force"), nil); err != nil {
+				return err
+			}
+		}
+		resolved = r
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if newRAM != "" {
+		color.Cyan("📈 Scaling VM '%s' RAM to %s", vmName, resolved.RAM)
+	}
+	if newCPU != "" {
+		color.Cyan("📈 Scaling VM '%s' CPU to %s cores", vmName, resolved.CPU)
+	}
+
+	if resolved.Status != StateRunning && resolved.Status != StatePaused {
+		color.Green("✅ VM '%s' resources updated, they apply at the next start", vmName)
+		return nil
+	}
+
+	var ramMB, cpus int
+	if newRAM != "" {
+		ramMB, _ = resolved.RAM.MB()
+	}
+	if newCPU != "" {
+		cpus, _ = strconv.Atoi(resolved.CPU)
+	}
+
+	var results []scaleResult
+	err = withQMP(resolved, func(ctx context.Context, client *qmp.Client) error {
+		results = scaleLive(ctx, client, ramMB, cpus)
+		return nil
+	})
+	if err != nil {
+		color.Green("✅ VM '%s' resources updated", vmName)
+		color.Yellow("⚠️  Restart required: %v", err)
+		return nil
+	}
+
+	if _, err := updateVM(configPath, vmName, func(vm *VMConfig) error {
+		for _, r := range results {
+			if !r.Live {
+				continue
+			}
+			switch r.Resource {
+			case "ram":
+				vm.Resources.CurrentRAM = r.Current
+			case "cpu":
+				vm.Resources.CurrentCPU = r.Current
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Warnf("Failed to record current resources of VM '%s': %v", vmName, err)
+	}
+
+	restart := false
+	for _, r := range results {
+		unit := "MB"
+		if r.Resource == "cpu" {
+			unit = "vCPUs"
+		}
+		if r.Live {
+			color.Green("✅ %s is now %d %s (applied live)", strings.ToUpper(r.Resource), r.Current, unit)
+			continue
+		}
+		restart = true
+		color.Yellow("⚠️  %s stays at %d %s until restart: %s", strings.ToUpper(r.Resource), r.Current, unit, r.Reason)
+	}
+	if restart {
+		color.Yellow("⚠️  Restart required: restart the VM for the remaining changes to take effect")
+	}
+
+	log.WithFields(logrus.Fields{
+		"action":  "scale",
+		"vm":      vmName,
+		"ram":     resolved.RAM,
+		"cpu":     resolved.CPU,
+		"restart": restart,
+	}).Info("VM resources scaled")
+	return nil
+}
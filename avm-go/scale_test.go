@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp/qmptest"
+)
+
+// fakeScalableVM serves a VM booted with 4096 MB and four vCPU slots, of
+// which the given QOM paths are plugged.
+func fakeScalableVM(t *testing.T, plugged ...string) (*qmptest.Server, *qmp.Client, map[string]json.RawMessage) {
+	server, err := qmptest.NewServer(filepath.Join(t.TempDir(), "qmp.sock"))
+	if err != nil {
+		t.Fatalf("Failed to start fake QMP server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	calls := map[string]json.RawMessage{}
+	ok := func(name string) qmptest.Handler {
+		return func(args json.RawMessage) (interface{}, *qmp.Error) {
+			calls[name] = args
+			return struct{}{}, nil
+		}
+	}
+	server.Handle("query-balloon", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return qmp.BalloonInfo{Actual: 2048 * mib}, nil
+	})
+	server.Handle("query-memory-size-summary", func(json.RawMessage) (interface{}, *qmp.Error) {
+		return qmp.MemorySizeSummary{BaseMemory: 4096 * mib}, nil
+	})
+	server.Handle("query-hotpluggable-cpus", func(json.RawMessage) (interface{}, *qmp.Error) {
+		slots := make([]qmp.HotpluggableCPU, 4)
+		for i := range slots {
+			slots[i] = qmp.HotpluggableCPU{Type: "qemu64-x86_64-cpu", VCPUsCount: 1, Props: map[string]int{"socket-id": i, "core-id": 0, "thread-id": 0}}
+			if i < len(plugged) {
+				slots[i].QOMPath = plugged[i]
+			}
+		}
+		return slots, nil
+	})
+	server.Handle("balloon", ok("balloon"))
+	server.Handle("device_add", ok("device_add"))
+	server.Handle("device_del", ok("device_del"))
+
+	client, err := qmp.Dial(server.Path, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return server, client, calls
+}
+
+func TestScaleLive(t *testing.T) {
+	server, client, calls := fakeScalableVM(t, "/machine/unattached/device[0]", "/machine/unattached/device[1]")
+
+	results := scaleLive(context.Background(), client, 3072, 3)
+	for _, r := range results {
+		if !r.Live || r.Current != r.Target {
+			t.Errorf("Expected %s to scale live to %d, got %+v", r.Resource, r.Target, r)
+		}
+	}
+
+	var balloon struct{ Value int64 }
+	json.Unmarshal(calls["balloon"], &balloon)
+	if balloon.Value != 3072*mib {
+		t.Errorf("Expected balloon target of 3072 MB, got %d bytes", balloon.Value)
+	}
+	var add map[string]interface{}
+	json.Unmarshal(calls["device_add"], &add)
+	if add["id"] != "avm-cpu-2" || add["driver"] != "qemu64-x86_64-cpu" || add["socket-id"] != float64(2) {
+		t.Errorf("Unexpected device_add arguments: %v", add)
+	}
+	if strings.Contains(strings.Join(server.Commands(), ","), "device_del") {
+		t.Errorf("Expected no unplug, got %v", server.Commands())
+	}
+}
+
+func TestScaleLiveUnplugsOnlyHotAddedCPUs(t *testing.T) {
+	_, client, calls := fakeScalableVM(t, "/machine/unattached/device[0]", "/machine/unattached/device[1]", "/machine/peripheral/avm-cpu-2")
+
+	results := scaleLive(context.Background(), client, 0, 2)
+	if len(results) != 1 || !results[0].Live || results[0].Current != 2 {
+		t.Fatalf("Expected a live unplug to 2 vCPUs, got %+v", results)
+	}
+	var del struct{ ID string }
+	json.Unmarshal(calls["device_del"], &del)
+	if del.ID != "avm-cpu-2" {
+		t.Errorf("Expected avm-cpu-2 to be unplugged, got %q", del.ID)
+	}
+
+	results = scaleLive(context.Background(), client, 0, 1)
+	if results[0].Live || !strings.Contains(results[0].Reason, "hot-added") {
+		t.Errorf("Expected boot vCPUs to need a restart, got %+v", results[0])
+	}
+}
+
+func TestScaleLiveBeyondBootResources(t *testing.T) {
+	_, client, calls := fakeScalableVM(t, "/machine/unattached/device[0]")
+
+	results := scaleLive(context.Background(), client, 8192, 6)
+	for _, r := range results {
+		if r.Live || r.Reason == "" {
+			t.Errorf("Expected %s to require a restart, got %+v", r.Resource, r)
+		}
+	}
+	if results[0].Current != 2048 || results[1].Current != 1 {
+		t.Errorf("Expected current values to be reported unchanged, got %+v", results)
+	}
+	if _, ok := calls["balloon"]; ok {
+		t.Error("Expected no balloon change beyond boot memory")
+	}
+}
+
+func TestWaitBalloon(t *testing.T) {
+	_, client, _ := fakeScalableVM(t)
+
+	if current, err := waitBalloon(context.Background(), client, 2048); err != nil || current != 2048 {
+		t.Errorf("Expected the balloon at 2048 MB, got %d, %v", current, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if current, err := waitBalloon(ctx, client, 1024); err == nil || current != 2048 {
+		t.Errorf("Expected a guest stuck at 2048 MB to time out, got %d, %v", current, err)
+	}
+}
+
+func TestValidateVMMaxCPU(t *testing.T) {
+	vm := VMConfig{Name: "dev", RAM: "2048", CPU: "8", Resources: VMResources{MaxCPU: ptrTo(4)}}
+	err := validateVM(vm)
+	if err == nil || !strings.Contains(err.Error(), "max_cpu") {
+		t.Errorf("Expected a max_cpu violation, got %v", err)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli/v2"
+)
+
+// vmSetting is a per-VM value that resolves in layers, lowest first: the
+// built-in default, the config's defaults block, the VM itself, an AVM_*
+// environment variable, then a command-line flag.
+type vmSetting struct {
+	Key     string // JSON path within a VM, e.g. resources.max_ram
+	Builtin string // "" leaves the zero value
+	Flag    string // command-line flag overriding it, "" for none
+	Usage   string
+}
+
+var vmSettings = []vmSetting{
+	{Key: "ram", Builtin: "2048", Flag: "ram", Usage: "RAM, e.g. 2048, 512M or 2G"},
+	{Key: "cpu", Builtin: "2", Flag: "cpu", Usage: "Number of CPU cores"},
+	{Key: "ssh_port", Builtin: "2222", Flag: "ssh-port", Usage: "Host port forwarded to the guest's SSH"},
+	{Key: "vnc_port", Flag: "vnc-port", Usage: "VNC port"},
+	{Key: "image", Builtin: "alpine-vm.qcow2", Flag: "image", Usage: "Disk image"},
+	{Key: "accel", Builtin: AccelAuto, Flag: "accel", Usage: "Accelerator: auto, kvm or tcg"},
+	{Key: "arch", Builtin: ArchX86_64},
+	{Key: "firmware"},
+	{Key: "restart_policy", Builtin: string(RestartNever)},
+	{Key: "autostart", Builtin: "false"},
+	{Key: "resources.max_ram"}, // no built-in: it raises the memory QEMU boots with
+	{Key: "resources.max_cpu", Builtin: "4"},
+}
+
+// settableVMKeys are the VM keys `config set` accepts besides vmSettings.
+// Everything else is runtime state owned by avm-go.
+var settableVMKeys = map[string]bool{
+	"depends_on": true,
+	"forwards":   true,
+	"pid_file":   true,
+	"log_file":   true,
+	"labels":     true,
+}
+
+// settableConfigKeys are the top-level keys `config set` accepts.
+var settableConfigKeys = map[string]bool{
+	"default_vm":        true,
+	"log_file":          true,
+	"port_range":        true,
+	"mem_overcommit":    true,
+	"cpu_overcommit":    true,
+	"host_reserve":      true,
+	"metrics_interval":  true,
+	"metrics_retention": true,
+}
+
+// Layer names shown by `config show --resolved`.
+const (
+	sourceBuiltin  = "built-in"
+	sourceDefaults = "defaults"
+	sourceVM       = "vm"
+)
+
+func findSetting(key string) (vmSetting, bool) {
+	for _, s := range vmSettings {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return vmSetting{}, false
+}
+
+// envVar is the environment variable overriding the setting, e.g.
+// AVM_RESOURCES_MAX_RAM.
+func (s vmSetting) envVar() string {
+	return "AVM_" + strings.ToUpper(strings.ReplaceAll(s.Key, ".", "_"))
+}
+
+// settingOverrides are setting values from the environment and the command
+// line, keyed by setting. The CLI collects them and passes them to the
+// daemon with a start request, so they apply to that run (and its
+// restarts) only.
+type settingOverrides struct {
+	Env   map[string]string `json:"env,omitempty"`
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// envOverrides collects the AVM_* variables that are set.
+func envOverrides() settingOverrides {
+	o := settingOverrides{Env: map[string]string{}}
+	for _, s := range vmSettings {
+		if v := os.Getenv(s.envVar()); v != "" {
+			o.Env[s.Key] = v
+		}
+	}
+	return o
+}
+
+// contextOverrides collects AVM_* variables and any setting flags given to
+// the command.
+func contextOverrides(c *cli.Context) settingOverrides {
+	o := envOverrides()
+	o.Flags = map[string]string{}
+	for _, s := range vmSettings {
+		if s.Flag != "" && c.IsSet(s.Flag) {
+			o.Flags[s.Key] = c.String(s.Flag)
+		}
+	}
+	return o
+}
+
+// settingFlags are the flags that override settings for one command.
+func settingFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, s := range vmSettings {
+		if s.Flag != "" {
+			flags = append(flags, &cli.StringFlag{
+				Name:  s.Flag,
+				Usage: fmt.Sprintf("%s (overrides the config and %s)", s.Usage, s.envVar()),
+			})
+		}
+	}
+	return flags
+}
+
+// ptrTo returns a pointer to v, for settings stored as pointers so that a
+// VM can set them to false or 0 over a default.
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+// orZero reads a pointer setting, nil as the zero value.
+func orZero[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
+
+// resolveVM applies the setting layers to a stored VM. sources maps each
+// setting key to the layer its value came from.
+func resolveVM(defaults map[string]string, vm VMConfig, o settingOverrides) (VMConfig, map[string]string, error) {
+	sources := map[string]string{}
+	for _, s := range vmSettings {
+		field, err := fieldByPath(reflect.ValueOf(&vm).Elem(), s.Key)
+		if err != nil {
+			return vm, nil, err
+		}
+
+		value, source := s.Builtin, sourceBuiltin
+		if v := defaults[s.Key]; v != "" {
+			value, source = v, sourceDefaults
+		}
+		// Pointer settings are set when non-nil, even to false or 0.
+		if !field.IsZero() {
+			value, source = formatValue(field), sourceVM
+		}
+		if v, ok := o.Env[s.Key]; ok {
+			value, source = v, "env "+s.envVar()
+		}
+		if v, ok := o.Flags[s.Key]; ok {
+			value, source = v, "flag --"+s.Flag
+		}
+
+		if err := setValue(field, value); err != nil {
+			return vm, nil, fmt.Errorf("%s (from %s): %v", s.Key, source, err)
+		}
+		sources[s.Key] = source
+	}
+	return vm, sources, nil
+}
+
+// resolvedVM looks up a VM and resolves it with the environment's
+// overrides.
+func (config Config) resolvedVM(name string) (VMConfig, error) {
+	vm, ok := config.VMs[name]
+	if !ok {
+		return VMConfig{}, fmt.Errorf("VM '%s' not found", name)
+	}
+	resolved, _, err := resolveVM(config.Defaults, vm, envOverrides())
+	return resolved, err
+}
+
+// displayVM is resolvedVM for listings, falling back to the stored values
+// when a setting doesn't parse; `config validate` reports those.
+func (config Config) displayVM(name string) VMConfig {
+	vm, err := config.resolvedVM(name)
+	if err != nil {
+		return config.VMs[name]
+	}
+	return vm
+}
+
+// fieldByPath finds the field of the struct v at a dotted JSON path.
+func fieldByPath(v reflect.Value, path string) (reflect.Value, error) {
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct || v.Type() == reflect.TypeOf(time.Time{}) {
+			return reflect.Value{}, fmt.Errorf("unknown key '%s'", path)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+			if tag == name {
+				v, found = v.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("unknown key '%s'", path)
+		}
+	}
+	return v, nil
+}
+
+// formatValue renders a config field the way `config set` accepts it.
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return ""
+		}
+		return formatValue(v.Elem())
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Slice:
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = v.Index(i).String()
+		}
+		return strings.Join(parts, ",")
+	case reflect.Map:
+		parts := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			parts = append(parts, key.String()+"="+v.MapIndex(key).String())
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ",")
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// setValue parses s into a config field. An empty s sets the zero value.
+func setValue(v reflect.Value, s string) error {
+	if s == "" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := setValue(elem.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", s)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("'%s' is not true or false", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var parts []string
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		v.Set(reflect.ValueOf(parts))
+	case reflect.Map:
+		m := map[string]string{}
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(p, "=")
+			if !ok {
+				return fmt.Errorf("'%s' is not key=value", p)
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("can't be set from the command line")
+	}
+	return nil
+}
+
+// getConfigKey returns the value at key: vms.<name>.<path> (resolved, for
+// settings), defaults.<setting>, or a top-level key.
+func getConfigKey(config Config, key string, o settingOverrides) (string, error) {
+	if rest, ok := strings.CutPrefix(key, "vms."); ok {
+		name, path, _ := strings.Cut(rest, ".")
+		vm, exists := config.VMs[name]
+		if !exists {
+			return "", fmt.Errorf("VM '%s' not found", name)
+		}
+		if _, ok := findSetting(path); ok {
+			var err error
+			if vm, _, err = resolveVM(config.Defaults, vm, o); err != nil {
+				return "", err
+			}
+		}
+		field, err := fieldByPath(reflect.ValueOf(&vm).Elem(), path)
+		if err != nil {
+			return "", err
+		}
+		return formatValue(field), nil
+	}
+
+	if setting, ok := strings.CutPrefix(key, "defaults."); ok {
+		if _, ok := findSetting(setting); !ok {
+			return "", fmt.Errorf("'%s' is not a setting with defaults", setting)
+		}
+		return config.Defaults[setting], nil
+	}
+
+	field, err := fieldByPath(reflect.ValueOf(&config).Elem(), key)
+	if err != nil || field.Kind() == reflect.Map {
+		return "", fmt.Errorf("unknown key '%s'", key)
+	}
+	return formatValue(field), nil
+}
+
+// setConfigKey sets key to value, or unsets it when value is empty, and
+// checks the result.
+func setConfigKey(config *Config, key, value string) error {
+	before := cloneConfig(*config)
+	switch {
+	case strings.HasPrefix(key, "vms."):
+		name, path, _ := strings.Cut(strings.TrimPrefix(key, "vms."), ".")
+		vm, exists := config.VMs[name]
+		if !exists {
+			return fmt.Errorf("VM '%s' not found", name)
+		}
+		if _, ok := findSetting(path); !ok && !settableVMKeys[path] {
+			return fmt.Errorf("'%s' can't be set", key)
+		}
+		field, err := fieldByPath(reflect.ValueOf(&vm).Elem(), path)
+		if err != nil {
+			return err
+		}
+		if err := setValue(field, value); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		config.VMs[name] = vm
+
+	case strings.HasPrefix(key, "defaults."):
+		setting := strings.TrimPrefix(key, "defaults.")
+		if _, ok := findSetting(setting); !ok {
+			return fmt.Errorf("'%s' is not a setting with defaults", setting)
+		}
+		if value == "" {
+			delete(config.Defaults, setting)
+			break
+		}
+		if config.Defaults == nil {
+			config.Defaults = map[string]string{}
+		}
+		config.Defaults[setting] = value
+
+	case settableConfigKeys[key]:
+		field, _ := fieldByPath(reflect.ValueOf(config).Elem(), key)
+		setValue(field, value)
+		if key == "default_vm" && value != "" {
+			if _, exists := config.VMs[value]; !exists {
+				return fmt.Errorf("VM '%s' not found", value)
+			}
+		}
+
+	default:
+		return fmt.Errorf("'%s' can't be set", key)
+	}
+
+	violations, _ := settingViolations(*config)
+	violations = append(violations, newPortClashes(before, *config)...)
+	if len(violations) > 0 {
+		msgs := make([]string, len(violations))
+		for i, v := range violations {
+			msgs[i] = v.Path + " " + v.Message
+		}
+		return fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return checkHibernatedSize(before, *config)
+}
+
+// settingViolations checks the defaults block and every VM as resolved
+// from the config file (without environment or flag overrides). It also
+// returns the resolved VMs.
+func settingViolations(config Config) ([]configViolation, map[string]VMConfig) {
+	var violations []configViolation
+
+	scratch := VMConfig{Name: "defaults"}
+	for key, value := range config.Defaults {
+		setting, ok := findSetting(key)
+		if !ok {
+			violations = append(violations, configViolation{Path: "defaults." + key, Message: "is not a setting with defaults"})
+			continue
+		}
+		field, _ := fieldByPath(reflect.ValueOf(&scratch).Elem(), setting.Key)
+		if err := setValue(field, value); err != nil {
+			violations = append(violations, configViolation{Path: "defaults." + key, Message: err.Error()})
+		}
+	}
+
+	resolved := Config{}
+	if config.VMs != nil {
+		resolved.VMs = map[string]VMConfig{}
+	}
+	for name, vm := range config.VMs {
+		r, _, err := resolveVM(config.Defaults, vm, settingOverrides{})
+		if err != nil {
+			violations = append(violations, configViolation{Path: "vms." + name, Message: err.Error()})
+			continue
+		}
+		resolved.VMs[name] = r
+	}
+	resolved.PortRange = config.PortRange
+	resolved.MemOvercommit = config.MemOvercommit
+	resolved.CPUOvercommit = config.CPUOvercommit
+	resolved.HostReserve = config.HostReserve
+	resolved.MetricsInterval = config.MetricsInterval
+	resolved.MetricsRetention = config.MetricsRetention
+	violations = append(violations, fieldViolations(validate.Struct(resolved))...)
+	return violations, resolved.VMs
+}
+
+// configGet is the `avm-go config get` action.
+func configGet(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: avm-go config get <key.path>")
+	}
+	config, err := loadConfig(configPathFlag(c))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	value, err := getConfigKey(config, c.Args().First(), contextOverrides(c))
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
+// configSet is the `avm-go config set` action.
+func configSet(c *cli.Context) error {
+	if c.NArg() != 2 || c.Args().Get(1) == "" {
+		return fmt.Errorf("usage: avm-go config set <key.path> <value>")
+	}
+	key, value := c.Args().Get(0), c.Args().Get(1)
+
+	config, err := updateConfig(configPathFlag(c), func(config *Config) error {
+		return setConfigKey(config, key, value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %v", key, err)
+	}
+
+	color.Green("✅ %s = %s", key, value)
+	warnIfRunning(config, key)
+	return nil
+}
+
+// configUnset is the `avm-go config unset` action.
+func configUnset(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: avm-go config unset <key.path>")
+	}
+	key := c.Args().First()
+
+	config, err := updateConfig(configPathFlag(c), func(config *Config) error {
+		return setConfigKey(config, key, "")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unset %s: %v", key, err)
+	}
+
+	color.Green("✅ %s unset", key)
+	warnIfRunning(config, key)
+	return nil
+}
+
+// warnIfRunning tells the user that a changed VM setting applies from the
+// VM's next start.
+func warnIfRunning(config Config, key string) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(key, "vms."), ".")
+	if vm, ok := config.VMs[name]; ok && strings.HasPrefix(key, "vms.") && vm.Status.Active() {
+		color.Yellow("⚠️  VM '%s' is %s; the change takes effect on its next start", name, vm.Status)
+	}
+}
+
+// resolvedSetting is one row of `config show --resolved`.
+type resolvedSetting struct {
+	VM     string `json:"vm"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// showConfig is the `avm-go config show` action.
+func showConfig(c *cli.Context) error {
+	config, err := loadConfig(configPathFlag(c))
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	if !c.Bool("resolved") {
+		jsonData, _ := json.MarshalIndent(config, "", "  ")
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	var names []string
+	if name := c.String("vm"); name != "" {
+		if _, ok := config.VMs[name]; !ok {
+			return fmt.Errorf("VM '%s' not found", name)
+		}
+		names = []string{name}
+	} else {
+		for name := range config.VMs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	overrides := contextOverrides(c)
+	var rows []resolvedSetting
+	for _, name := range names {
+		vm, sources, err := resolveVM(config.Defaults, config.VMs[name], overrides)
+		if err != nil {
+			return fmt.Errorf("VM '%s': %v", name, err)
+		}
+		for _, s := range vmSettings {
+			field, _ := fieldByPath(reflect.ValueOf(&vm).Elem(), s.Key)
+			rows = append(rows, resolvedSetting{VM: name, Key: s.Key, Value: formatValue(field), Source: sources[s.Key]})
+		}
+	}
+
+	if c.Bool("json") {
+		jsonData, _ := json.MarshalIndent(rows, "", "  ")
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"VM", "Key", "Value", "Source"})
+	for _, row := range rows {
+		table.Append([]string{row.VM, row.Key, row.Value, row.Source})
+	}
+	table.Render()
+	return nil
+}
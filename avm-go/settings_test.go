@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveVMLayers(t *testing.T) {
+	defaults := map[string]string{"ram": "1G", "cpu": "4", "restart_policy": "on-failure"}
+	vm := VMConfig{Name: "dev", CPU: "3", SSHPort: "2301"}
+	overrides := settingOverrides{
+		Env:   map[string]string{"ssh_port": "2400", "ram": "3G"},
+		Flags: map[string]string{"ram": "512M"},
+	}
+
+	got, sources, err := resolveVM(defaults, vm, overrides)
+	if err != nil {
+		t.Fatalf("resolveVM failed: %v", err)
+	}
+
+	expected := map[string][2]string{
+		"ram":               {"512M", "flag --ram"},
+		"cpu":               {"3", sourceVM},
+		"ssh_port":          {"2400", "env AVM_SSH_PORT"},
+		"image":             {"alpine-vm.qcow2", sourceBuiltin},
+		"restart_policy":    {"on-failure", sourceDefaults},
+		"resources.max_ram": {"", sourceBuiltin},
+		"resources.max_cpu": {"4", sourceBuiltin},
+	}
+	for key, want := range expected {
+		value, err := getConfigKey(Config{VMs: map[string]VMConfig{"dev": got}}, "vms.dev."+key, settingOverrides{})
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		if value != want[0] || sources[key] != want[1] {
+			t.Errorf("%s = %q from %q, expected %q from %q", key, value, sources[key], want[0], want[1])
+		}
+	}
+}
+
+func TestSetConfigKey(t *testing.T) {
+	config := Config{VMs: map[string]VMConfig{"dev": {Name: "dev", RAM: "2048"}}}
+
+	if err := setConfigKey(&config, "defaults.cpu", "4"); err != nil {
+		t.Fatalf("set defaults.cpu: %v", err)
+	}
+	if err := setConfigKey(&config, "vms.dev.depends_on", "db, cache"); err != nil {
+		t.Fatalf("set vms.dev.depends_on: %v", err)
+	}
+	if err := setConfigKey(&config, "vms.dev.ram", ""); err != nil {
+		t.Fatalf("unset vms.dev.ram: %v", err)
+	}
+
+	if value, _ := getConfigKey(config, "vms.dev.cpu", settingOverrides{}); value != "4" {
+		t.Errorf("Expected cpu 4 from defaults, got %q", value)
+	}
+	if value, _ := getConfigKey(config, "vms.dev.ram", settingOverrides{}); value != "2048" {
+		t.Errorf("Expected unset ram to fall back to 2048, got %q", value)
+	}
+	if deps := config.VMs["dev"].DependsOn; len(deps) != 2 || deps[1] != "cache" {
+		t.Errorf("Unexpected depends_on %v", deps)
+	}
+	if err := setConfigKey(&config, "vms.dev.labels", "team=infra, env=prod"); err != nil {
+		t.Fatalf("set vms.dev.labels: %v", err)
+	}
+	if value, _ := getConfigKey(config, "vms.dev.labels", settingOverrides{}); value != "env=prod,team=infra" {
+		t.Errorf("Expected sorted labels, got %q", value)
+	}
+
+	for key, value := range map[string]string{
+		"vms.dev.ram":            "lots",
+		"vms.dev.status":         "running",
+		"vms.dev.autostart":      "maybe",
+		"defaults.name":          "x",
+		"default_vm":             "missing",
+		"vms.dev.restart_policy": "sometimes",
+		"vms.dev.labels":         "team",
+	} {
+		c := Config{VMs: map[string]VMConfig{"dev": {Name: "dev"}}}
+		if err := setConfigKey(&c, key, value); err == nil {
+			t.Errorf("Expected %s = %s to be rejected", key, value)
+		}
+	}
+}
+
+func TestResolveVMExplicitZero(t *testing.T) {
+	defaults := map[string]string{"autostart": "true", "resources.max_cpu": "8"}
+	vm := VMConfig{Name: "dev", Autostart: ptrTo(false), Resources: VMResources{MaxCPU: ptrTo(0)}}
+
+	got, sources, err := resolveVM(defaults, vm, settingOverrides{})
+	if err != nil {
+		t.Fatalf("resolveVM failed: %v", err)
+	}
+	if orZero(got.Autostart) || sources["autostart"] != sourceVM {
+		t.Errorf("Expected the VM's autostart=false to win, got %v from %s", orZero(got.Autostart), sources["autostart"])
+	}
+	if got.Resources.MaxCPU == nil || *got.Resources.MaxCPU != 0 || sources["resources.max_cpu"] != sourceVM {
+		t.Errorf("Expected the VM's max_cpu=0 to win, got %v from %s", got.Resources.MaxCPU, sources["resources.max_cpu"])
+	}
+
+	unset, _, _ := resolveVM(defaults, VMConfig{Name: "other"}, settingOverrides{})
+	if !orZero(unset.Autostart) || orZero(unset.Resources.MaxCPU) != 8 {
+		t.Errorf("Expected an unset VM to take the defaults, got %+v", unset)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultShutdownTimeout = 60 * time.Second
+	// Time allowed between SIGTERM and SIGKILL.
+	terminateGracePeriod = 10 * time.Second
+)
+
+// shutdownOptions controls how a VM is brought down.
+type shutdownOptions struct {
+	Timeout time.Duration // how long the guest gets to power off after ACPI powerdown
+	Force   bool          // skip the guest and kill the process group immediately
+}
+
+// waitExit waits up to timeout for the process to exit. When done is nil
+// the PID is polled instead.
+func waitExit(pid int, done <-chan struct{}, timeout time.Duration) bool {
+	if done != nil {
+		select {
+		case <-done:
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			return true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return !processAlive(pid)
+}
+
+// shutdownVM brings a VM down in escalating steps: ACPI system_powerdown
+// over QMP, then SIGTERM and finally SIGKILL to the whole process group.
+func shutdownVM(vm VMConfig, pid int, done <-chan struct{}, opts shutdownOptions) error {
+	fields := logrus.Fields{"action": "stop", "vm": vm.Name, "pid": pid}
+
+	if opts.Force {
+		log.WithFields(fields).Info("Force stop requested, killing process group")
+		if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+			return fmt.Errorf("failed to kill VM '%s': %v", vm.Name, err)
+		}
+		waitExit(pid, done, terminateGracePeriod)
+		return nil
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultShutdownTimeout
+	}
+
+	if err := powerdownVM(vm); err != nil {
+		log.WithFields(fields).Warnf("ACPI powerdown unavailable: %v", err)
+	} else {
+		log.WithFields(fields).Infof("Sent system_powerdown, waiting up to %s", opts.Timeout)
+		if waitExit(pid, done, opts.Timeout) {
+			return nil
+		}
+		log.WithFields(fields).Warn("Guest did not power off in time")
+	}
+
+	if err := signalGroup(pid, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to stop VM '%s': %v", vm.Name, err)
+	}
+	if waitExit(pid, done, terminateGracePeriod) {
+		return nil
+	}
+
+	log.WithFields(fields).Warn("VM ignored SIGTERM, sending SIGKILL")
+	if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("failed to kill VM '%s': %v", vm.Name, err)
+	}
+	if !waitExit(pid, done, terminateGracePeriod) {
+		return fmt.Errorf("VM '%s' (PID %d) survived SIGKILL", vm.Name, pid)
+	}
+	return nil
+}
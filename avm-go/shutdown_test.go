@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ghost-chain-unity/proot-avm-go/qmp"
+	"github.com/ghost-chain-unity/proot-avm-go/qmp/qmptest"
+)
+
+func startSleeper(t *testing.T) (*exec.Cmd, chan struct{}) {
+	cmd := exec.Command("sleep", "60")
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Skipf("sleep not available: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	return cmd, done
+}
+
+func TestShutdownVMPowerdown(t *testing.T) {
+	cmd, done := startSleeper(t)
+	vm := VMConfig{Name: fmt.Sprintf("test-powerdown-%d", os.Getpid())}
+
+	// Fake QMP server: the "guest" powers off when asked to.
+	server, err := qmptest.NewServer(qmpSocketPath(vm))
+	if err != nil {
+		t.Fatalf("Failed to start fake QMP server: %v", err)
+	}
+	defer server.Close()
+	server.Handle("system_powerdown", func(json.RawMessage) (interface{}, *qmp.Error) {
+		cmd.Process.Kill()
+		return struct{}{}, nil
+	})
+
+	if err := shutdownVM(vm, cmd.Process.Pid, done, shutdownOptions{Timeout: 5 * time.Second}); err != nil {
+		t.Fatalf("shutdownVM failed: %v", err)
+	}
+
+	commands := server.Commands()
+	if commands[len(commands)-1] != "system_powerdown" {
+		t.Errorf("Expected system_powerdown, got %v", commands)
+	}
+}
+
+func TestShutdownVMFallsBackToSignals(t *testing.T) {
+	cmd, done := startSleeper(t)
+	vm := VMConfig{Name: fmt.Sprintf("test-nomonitor-%d", os.Getpid())}
+
+	start := time.Now()
+	if err := shutdownVM(vm, cmd.Process.Pid, done, shutdownOptions{Timeout: time.Second}); err != nil {
+		t.Fatalf("shutdownVM failed: %v", err)
+	}
+
+	select {
+	case <-done:
+	default:
+		t.Error("Expected process to be gone after shutdown")
+	}
+	if time.Since(start) > terminateGracePeriod {
+		t.Error("Expected SIGTERM to stop the process without escalating")
+	}
+}
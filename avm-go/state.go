@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// VMState is a VM's lifecycle state as stored in VMConfig.Status.
+type VMState string
+
+const (
+	StateCreating VMState = "creating"
+	StateStarting VMState = "starting"
+	StateRunning  VMState = "running"
+	StatePausing  VMState = "pausing"
+	StatePaused   VMState = "paused"
+	StateStopping VMState = "stopping"
+	StateStopped  VMState = "stopped"
+	StateCrashed  VMState = "crashed"
+)
+
+// vmTransitions lists the legal next states for every state.
+var vmTransitions = map[VMState][]VMState{
+	StateCreating: {StateStopped},
+	StateStarting: {StateRunning, StateStopping, StateStopped, StateCrashed},
+	StateRunning:  {StatePausing, StateStopping, StateStopped, StateCrashed},
+	StatePausing:  {StatePaused, StateRunning, StateStopping, StateCrashed},
+	StatePaused:   {StateRunning, StateStopping, StateCrashed},
+	StateStopping: {StateStopped, StateCrashed},
+	StateStopped:  {StateStarting},
+	StateCrashed:  {StateStarting, StateStopped},
+}
+
+// parseVMState normalizes a stored status, mapping the empty value and the
+// legacy "suspended" status onto the current states.
+func parseVMState(s string) (VMState, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return StateStopped, nil
+	case "suspended":
+		return StatePaused, nil
+	}
+
+	state := VMState(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := vmTransitions[state]; !ok {
+		return "", fmt.Errorf("unknown VM state '%s'", s)
+	}
+	return state, nil
+}
+
+// CanTransition reports whether moving from s to next is legal.
+func (s VMState) CanTransition(next VMState) bool {
+	for _, allowed := range vmTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether a VM in this state has a live process.
+func (s VMState) Active() bool {
+	switch s {
+	case StateStarting, StateRunning, StatePausing, StatePaused, StateStopping:
+		return true
+	}
+	return false
+}
+
+// transition moves the VM to next, refusing illegal transitions.
+func (vm *VMConfig) transition(next VMState) error {
+	current, err := parseVMState(string(vm.Status))
+	if err != nil {
+		return err
+	}
+	if current == next {
+		return nil
+	}
+	if !current.CanTransition(next) {
+		return fmt.Errorf("VM '%s' cannot go from %s to %s", vm.Name, current, next)
+	}
+	vm.Status = next
+	return nil
+}
+
+// readPIDFile returns the PID stored in path.
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid PID file %s: %v", path, err)
+	}
+	return pid, nil
+}
+
+// vmPID returns the PID of the VM's process if it is alive. After a
+// reboot or PID wrap the PID file can name an unrelated process, which
+// doesn't count.
+func vmPID(vm VMConfig) (int, bool) {
+	pid, err := readPIDFile(vmPIDFile(vm))
+	if err != nil {
+		return 0, false
+	}
+	return pid, processAlive(pid) && isVMProcess(vm, pid)
+}
+
+// isVMProcess reports whether pid's command line is vm's QEMU, recognised
+// by its QMP socket or, for VMs started before they had one, its image.
+// Without a /proc to read, a live PID is trusted.
+func isVMProcess(vm VMConfig, pid int) bool {
+	if _, err := os.Stat(procRoot); err != nil {
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	cmdline := string(data)
+	return strings.Contains(cmdline, qmpSocketPath(vm)) || vm.Image != "" && strings.Contains(cmdline, vmImagePath(vm))
+}
+
+// reconcileVM corrects the stored state against the real process and
+// reports whether anything changed. A VM whose process vanished while it
+// was meant to be up is marked crashed; a live process behind a stopped
+// record is adopted as running. Starting VMs are left to the daemon, which
+// records them before their PID file exists.
+func reconcileVM(vm *VMConfig) bool {
+	state, err := parseVMState(string(vm.Status))
+	if err != nil {
+		log.Warnf("VM '%s' has %v, treating it as stopped", vm.Name, err)
+		state = StateStopped
+	}
+	changed := state != vm.Status
+	vm.Status = state
+
+	_, alive := vmPID(*vm)
+	switch {
+	case state == StateCreating, state == StateStarting:
+		// No process yet, nothing to compare against.
+	case state.Active() && !alive:
+		if state == StateStopping {
+			vm.Status = StateStopped
+		} else {
+			vm.Status = StateCrashed
+		}
+		os.Remove(vmPIDFile(*vm))
+		changed = true
+	case !state.Active() && alive:
+		vm.Status = StateRunning
+		changed = true
+	}
+	return changed
+}
+
+// loadReconciledConfig loads the config and reconciles every VM's state
+// with its process, persisting any corrections.
+func loadReconciledConfig(configPath string) (Config, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return config, err
+	}
+
+	stale := false
+	for _, vm := range config.VMs {
+		if reconcileVM(&vm) {
+			stale = true
+		}
+	}
+	if !stale {
+		return config, nil
+	}
+
+	// Reconcile again under the write lock so a concurrent update isn't lost.
+	reconciled, err := updateConfig(configPath, func(config *Config) error {
+		for name, vm := range config.VMs {
+			if reconcileVM(&vm) {
+				log.Infof("Reconciled VM '%s' state to %s", name, vm.Status)
+				config.VMs[name] = vm
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Failed to save reconciled config: %v", err)
+		return config, nil
+	}
+	return reconciled, nil
+}
+
+// stateIcon returns the status icon shown next to a state in tables.
+func stateIcon(state VMState) string {
+	switch state {
+	case StateRunning:
+		return "🟢"
+	case StatePaused, StatePausing, StateStarting, StateStopping, StateCreating:
+		return "🟡"
+	case StateCrashed:
+		return "💥"
+	}
+	return "🔴"
+}
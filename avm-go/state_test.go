@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVMStateTransitions(t *testing.T) {
+	cases := []struct {
+		from, to VMState
+		legal    bool
+	}{
+		{StateStopped, StateStarting, true},
+		{StateStarting, StateRunning, true},
+		{StateRunning, StatePausing, true},
+		{StatePaused, StateRunning, true},
+		{StateRunning, StateCrashed, true},
+		{StateCrashed, StateStarting, true},
+		{StateStopped, StateRunning, false},
+		{StateStopped, StatePaused, false},
+		{StateCreating, StateRunning, false},
+	}
+
+	for _, tc := range cases {
+		if got := tc.from.CanTransition(tc.to); got != tc.legal {
+			t.Errorf("%s -> %s: expected legal=%v, got %v", tc.from, tc.to, tc.legal, got)
+		}
+	}
+}
+
+func TestParseVMStateLegacy(t *testing.T) {
+	if state, _ := parseVMState(""); state != StateStopped {
+		t.Errorf("Expected empty status to be stopped, got %s", state)
+	}
+	if state, _ := parseVMState("suspended"); state != StatePaused {
+		t.Errorf("Expected suspended to map to paused, got %s", state)
+	}
+	if _, err := parseVMState("sleeping"); err == nil {
+		t.Error("Expected unknown status to be rejected")
+	}
+}
+
+func TestReconcileVM(t *testing.T) {
+	dir := t.TempDir()
+
+	// A running record whose PID file points at nothing is a crash.
+	ghost := VMConfig{Name: "ghost", Status: StateRunning, PIDFile: filepath.Join(dir, "ghost.pid")}
+	if !reconcileVM(&ghost) || ghost.Status != StateCrashed {
+		t.Errorf("Expected ghost VM to be reconciled to crashed, got %s", ghost.Status)
+	}
+
+	// A stopped record with a live process is adopted as running, but
+	// only if that process is the VM's QEMU.
+	p := withFakeProc(t, 100)
+	livePID := filepath.Join(dir, "live.pid")
+	os.WriteFile(livePID, []byte(fmt.Sprintf("%d", os.Getpid())), 0644)
+	live := VMConfig{Name: "live", Status: StateStopped, PIDFile: livePID}
+	p.cmdline(os.Getpid(), "/usr/sbin/sshd", "-D")
+	if reconcileVM(&live) || live.Status != StateStopped {
+		t.Errorf("Expected an unrelated process not to be adopted, got %s", live.Status)
+	}
+	p.cmdline(os.Getpid(), "proot-distro", "login", "alpine", "--", "bash", "-c", "qemu-system-x86_64 -qmp unix:"+qmpSocketPath(live)+",server=on,wait=off")
+	if !reconcileVM(&live) || live.Status != StateRunning {
+		t.Errorf("Expected live VM to be reconciled to running, got %s", live.Status)
+	}
+
+	// A stopping VM whose process is gone finished stopping.
+	stopping := VMConfig{Name: "stopping", Status: StateStopping, PIDFile: filepath.Join(dir, "none.pid")}
+	reconcileVM(&stopping)
+	if stopping.Status != StateStopped {
+		t.Errorf("Expected stopping VM to be reconciled to stopped, got %s", stopping.Status)
+	}
+
+	// A starting VM has no PID file until the daemon spawns it.
+	starting := VMConfig{Name: "starting", Status: StateStarting, PIDFile: filepath.Join(dir, "none.pid")}
+	if reconcileVM(&starting) || starting.Status != StateStarting {
+		t.Errorf("Expected starting VM to be left alone, got %s", starting.Status)
+	}
+}